@@ -121,10 +121,19 @@ class App {
       
       let alertMsg = "Operation completed successfully";
 
+      // exit codes of roe-cli
+      let exitMessages = {
+        3: `Wrong decryption password.`,
+        4: `The image is corrupted.`,
+        5: `The image is truncated.`,
+        6: `Not an image encrypted with roe.`,
+        7: `Some parts of the file are missing.`
+      };
+
       let trim = (str) => `${str}`.length > 200 ? `${str.substring(0, 197).trim()}...` : `${str}`.trim();
 
       if (resp.error) {
-        alertMsg = `${resp.stdout}`.match(/failed to decrypt/) ? `Wrong decryption password.` : `An error occurred.`;
+        alertMsg = exitMessages[resp.error.code] || `An error occurred.`;
         alertMsg += `\n\n`;
         alertMsg += `message: ${trim(resp.error.message)}\n`;
         alertMsg += `stdout: ${trim(resp.stdout)}\n`;
@@ -157,10 +166,10 @@ class App {
     this.elements.sendBtn.innerText = (state.action === 'encrypt') ? "Encrypt" : "Decrypt";
     this.elements.actionMsg.innerText = (state.action === 'encrypt') ? 
       "Encrypt any file (or a folder recursively) into a valid .bmp image. Big files are splitted." : 
-      "Decrypt a .bmp image (or a folder recursively) back to the original file.";
+      "Decrypt a .bmp, .png or .wav file (or a folder recursively) back to the original file.";
     this.elements.inputBtn.innerText = (state.action === 'encrypt') ? 
       "Select files..." :
-      "Select .bmp images...";
+      "Select .bmp, .png or .wav files...";
 
     // busy or not?
     [this.elements.pass, this.elements.passConf].forEach(e => e.disabled = state.running);
@@ -182,7 +191,7 @@ class App {
 
     // open file dialog to select input file(s)
     this.elements.inputBtn.onclick = function() {
-      let filters = (state.action === 'encrypt') ? [{name: 'All Files', extensions: ['*']}] : [{name: 'Images', extensions: ['bmp']}]
+      let filters = (state.action === 'encrypt') ? [{name: 'All Files', extensions: ['*']}] : [{name: 'Images and sounds', extensions: ['bmp', 'png', 'wav']}]
       nodeapis.dialog.showOpenDialog({ properties: ['openFile', 'multiSelections'], filters: filters })
         .then((resp) => {
           if (resp.canceled) return;
@@ -4,53 +4,155 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/howeyc/gopass"
+	"github.com/topac/roe/pkg/roe"
+	"golang.org/x/term"
 )
 
 const splitDefVal = 24000000
 
+// stringList is a flag.Value collecting the values of a flag given many times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
 // CLIOpts describes all possible arguments and options available in the command-line interface.
 type CLIOpts struct {
-	Input     []string
-	InputDir  string
-	Outdir    string
-	Encrypt   bool
-	Decrypt   bool
-	Recursive bool
-	Password  string
-	Split     int
+	Input        []string
+	InputDir     string
+	Outdir       string
+	Encrypt      bool
+	Decrypt      bool
+	Recursive    bool
+	Password     string
+	Keyfile      []byte
+	Split        int64
+	KDF          roe.KDFParams
+	Cipher       roe.Cipher
+	NameTemplate string
+	Preserve     roe.Preserve
+	Compression  roe.CompressionParams
+	Container    roe.Container
+	Dimensions   roe.Dimensions
+	KDFLimits    roe.KDFLimits
+	Covers       []image.Image
+	Progress     bool
+	Jobs         int
+	Recipients   []roe.Recipient
+	Identities   []roe.Identity
+	keyfile      string
+	preserve     string
+	compress     string
+	format       string
+	aspect       string
+	covers       stringList
+	kdfSpec      string
+	cipher       string
+	recipients   stringList
+	recFiles     stringList
+	sshFiles     stringList
+	idFiles      stringList
 }
 
 // StartCLI init the command line interface, returning Opts and any validation errors of the Opts.
 // When error is not nil, the Opts are not valid and the program should not rely on them.
 func StartCLI() (CLIOpts, error) {
 	var outdir string
-	var encrypt, decrypt, recursive bool
-	var password string
-	var split int
+	var encrypt, decrypt, recursive, progress bool
+	var password, keyfile string
+	var split int64
+	var jobs int
+	var kdf, cipher string
+	var nameTemplate string
+	var hideName bool
+	var preserve string
+	var compress string
+	var format string
+	var maxWidth, maxHeight, maxPixels int64
+	var maxKDFMemory uint
+	var aspect string
+	var recipients, recFiles, sshFiles, idFiles, covers stringList
 
 	flag.StringVar(&outdir, "outdir", ".", "Output directory")
 	flag.StringVar(&password, "p", "", "Password")
+	flag.StringVar(&keyfile, "keyfile", "", "Mix the content of the given file into the key, alone or along with a password, prompted on a terminal when -p is not given")
 	flag.BoolVar(&encrypt, "encrypt", false, "Encrypt mode")
 	flag.BoolVar(&decrypt, "decrypt", false, "Decrypt mode")
 	flag.BoolVar(&recursive, "recursive", false, "Traverse directories recursively")
-	flag.IntVar(&split, "split", splitDefVal, "Split every N bytes")
+	flag.BoolVar(&progress, "progress", false, "Show a progress bar instead of the list of the images written")
+	flag.Int64Var(&split, "split", splitDefVal, "Split every N bytes")
+	flag.IntVar(&jobs, "jobs", 1, "Number of files encrypted or decrypted at the same time with -recursive")
+	flag.StringVar(&kdf, "kdf", roe.DefaultKDFParams.String(), "Key derivation function and its costs, for e.g. \"argon2id,t=3,m=65536,p=4\" or \"scrypt,n=32768,r=8,p=1\"")
+	flag.UintVar(&maxKDFMemory, "max-kdf-memory", uint(roe.DefaultKDFLimits.Memory), "Maximum memory in KiB of the key derivation of a password slot when decrypting")
+	flag.StringVar(&cipher, "cipher", roe.DefaultCipher.String(), "Cipher, aes256gcm or xchacha20poly1305")
+	flag.StringVar(&nameTemplate, "name-template", roe.DefaultNameTemplate, "Name of the images, {name} is the original filename, {rand} a random string and {date} the current date")
+	flag.BoolVar(&hideName, "hide-name", false, "Give the images random names, same as -name-template {rand}")
+	flag.StringVar(&preserve, "preserve", roe.PreserveAll.String(), "Attributes of the files restored on decryption: mtime, mode, xattrs, all or none")
+	flag.StringVar(&compress, "compress", roe.CompressionParams{}.String(), "Compress the files before encrypting them, for e.g. \"zstd\", \"zstd,level=19\" or \"deflate,level=9\"")
+	flag.StringVar(&format, "format", roe.DefaultContainer.Name(), "Format of the files written: bmp, png or wav")
+	flag.Int64Var(&maxWidth, "max-width", 0, "Maximum width of the images in pixels, the files are splitted to fit")
+	flag.Int64Var(&maxHeight, "max-height", 0, "Maximum height of the images in pixels, the files are splitted to fit")
+	flag.Int64Var(&maxPixels, "max-pixels", 0, "Maximum number of pixels of the images, the files are splitted to fit")
+	flag.StringVar(&aspect, "aspect", "", "Aspect ratio of the images, for e.g. \"4:3\" or \"16:9\", square by default")
+	flag.Var(&covers, "cover", "Hide the encrypted data in the given photo instead of writing noise, can be repeated to hold the parts of larger files")
+	flag.Var(&recipients, "recipient", "Encrypt to the given public key instead of using a password, can be repeated")
+	flag.Var(&recFiles, "recipients-file", "Encrypt to the public keys listed in the given file, can be repeated")
+	flag.Var(&sshFiles, "ssh-recipient", "Encrypt to the ssh-ed25519 or ssh-rsa public keys of the given file, for e.g. ~/.ssh/id_ed25519.pub, can be repeated")
+	flag.Var(&idFiles, "identity", "Decrypt using the private keys of the given file (or an ssh private key) instead of a password, can be repeated")
 	setUsage(flag.CommandLine)
 	flag.Parse()
 
 	opts := CLIOpts{
-		Input:     flag.Args(),
-		Outdir:    outdir,
-		Encrypt:   encrypt,
-		Decrypt:   decrypt,
-		Recursive: recursive,
-		Password:  password,
-		Split:     split,
+		Input:        flag.Args(),
+		Outdir:       outdir,
+		Encrypt:      encrypt,
+		Decrypt:      decrypt,
+		Recursive:    recursive,
+		Progress:     progress,
+		Password:     password,
+		keyfile:      keyfile,
+		Split:        split,
+		Jobs:         jobs,
+		NameTemplate: nameTemplate,
+		preserve:     preserve,
+		compress:     compress,
+		format:       format,
+		Dimensions:   roe.Dimensions{MaxWidth: maxWidth, MaxHeight: maxHeight, MaxPixels: maxPixels},
+		KDFLimits:    roe.KDFLimits{Memory: uint32(maxKDFMemory)},
+		aspect:       aspect,
+		covers:       covers,
+		kdfSpec:      kdf,
+		cipher:       cipher,
+		recipients:   recipients,
+		recFiles:     recFiles,
+		sshFiles:     sshFiles,
+		idFiles:      idFiles,
+	}
+
+	if maxKDFMemory > math.MaxUint32 {
+		return opts, fmt.Errorf("invalid -max-kdf-memory %d, the maximum is %d", maxKDFMemory, uint32(math.MaxUint32))
+	}
+
+	if hideName {
+		if nameTemplate != roe.DefaultNameTemplate {
+			return opts, fmt.Errorf("-hide-name and -name-template flags are mutually exclusive")
+		}
+		opts.NameTemplate = roe.RandomNameTemplate
 	}
 
 	return opts, validate(&opts)
@@ -110,19 +212,222 @@ func validate(opts *CLIOpts) error {
 	if opts.Split < 1000000 {
 		return fmt.Errorf("-split flag is invalid: cannot be less than 1MB")
 	}
+	if opts.Split > roe.MaxSplit {
+		return fmt.Errorf("-split flag is invalid: cannot be greater than %d, the size limit of an image", roe.MaxSplit)
+	}
 	if opts.Split != splitDefVal && opts.Decrypt {
 		return fmt.Errorf("-split flag is accepted only with -encrypt")
 	}
 
+	// validate -jobs flag
+	if opts.Jobs < 1 {
+		return fmt.Errorf("-jobs flag is invalid: cannot be less than 1")
+	}
+	if opts.Jobs != 1 && opts.InputDir == "" {
+		return fmt.Errorf("-jobs flag is accepted only with -recursive")
+	}
+
+	// validate -kdf flag
+	kdf, err := roe.ParseKDFParams(opts.kdfSpec)
+	if err != nil {
+		return fmt.Errorf("-kdf flag is invalid: %v", err)
+	}
+	if kdf != roe.DefaultKDFParams && opts.Decrypt {
+		return fmt.Errorf("-kdf flag is accepted only with -encrypt, the parameters are read from the images")
+	}
+	opts.KDF = kdf
+
+	// validate -cipher flag
+	c, err := roe.ParseCipher(opts.cipher)
+	if err != nil {
+		return fmt.Errorf("-cipher flag is invalid: %v", err)
+	}
+	if c != roe.DefaultCipher && opts.Decrypt {
+		return fmt.Errorf("-cipher flag is accepted only with -encrypt, the cipher is read from the images")
+	}
+	opts.Cipher = c
+
+	// validate -name-template flag, the original filenames are always restored on decryption
+	if err := roe.ValidateNameTemplate(opts.NameTemplate); err != nil {
+		return fmt.Errorf("-name-template flag is invalid: %v", err)
+	}
+	if opts.NameTemplate != roe.DefaultNameTemplate && opts.Decrypt {
+		return fmt.Errorf("-name-template and -hide-name flags are accepted only with -encrypt")
+	}
+
+	// validate -preserve flag, the attributes are chosen when encrypting
+	p, err := roe.ParsePreserve(opts.preserve)
+	if err != nil {
+		return fmt.Errorf("-preserve flag is invalid: %v", err)
+	}
+	if p != roe.PreserveAll && opts.Decrypt {
+		return fmt.Errorf("-preserve flag is accepted only with -encrypt, the attributes stored in the images are always restored")
+	}
+	opts.Preserve = p
+
+	// validate -compress flag, the images record whether they have been compressed
+	comp, err := roe.ParseCompressionParams(opts.compress)
+	if err != nil {
+		return fmt.Errorf("-compress flag is invalid: %v", err)
+	}
+	if comp.Algorithm != roe.NoCompression && opts.Decrypt {
+		return fmt.Errorf("-compress flag is accepted only with -encrypt, the images are decompressed automatically")
+	}
+	opts.Compression = comp
+
+	// validate -format flag, the format of an image is detected when decrypting it
+	container, err := roe.ParseContainer(opts.format)
+	if err != nil {
+		return fmt.Errorf("-format flag is invalid: %v", err)
+	}
+	if container != roe.DefaultContainer && opts.Decrypt {
+		return fmt.Errorf("-format flag is accepted only with -encrypt, the format is detected automatically")
+	}
+	opts.Container = container
+
+	// validate -max-width, -max-height, -max-pixels and -aspect flags, without -split the
+	// size of the parts is the one of the largest image
+	if opts.aspect != "" {
+		a, err := roe.ParseAspect(opts.aspect)
+		if err != nil {
+			return fmt.Errorf("-aspect flag is invalid: %v", err)
+		}
+		opts.Dimensions.Aspect = a
+	}
+	if opts.Dimensions != (roe.Dimensions{}) {
+		if opts.Decrypt {
+			return fmt.Errorf("-max-width, -max-height, -max-pixels and -aspect flags are accepted only with -encrypt")
+		}
+		if opts.Dimensions.MaxWidth < 0 || opts.Dimensions.MaxHeight < 0 || opts.Dimensions.MaxPixels < 0 {
+			return fmt.Errorf("-max-width, -max-height and -max-pixels flags cannot be negative")
+		}
+		if container == roe.WAV {
+			return fmt.Errorf("-max-width, -max-height, -max-pixels and -aspect flags cannot be used with -format wav")
+		}
+		if opts.Split == splitDefVal {
+			opts.Split = roe.MaxSplit
+		}
+	}
+
+	// validate -cover flag, the size of the parts is the one the covers hold
+	if len(opts.covers) > 0 {
+		if opts.Decrypt {
+			return fmt.Errorf("-cover flag is accepted only with -encrypt, the data is found in the images automatically")
+		}
+		if opts.Dimensions != (roe.Dimensions{}) {
+			return fmt.Errorf("-cover flag cannot be used along with -max-width, -max-height, -max-pixels and -aspect, the images have the size of the covers")
+		}
+		if container == roe.WAV {
+			return fmt.Errorf("-cover flag cannot be used with -format wav")
+		}
+		for _, fp := range opts.covers {
+			img, err := readCover(fp)
+			if err != nil {
+				return fmt.Errorf("-cover flag is invalid: %v", err)
+			}
+			opts.Covers = append(opts.Covers, img)
+		}
+		if opts.Split == splitDefVal {
+			opts.Split = roe.MaxSplit
+		}
+	}
+
+	// validate -recipient, -recipients-file, -ssh-recipient and -identity flags
+	if (len(opts.recipients) > 0 || len(opts.recFiles) > 0 || len(opts.sshFiles) > 0) && !opts.Encrypt {
+		return fmt.Errorf("-recipient, -recipients-file and -ssh-recipient flags are accepted only with -encrypt")
+	}
+	if len(opts.idFiles) > 0 && !opts.Decrypt {
+		return fmt.Errorf("-identity flag is accepted only with -decrypt")
+	}
+	for _, s := range opts.recipients {
+		r, err := roe.ParseX25519Recipient(s)
+		if err != nil {
+			return fmt.Errorf("-recipient flag is invalid: %v", err)
+		}
+		opts.Recipients = append(opts.Recipients, r)
+	}
+	for _, fp := range opts.recFiles {
+		list, err := readRecipientsFile(fp)
+		if err != nil {
+			return fmt.Errorf("-recipients-file flag is invalid: %v", err)
+		}
+		opts.Recipients = append(opts.Recipients, list...)
+	}
+	for _, fp := range opts.sshFiles {
+		list, err := readRecipientsFile(fp)
+		if err != nil {
+			return fmt.Errorf("-ssh-recipient flag is invalid: %v", err)
+		}
+		opts.Recipients = append(opts.Recipients, list...)
+	}
+	for _, fp := range opts.idFiles {
+		list, err := readIdentitiesFile(fp)
+		if err != nil {
+			return fmt.Errorf("-identity flag is invalid: %v", err)
+		}
+		opts.Identities = append(opts.Identities, list...)
+	}
+	usesKeys := len(opts.Recipients) > 0 || len(opts.Identities) > 0
+	if usesKeys && opts.Password != "" {
+		return fmt.Errorf("-p flag cannot be used along with public keys")
+	}
+	if len(opts.Recipients) > 0 && opts.KDF != roe.DefaultKDFParams {
+		return fmt.Errorf("-kdf flag cannot be used along with -recipient")
+	}
+
+	// validate -keyfile flag, the keyfile can be used alone or with a password
+	if opts.keyfile != "" {
+		if usesKeys {
+			return fmt.Errorf("-keyfile flag cannot be used along with public keys")
+		}
+		keyfile, err := readKeyfile(opts.keyfile)
+		if err != nil {
+			return fmt.Errorf("-keyfile flag is invalid: %v", err)
+		}
+		opts.Keyfile = keyfile
+		if opts.Password == "" && stdinIsTerminal() {
+			fmt.Println("Type the password used along with the keyfile, leave it empty to use the keyfile alone.")
+			if opts.Encrypt {
+				readPasswordLoop(&opts.Password, true)
+			} else {
+				readPassword(&opts.Password)
+			}
+		}
+		if opts.Encrypt {
+			opts.Recipients = []roe.Recipient{roe.NewKeyfileRecipient(opts.Password, keyfile, opts.KDF)}
+		} else {
+			opts.Identities = []roe.Identity{roe.NewKeyfileIdentity(opts.Password, keyfile)}
+		}
+		return nil
+	}
+
 	// read the password
-	if opts.Password == "" {
-		readPasswordLoop(&opts.Password)
+	if opts.Password == "" && !usesKeys {
+		readPasswordLoop(&opts.Password, false)
 	}
 
 	return nil
 }
 
-func readPasswordLoop(password *string) {
+// stdinIsTerminal tells whether the passwords can be prompted, when the input is not
+// redirected
+func stdinIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// readPassword prompts once for a password, which may be empty.
+func readPassword(password *string) {
+	fmt.Printf("Type the password: ")
+	pwd, err := gopass.GetPasswd()
+	if err != nil {
+		os.Exit(1)
+	}
+	*password = string(pwd)
+}
+
+// readPasswordLoop prompts for a password until it is confirmed.
+// An empty password is accepted only when allowEmpty is true.
+func readPasswordLoop(password *string, allowEmpty bool) {
 	for {
 		fmt.Printf("Type the password: ")
 		pwd, err := gopass.GetPasswd()
@@ -130,6 +435,10 @@ func readPasswordLoop(password *string) {
 			os.Exit(1)
 		}
 		if len(pwd) == 0 {
+			if allowEmpty {
+				*password = ""
+				break
+			}
 			continue
 		}
 
@@ -151,18 +460,115 @@ func setUsage(f *flag.FlagSet) {
 	f.Usage = func() {
 		exe := path.Base(os.Args[0])
 		fmt.Printf("Usage: %s [options] input\n", exe)
+		fmt.Printf("       %s keygen [-o file]\n", exe)
+		fmt.Printf("       %s slot list|add|remove [options] image\n", exe)
 		fmt.Println("\nExamples:")
 		fmt.Printf("  %s -encrypt -outdir /tmp/ jazz.mp3\n", exe)
 		fmt.Printf("  %s -encrypt *.pdf\n", exe)
 		fmt.Printf("  %s -encrypt -recursive -outdir /tmp/ /home/John/Movies\n", exe)
+		fmt.Printf("  %s -encrypt -kdf scrypt,n=1048576 secrets.txt\n", exe)
+		fmt.Printf("  %s -encrypt -recipient roepk1... -recipients-file team.txt report.pdf\n", exe)
 		fmt.Printf("  %s -decrypt invoice.pdf.bmp\n", exe)
+		fmt.Printf("  %s -encrypt -keyfile /media/usb/blob report.pdf\n", exe)
+		fmt.Printf("  %s -encrypt -hide-name -recursive -outdir /tmp/ /home/John/Documents\n", exe)
+		fmt.Printf("  %s -encrypt -name-template IMG_{date}_{rand} holidays.mp4\n", exe)
+		fmt.Printf("  %s -encrypt -preserve mtime,mode -recursive /home/John/bin\n", exe)
+		fmt.Printf("  %s -encrypt -compress zstd,level=19 server.log\n", exe)
+		fmt.Printf("  %s -encrypt -format png holidays.mp4\n", exe)
+		fmt.Printf("  %s -decrypt holidays.mp4.png\n", exe)
+		fmt.Printf("  %s -encrypt -format png -max-width 16384 -aspect 4:3 holidays.mp4\n", exe)
+		fmt.Printf("  %s -encrypt -format png -cover beach.jpg -cover sunset.png notes.txt\n", exe)
+		fmt.Printf("  %s -encrypt -ssh-recipient ~/.ssh/id_ed25519.pub report.pdf\n", exe)
+		fmt.Printf("  %s -decrypt -identity key.txt report.pdf.bmp\n", exe)
+		fmt.Printf("  %s -decrypt -identity ~/.ssh/id_ed25519 report.pdf.bmp\n", exe)
+		fmt.Printf("  %s keygen -o key.txt\n", exe)
+		fmt.Printf("  %s slot list report.pdf.bmp\n", exe)
+		fmt.Printf("  %s slot add report.pdf.bmp\n", exe)
+		fmt.Printf("  %s slot add -ssh-recipient ~/.ssh/id_ed25519.pub report.pdf.bmp\n", exe)
+		fmt.Printf("  %s slot remove -slot 1 report.pdf.bmp\n", exe)
 		fmt.Printf("  %s -decrypt -recursive -outdir /tmp/ /home/John/Cloud\n", exe)
+		fmt.Printf("  %s -decrypt -recursive -jobs 8 -outdir /tmp/ /home/John/Photos\n", exe)
+		fmt.Printf("  %s -encrypt -progress -outdir /media/usb/ backup.tar\n", exe)
 		fmt.Println("\nOptions:")
 		flag.PrintDefaults()
+		fmt.Println("\nExit status:")
+		fmt.Printf("  %d  wrong password, keyfile or identity\n", exitWrongKey)
+		fmt.Printf("  %d  corrupted image\n", exitCorrupted)
+		fmt.Printf("  %d  truncated image\n", exitTruncated)
+		fmt.Printf("  %d  not a roe image\n", exitNotRoeImage)
+		fmt.Printf("  %d  missing parts of a splitted file\n", exitMissingParts)
+		fmt.Printf("  %d  any other error, 2 for invalid flags\n", exitError)
 		os.Exit(2)
 	}
 }
 
+// readRecipientsFile returns the public keys listed in fp
+func readRecipientsFile(fp string) ([]roe.Recipient, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list, err := roe.ParseRecipients(f)
+	if err == nil && len(list) == 0 {
+		err = fmt.Errorf("no public keys found in '%s'", fp)
+	}
+	return list, err
+}
+
+// readIdentitiesFile returns the private keys listed in fp, or the ssh private key
+// stored in fp prompting for its passphrase when needed
+func readIdentitiesFile(fp string) ([]roe.Identity, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		id, err := roe.ParseSSHIdentity(data, func() ([]byte, error) {
+			fmt.Printf("Type the passphrase of '%s': ", fp)
+			return gopass.GetPasswd()
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []roe.Identity{id}, nil
+	}
+
+	list, err := roe.ParseIdentities(bytes.NewReader(data))
+	if err == nil && len(list) == 0 {
+		err = fmt.Errorf("no private keys found in '%s'", fp)
+	}
+	return list, err
+}
+
+// readCover decodes the cover image fp
+func readCover(fp string) (image.Image, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := roe.DecodeImage(f)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a bmp, png, tiff or jpeg image: %v", fp, err)
+	}
+	return img, nil
+}
+
+// readKeyfile returns the content of the keyfile fp
+func readKeyfile(fp string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("'%s' is empty", fp)
+	}
+	return data, nil
+}
+
 func absPath(dir string) (string, error) {
 	stat, err := os.Stat(dir)
 	if err != nil {
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/topac/roe/pkg/roe"
+)
+
+// runKeygen implements the keygen command: it generates a new X25519 identity
+// and writes it to stdout, or to the file given with -o.
+func runKeygen(args []string) error {
+	f := flag.NewFlagSet("keygen", flag.ExitOnError)
+	output := f.String("o", "", "Write the private key to the given file instead of stdout")
+	f.Parse(args)
+
+	if f.NArg() != 0 {
+		return fmt.Errorf("keygen does not accept arguments")
+	}
+
+	id, err := roe.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		// never overwrite an existing private key
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+		fmt.Fprintf(os.Stderr, "Public key: %s\n", id.Recipient())
+	}
+
+	fmt.Fprintf(out, "# created: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(out, "# public key: %s\n", id.Recipient())
+	_, err = fmt.Fprintf(out, "%s\n", id)
+	return err
+}
@@ -1,48 +1,139 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 
 	"github.com/topac/roe/pkg/roe"
 )
 
+// exit codes of roecli, 2 is used by the flag package for invalid usage
+const (
+	exitError        = 1
+	exitWrongKey     = 3
+	exitCorrupted    = 4
+	exitTruncated    = 5
+	exitNotRoeImage  = 6
+	exitMissingParts = 7
+)
+
+// exitCode returns the exit code telling apart the kind of err.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, roe.ErrWrongKey):
+		return exitWrongKey
+	case errors.Is(err, roe.ErrCorrupted):
+		return exitCorrupted
+	case errors.Is(err, roe.ErrTruncated):
+		return exitTruncated
+	case errors.Is(err, roe.ErrNotRoeImage):
+		return exitNotRoeImage
+	case errors.Is(err, roe.ErrMissingParts):
+		return exitMissingParts
+	}
+	return exitError
+}
+
 func fatalf(err error) {
+	if activeBar != nil {
+		activeBar.done()
+	}
 	if err == nil {
 		os.Exit(0)
 	}
 	fmt.Printf("ERROR: %v\n", err)
-	os.Exit(1)
+	os.Exit(exitCode(err))
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		fatalf(runKeygen(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "slot" {
+		fatalf(runSlot(os.Args[2:]))
+	}
+
+	// the library is silent unless given a logger
+	roe.SetLogger(log.New(os.Stderr, "", log.LstdFlags))
+
 	opts, err := StartCLI()
 
 	if err != nil {
 		fatalf(err)
 	}
 
-	key := roe.KeyFromPassword(opts.Password)
+	// the progress bar replaces the log
+	var progress roe.ProgressFunc
+	if opts.Progress {
+		roe.SetLogger(nil)
+		activeBar = &progressBar{}
+		progress = activeBar.update
+	}
+
+	// ctrl+c stops the operation, removing the partially written files
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
 
 	if opts.Encrypt {
+		recipients := opts.Recipients
+		if len(recipients) == 0 {
+			recipients = []roe.Recipient{roe.NewPasswordRecipient(opts.Password, opts.KDF)}
+		}
+		e, err := roe.NewEncrypter(roe.EncryptOptions{
+			Recipients:   recipients,
+			Cipher:       opts.Cipher,
+			Split:        opts.Split,
+			NameTemplate: opts.NameTemplate,
+			Preserve:     opts.Preserve,
+			Compression:  opts.Compression,
+			Container:    opts.Container,
+			Dimensions:   opts.Dimensions,
+			Covers:       opts.Covers,
+			Jobs:         opts.Jobs,
+		})
+		if err != nil {
+			fatalf(err)
+		}
+
 		if opts.InputDir != "" {
-			fatalf(roe.EncryptDir(opts.InputDir, opts.Outdir, key, opts.Split))
+			fatalf(e.EncryptDir(ctx, opts.InputDir, opts.Outdir, progress))
 		}
 
 		for _, input := range opts.Input {
-			if roe.GetFileSize(input) == 0 {
+			if size, err := roe.GetFileSize(input); err != nil {
+				fatalf(err)
+			} else if size == 0 {
 				continue
 			}
-			if err := roe.EncryptFile(input, opts.Outdir, key, opts.Split); err != nil {
+			if err := e.EncryptFile(ctx, input, opts.Outdir, progress); err != nil {
 				fatalf(err)
 			}
 		}
 	}
 
 	if opts.Decrypt {
+		ids := opts.Identities
+		if len(ids) == 0 {
+			ids = []roe.Identity{roe.NewPasswordIdentity(opts.Password)}
+		}
+		d, err := roe.NewDecrypter(roe.DecryptOptions{Identities: ids, Jobs: opts.Jobs, KDFLimits: opts.KDFLimits})
+		if err != nil {
+			fatalf(err)
+		}
+
 		if opts.InputDir != "" {
-			fatalf(roe.DecryptDir(opts.InputDir, opts.Outdir, key))
+			fatalf(d.DecryptDir(ctx, opts.InputDir, opts.Outdir, progress))
 		}
 
 		// dict is used to avoid decrypting twice the same file, for e.g.
@@ -52,17 +143,23 @@ func main() {
 		dict := make(map[string]bool)
 
 		for _, input := range opts.Input {
-			if roe.GetFileSize(input) == 0 {
+			if size, err := roe.GetFileSize(input); err != nil {
+				fatalf(err)
+			} else if size == 0 {
 				continue
 			}
 
-			dp := filepath.Join(opts.Outdir, roe.DecryptedFilename(input))
+			name, err := roe.DecryptedFilename(input)
+			if err != nil {
+				fatalf(err)
+			}
+			dp := filepath.Join(opts.Outdir, name)
 			if dict[dp] {
 				continue
 			}
 			dict[dp] = true
 
-			if err := roe.DecryptFile(input, opts.Outdir, key); err != nil {
+			if err := d.DecryptFile(ctx, input, opts.Outdir, progress); err != nil {
 				fatalf(err)
 			}
 		}
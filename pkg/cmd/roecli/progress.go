@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/topac/roe/pkg/roe"
+)
+
+// progressBar prints the progress of an operation on a single line of stderr.
+type progressBar struct {
+	last    time.Time
+	width   int
+	pending bool
+}
+
+// activeBar is ended by fatalf, so that the error is printed on its own line
+var activeBar *progressBar
+
+func (b *progressBar) update(p roe.Progress) {
+	finished := p.FileDone == p.FileSize && p.Part == p.Parts
+	if !finished && time.Since(b.last) < 100*time.Millisecond {
+		return
+	}
+	b.last = time.Now()
+
+	percent := 100.0
+	if p.FileSize > 0 {
+		percent = float64(p.FileDone) * 100 / float64(p.FileSize)
+	}
+	line := fmt.Sprintf("%5.1f%%  %s", percent, filepath.Base(p.File))
+	if p.Parts > 1 {
+		line += fmt.Sprintf(" (part %d/%d)", p.Part, p.Parts)
+	}
+	if p.Total != p.FileSize {
+		line += fmt.Sprintf("  %d/%d MB", p.Done/1000000, p.Total/1000000)
+	}
+
+	// pad with spaces to overwrite a longer line
+	pad := b.width - len(line)
+	if pad < 0 {
+		pad = 0
+	}
+	b.width = len(line)
+	fmt.Fprintf(os.Stderr, "\r%s%s", line, strings.Repeat(" ", pad))
+	b.pending = true
+
+	if finished {
+		b.done()
+	}
+}
+
+// done ends the line of the progress bar.
+func (b *progressBar) done() {
+	if b.pending {
+		fmt.Fprintln(os.Stderr)
+		b.pending, b.width = false, 0
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/howeyc/gopass"
+	"github.com/topac/roe/pkg/roe"
+)
+
+// runSlot implements the slot command, used to list, add and remove the key slots of an image.
+// Only the headers are rewritten, in every part when the image is splitted.
+func runSlot(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected one of the slot commands: list, add, remove")
+	}
+
+	f := flag.NewFlagSet("slot "+args[0], flag.ExitOnError)
+	password := f.String("p", "", "Password unlocking one of the slots")
+	keyfile := f.String("keyfile", "", "Keyfile unlocking one of the slots, alone or along with -p")
+	newKeyfile := f.String("new-keyfile", "", "Add a slot for the given keyfile, the password of the new slot can be left empty")
+	kdfSpec := f.String("kdf", roe.DefaultKDFParams.String(), "Key derivation function and its costs of the new password slot")
+	recipient := f.String("recipient", "", "Add a slot for the given public key, roe or ssh, instead of a new password")
+	sshFile := f.String("ssh-recipient", "", "Add a slot for the ssh-ed25519 or ssh-rsa public key of the given file, for e.g. ~/.ssh/id_ed25519.pub")
+	index := f.Int("slot", -1, "Index of the slot to remove, as printed by slot list")
+	var idFiles stringList
+	f.Var(&idFiles, "identity", "Unlock the image using the private keys of the given file instead of a password, can be repeated")
+	f.Parse(args[1:])
+
+	if f.NArg() != 1 {
+		return fmt.Errorf("invalid usage, the last arg should be the image")
+	}
+	image := f.Arg(0)
+
+	if args[0] == "list" {
+		slots, err := roe.ListSlots(image)
+		if err != nil {
+			return err
+		}
+		for _, s := range slots {
+			fmt.Println(s)
+		}
+		return nil
+	}
+	if args[0] != "add" && args[0] != "remove" {
+		return fmt.Errorf("unknown slot command '%s'", args[0])
+	}
+
+	// the keys unlocking the image
+	var ids []roe.Identity
+	for _, fp := range idFiles {
+		list, err := readIdentitiesFile(fp)
+		if err != nil {
+			return fmt.Errorf("-identity flag is invalid: %v", err)
+		}
+		ids = append(ids, list...)
+	}
+	if len(ids) > 0 && (*password != "" || *keyfile != "") {
+		return fmt.Errorf("-p and -keyfile flags cannot be used along with -identity")
+	}
+	if *keyfile != "" {
+		data, err := readKeyfile(*keyfile)
+		if err != nil {
+			return fmt.Errorf("-keyfile flag is invalid: %v", err)
+		}
+		if *password == "" && stdinIsTerminal() {
+			fmt.Println("Type the current password used along with the keyfile, leave it empty if the keyfile is used alone.")
+			readPassword(password)
+		}
+		ids = append(ids, roe.NewKeyfileIdentity(*password, data))
+	}
+	if len(ids) == 0 {
+		if *password == "" {
+			fmt.Printf("Type the current password: ")
+			pwd, err := gopass.GetPasswd()
+			if err != nil {
+				os.Exit(1)
+			}
+			*password = string(pwd)
+		}
+		ids = append(ids, roe.NewPasswordIdentity(*password))
+	}
+
+	if args[0] == "remove" {
+		if *index < 0 {
+			return fmt.Errorf("-slot flag is required")
+		}
+		return roe.RemoveSlot(image, ids, *index)
+	}
+
+	kdf, err := roe.ParseKDFParams(*kdfSpec)
+	if err != nil {
+		return fmt.Errorf("-kdf flag is invalid: %v", err)
+	}
+	var r roe.Recipient
+	if countSet(*recipient, *sshFile, *newKeyfile) > 1 {
+		return fmt.Errorf("-recipient, -ssh-recipient and -new-keyfile flags are mutually exclusive")
+	}
+	if *recipient != "" {
+		list, err := roe.ParseRecipients(strings.NewReader(*recipient))
+		if err == nil && len(list) != 1 {
+			err = fmt.Errorf("expected one public key")
+		}
+		if err != nil {
+			return fmt.Errorf("-recipient flag is invalid: %v", err)
+		}
+		r = list[0]
+	} else if *sshFile != "" {
+		list, err := readRecipientsFile(*sshFile)
+		if err == nil && len(list) != 1 {
+			err = fmt.Errorf("expected one public key in '%s', found %d", *sshFile, len(list))
+		}
+		if err != nil {
+			return fmt.Errorf("-ssh-recipient flag is invalid: %v", err)
+		}
+		r = list[0]
+	} else if *newKeyfile != "" {
+		data, err := readKeyfile(*newKeyfile)
+		if err != nil {
+			return fmt.Errorf("-new-keyfile flag is invalid: %v", err)
+		}
+		var newPassword string
+		fmt.Println("Choose the password of the new slot, leave it empty to use the keyfile alone.")
+		readPasswordLoop(&newPassword, true)
+		r = roe.NewKeyfileRecipient(newPassword, data, kdf)
+	} else {
+		var newPassword string
+		fmt.Println("Choose the password of the new slot.")
+		readPasswordLoop(&newPassword, false)
+		r = roe.NewPasswordRecipient(newPassword, kdf)
+	}
+	return roe.AddSlot(image, ids, r)
+}
+
+// countSet returns how many of the flag values are not empty
+func countSet(values ...string) int {
+	n := 0
+	for _, v := range values {
+		if v != "" {
+			n++
+		}
+	}
+	return n
+}
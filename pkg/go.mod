@@ -1,9 +1,12 @@
 module github.com/topac/roe/pkg
 
-go 1.13
+go 1.18
 
 require (
 	github.com/howeyc/gopass v0.0.0-20190910152052-7cb4b85ec19c
-	golang.org/x/crypto v0.0.0-20200429183012-4b2356b1ed79 // indirect
-	golang.org/x/sys v0.0.0-20200501052902-10377860bb8e // indirect
+	github.com/klauspost/compress v1.11.13
+	golang.org/x/crypto v0.23.0
+	golang.org/x/image v0.18.0
+	golang.org/x/sys v0.21.0
+	golang.org/x/term v0.21.0
 )
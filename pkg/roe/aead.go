@@ -0,0 +1,62 @@
+package roe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher identifies the authenticated encryption algorithm used to encrypt the payload.
+type Cipher uint8
+
+// Supported ciphers. The values are stored in the payload header.
+const (
+	AES256GCM         Cipher = 1
+	XChaCha20Poly1305 Cipher = 2
+)
+
+// DefaultCipher is the cipher used when none is specified.
+const DefaultCipher = AES256GCM
+
+func (c Cipher) String() string {
+	switch c {
+	case AES256GCM:
+		return "aes256gcm"
+	case XChaCha20Poly1305:
+		return "xchacha20poly1305"
+	}
+	return fmt.Sprintf("cipher(%d)", uint8(c))
+}
+
+// ParseCipher returns the Cipher named s, as returned by Cipher.String.
+func ParseCipher(s string) (Cipher, error) {
+	for _, c := range []Cipher{AES256GCM, XChaCha20Poly1305} {
+		if strings.EqualFold(s, c.String()) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher '%s'", s)
+}
+
+// errAuthFailed is returned when the authentication tag of a chunk of the payload does
+// not match. The file key has already been verified by the header MAC, so the image
+// has been tampered with.
+var errAuthFailed = newError(ErrCorrupted, "authentication failed: corrupted image")
+
+// newAEAD returns the AEAD of the given cipher initialized with a 256 bits key.
+func newAEAD(c Cipher, key []byte) (cipher.AEAD, error) {
+	switch c {
+	case AES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case XChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, fmt.Errorf("unsupported cipher %d", uint8(c))
+}
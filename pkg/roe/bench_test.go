@@ -0,0 +1,149 @@
+package roe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchSizes are the sizes of the cleartext used by the benchmarks.
+var benchSizes = []int{64 << 10, 1 << 20, 16 << 20}
+
+func benchName(c Cipher, size int) string {
+	return fmt.Sprintf("%s/%dKiB", c, size>>10)
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	for _, c := range []Cipher{AES256GCM, XChaCha20Poly1305} {
+		for _, size := range benchSizes {
+			b.Run(benchName(c, size), func(b *testing.B) {
+				cleartext := make([]byte, size)
+				rand.Read(cleartext)
+				header, fileKey, err := newPayloadHeader(rand.Reader, []Recipient{NewPasswordRecipient("foobar", testKDFParams)}, c)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := encrypt(rand.Reader, bytes.NewReader(cleartext), ioutil.Discard, BMP, header, fileKey, int64(size)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	for _, c := range []Cipher{AES256GCM, XChaCha20Poly1305} {
+		for _, size := range benchSizes {
+			b.Run(benchName(c, size), func(b *testing.B) {
+				cleartext := make([]byte, size)
+				rand.Read(cleartext)
+				buffer := bytes.NewBuffer(make([]byte, 0))
+				if err := encryptWithPassword(bytes.NewReader(cleartext), buffer, "foobar", c, size); err != nil {
+					b.Fatal(err)
+				}
+				enc := buffer.Bytes()
+				ids := identities{NewPasswordIdentity("foobar")}
+
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := decrypt(bytes.NewReader(enc), ioutil.Discard, ids); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkEncryptFile measures the whole pipeline, from the original file to the images.
+func BenchmarkEncryptFile(b *testing.B) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	size := 64 << 20
+	cleanpath := filepath.Join(tmpdir, "clean.bin")
+	createRandomFile(cleanpath, size)
+	e, err := NewEncrypter(EncryptOptions{
+		Recipients: []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+		Split:      16 << 20,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := e.EncryptFile(context.Background(), cleanpath, filepath.Join(tmpdir, "enc"), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecryptFile measures the whole pipeline, from the images to the original file.
+func BenchmarkDecryptFile(b *testing.B) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	size := 64 << 20
+	cleanpath := filepath.Join(tmpdir, "clean.bin")
+	createRandomFile(cleanpath, size)
+	encdir := filepath.Join(tmpdir, "enc")
+	if err := encryptFile(cleanpath, encdir, "foobar", EncryptOptions{Split: 16 << 20}); err != nil {
+		b.Fatal(err)
+	}
+	d, err := NewDecrypter(DecryptOptions{Identities: []Identity{NewPasswordIdentity("foobar")}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	decdir := filepath.Join(tmpdir, "dec")
+	os.MkdirAll(decdir, os.ModePerm)
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := d.DecryptFile(context.Background(), filepath.Join(encdir, "clean.bin.1-4.bmp"), decdir, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecryptReader measures NewDecryptReader read with small buffers, like a
+// consumer parsing the data would do.
+func BenchmarkDecryptReader(b *testing.B) {
+	size := 16 << 20
+	cleartext := make([]byte, size)
+	rand.Read(cleartext)
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := encryptWithPassword(bytes.NewReader(cleartext), buffer, "foobar", DefaultCipher, size); err != nil {
+		b.Fatal(err)
+	}
+	enc := buffer.Bytes()
+	ids := []Identity{NewPasswordIdentity("foobar")}
+	buf := make([]byte, 512)
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := NewDecryptReader(bytes.NewReader(enc), ids)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.CopyBuffer(ioutil.Discard, struct{ io.Reader }{r}, buf); err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
@@ -1,5 +1,22 @@
 package roe
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// bmpHeaderSize is the size of the file header plus the BITMAPINFOHEADER
+const bmpHeaderSize = 14 + 40
+
+// maxBmpDataSize is the maximum size of the data-section of a bmp image,
+// since the size of the whole file is stored in 32 bits.
+const maxBmpDataSize = math.MaxUint32 - bmpHeaderSize
+
 // bmpHeader represents the header fields needed to build a valid bmp image
 type bmpHeader struct {
 	FileType                [2]byte
@@ -20,6 +37,8 @@ type bmpHeader struct {
 	ImportantColors         uint32
 }
 
+// newBmpHeader returns the header of a 32bpp image, the data-section of
+// width * height pixels cannot be larger than maxBmpDataSize.
 func newBmpHeader(width, height int) bmpHeader {
 	header := bmpHeader{}
 
@@ -40,3 +59,255 @@ func newBmpHeader(width, height int) bmpHeader {
 
 	return header
 }
+
+// bmpContainer stores the payload in the pixels of a 32bpp image, bottom-up as usual,
+// the image is shown as noise. It is a square unless the shape is given, see Dimensions.
+type bmpContainer struct {
+	shape *imageShape
+}
+
+func (bmpContainer) Name() string { return "bmp" }
+
+func (bmpContainer) Ext() string { return ".bmp" }
+
+// Capacity is the data-section of the largest image.
+func (c bmpContainer) Capacity() int64 {
+	return c.shape.capacity()
+}
+
+func (c bmpContainer) newWriter(w io.Writer, size int64, rnd io.Reader) (io.WriteCloser, error) {
+	h, err := newPayloadBmpHeader(c.shape, size)
+	if err != nil {
+		return nil, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, h); err != nil {
+		return nil, err
+	}
+	return &fillWriter{w: w, size: int64(h.ImageSize), rnd: rnd}, nil
+}
+
+func (bmpContainer) withShape(shape *imageShape) Container {
+	return bmpContainer{shape: shape}
+}
+
+func (bmpContainer) maxWidth() int64 {
+	return maxImagePixels
+}
+
+func (bmpContainer) layout() pixelLayout {
+	return bmpLayout
+}
+
+func (bmpContainer) match(head []byte) bool {
+	return head[0] == 'B' && head[1] == 'M'
+}
+
+func (bmpContainer) newReader(r io.Reader) (io.Reader, error) {
+	info, err := readBmpInfo(r)
+	if err != nil {
+		return nil, err
+	}
+	return info.pixels(r)
+}
+
+// newPayloadBmpHeader returns the header of the smallest image of the shape able to hold
+// encsize bytes, see imageShape.size.
+func newPayloadBmpHeader(shape *imageShape, encsize int64) (bmpHeader, error) {
+	if encsize > shape.capacity() {
+		return bmpHeader{}, fmt.Errorf("%d bytes do not fit in a bmp image, the maximum is about %d bytes", encsize, shape.capacity())
+	}
+	width, height := shape.size(encsize)
+	return newBmpHeader(int(width), int(height)), nil
+}
+
+// Sizes of the versions of the info header read, BITMAPINFOHEADER to BITMAPV5HEADER.
+const (
+	bmpInfoHeaderSize   = 40
+	bmpV2InfoHeaderSize = 52
+	bmpV3InfoHeaderSize = 56
+	bmpV4InfoHeaderSize = 108
+	bmpV5InfoHeaderSize = 124
+)
+
+// Compression methods of the pixels read, the pixels are never compressed but the color
+// masks can be given explicitly.
+const (
+	bmpRGB            = 0
+	bmpBitfields      = 3
+	bmpAlphaBitfields = 6
+)
+
+// bmpInfo describes the pixels of a bmp image, as read by readBmpInfo.
+type bmpInfo struct {
+	width   int64
+	height  int64
+	topDown bool
+}
+
+// readBmpInfo reads and validates the headers of a bmp image from r, leaving r at the
+// beginning of the pixels. Only the uncompressed 32 bits images, with the bytes of the
+// pixels in the B, G, R and A order, can hold a payload: the other ones are not roe
+// images, the malformed ones are corrupted.
+func readBmpInfo(r io.Reader) (bmpInfo, error) {
+	// the file header and the size of the info header, which tells its version
+	b := make([]byte, 14+4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return bmpInfo{}, readError(err, "failed to read the bmp header")
+	}
+	if b[0] != 'B' || b[1] != 'M' {
+		return bmpInfo{}, errNotRoePayload
+	}
+	fileSize := int64(binary.LittleEndian.Uint32(b[2:]))
+	offset := int64(binary.LittleEndian.Uint32(b[10:]))
+	infoSize := binary.LittleEndian.Uint32(b[14:])
+	switch infoSize {
+	case bmpInfoHeaderSize, bmpV2InfoHeaderSize, bmpV3InfoHeaderSize, bmpV4InfoHeaderSize, bmpV5InfoHeaderSize:
+	default:
+		return bmpInfo{}, newError(ErrNotRoeImage, "unsupported bmp info header of %d bytes", infoSize)
+	}
+	h := make([]byte, infoSize)
+	copy(h, b[14:])
+	if _, err := io.ReadFull(r, h[4:]); err != nil {
+		return bmpInfo{}, readError(err, "failed to read the bmp header")
+	}
+	read := int64(14 + infoSize)
+
+	width := int64(int32(binary.LittleEndian.Uint32(h[4:])))
+	height := int64(int32(binary.LittleEndian.Uint32(h[8:])))
+	planes := binary.LittleEndian.Uint16(h[12:])
+	bpp := binary.LittleEndian.Uint16(h[14:])
+	compression := binary.LittleEndian.Uint32(h[16:])
+	imageSize := int64(binary.LittleEndian.Uint32(h[20:]))
+
+	if planes != 1 {
+		return bmpInfo{}, newError(ErrCorrupted, "invalid bmp header, %d planes", planes)
+	}
+	if bpp != 32 {
+		return bmpInfo{}, newError(ErrNotRoeImage, "unsupported bmp image of %d bits per pixel, a roe image has 32", bpp)
+	}
+
+	// the masks follow the BITMAPINFOHEADER, they are part of the later versions
+	switch compression {
+	case bmpRGB:
+	case bmpBitfields, bmpAlphaBitfields:
+		masks := h[bmpInfoHeaderSize:]
+		if infoSize == bmpInfoHeaderSize {
+			masks = make([]byte, 12)
+			if compression == bmpAlphaBitfields {
+				masks = make([]byte, 16)
+			}
+			if _, err := io.ReadFull(r, masks); err != nil {
+				return bmpInfo{}, readError(err, "failed to read the bmp color masks")
+			}
+			read += int64(len(masks))
+		}
+		if !bgraMasks(masks) {
+			return bmpInfo{}, newError(ErrNotRoeImage, "unsupported bmp color masks")
+		}
+	default:
+		return bmpInfo{}, newError(ErrNotRoeImage, "unsupported bmp compression %d", compression)
+	}
+
+	// a negative height is the one of a top-down image
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	if width <= 0 || height == 0 {
+		return bmpInfo{}, newError(ErrCorrupted, "invalid bmp size %dx%d", width, height)
+	}
+	if width > math.MaxUint32/4 || height > math.MaxUint32/4 {
+		return bmpInfo{}, newError(ErrCorrupted, "invalid bmp size %dx%d, larger than 4 GiB", width, height)
+	}
+	size := 4 * width * height
+	if offset < read {
+		return bmpInfo{}, newError(ErrCorrupted, "invalid bmp pixels offset %d, the headers end at %d", offset, read)
+	}
+	if offset+size > math.MaxUint32 {
+		return bmpInfo{}, newError(ErrCorrupted, "invalid bmp size %dx%d, larger than 4 GiB", width, height)
+	}
+	if fileSize != 0 && fileSize < offset+size {
+		return bmpInfo{}, newError(ErrCorrupted, "invalid bmp file size %d, the pixels end at %d", fileSize, offset+size)
+	}
+	if imageSize != 0 && imageSize < size {
+		return bmpInfo{}, newError(ErrCorrupted, "invalid bmp image size %d, the pixels are %d bytes", imageSize, size)
+	}
+
+	// skip the color table or whatever precedes the pixels
+	if _, err := io.CopyN(ioutil.Discard, r, offset-read); err != nil {
+		return bmpInfo{}, readError(err, "failed to read the bmp header")
+	}
+	return bmpInfo{width: width, height: height, topDown: topDown}, nil
+}
+
+// bgraMasks reports whether the color masks read from b, red, green, blue and optionally
+// alpha, select the bytes of the pixels in the B, G, R and A order.
+func bgraMasks(b []byte) bool {
+	want := []uint32{0x00ff0000, 0x0000ff00, 0x000000ff, 0xff000000}
+	for i := 0; i < 4 && 4*i+4 <= len(b); i++ {
+		m := binary.LittleEndian.Uint32(b[4*i:])
+		// the alpha channel can be left out, its byte is kept anyway
+		if m != want[i] && !(i == 3 && m == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// pixels returns a reader of the pixels read from r in the order written by encrypt,
+// from the bottom row. The rows of a top-down image are read entirely first.
+func (info bmpInfo) pixels(r io.Reader) (io.Reader, error) {
+	size := 4 * info.width * info.height
+	if !info.topDown {
+		return io.LimitReader(r, size), nil
+	}
+
+	buf, err := readPixels(r, size)
+	if err != nil {
+		return nil, err
+	}
+	stride := 4 * info.width
+	rows := make([]io.Reader, 0, info.height)
+	for off := size - stride; off >= 0; off -= stride {
+		rows = append(rows, bytes.NewReader(buf[off:off+stride]))
+	}
+	return io.MultiReader(rows...), nil
+}
+
+// readPixels reads the size bytes of the pixels from r. The buffer grows with the bytes
+// read, so that the size found in a header does not allocate more than the image holds.
+func readPixels(r io.Reader, size int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, size); err != nil {
+		return nil, readError(err, "failed to read the bmp pixels")
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeBmp decodes the bmp image read from r, keeping the alpha channel.
+func decodeBmp(r io.Reader) (*image.NRGBA, error) {
+	info, err := readBmpInfo(r)
+	if err != nil {
+		return nil, err
+	}
+	// the pixels are read before allocating the image, for the same reason
+	buf, err := readPixels(r, 4*info.width*info.height)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, int(info.width), int(info.height)))
+	stride := int(4 * info.width)
+	for y := 0; y < int(info.height); y++ {
+		row := buf[y*stride : (y+1)*stride]
+		dy := y
+		if !info.topDown {
+			dy = int(info.height) - 1 - y
+		}
+		p := img.Pix[img.PixOffset(0, dy):]
+		for x := 0; x < len(row); x += 4 {
+			p[x], p[x+1], p[x+2], p[x+3] = row[x+2], row[x+1], row[x], row[x+3]
+		}
+	}
+	return img, nil
+}
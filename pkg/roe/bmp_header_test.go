@@ -0,0 +1,208 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"runtime"
+	"testing"
+
+	"golang.org/x/image/bmp"
+)
+
+// encryptToBmp returns the bmp image of cleartext, encrypted with the password foobar.
+func encryptToBmp(t *testing.T, cleartext []byte) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	w, err := NewEncryptWriter(buffer, []Recipient{NewPasswordRecipient("foobar", testKDFParams)}, DefaultCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(cleartext)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// rewriteBmp returns the image buf written by encrypt with an info header of infoSize
+// bytes, the color masks when compression is bmpBitfields, gap bytes before the pixels
+// and the rows from the top when topDown.
+func rewriteBmp(buf []byte, infoSize int, compression uint32, gap int, topDown bool) []byte {
+	var h bmpHeader
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h)
+	pixels := buf[h.BitmapOffset:]
+
+	info := make([]byte, infoSize)
+	height := int32(h.PixelHeight)
+	if topDown {
+		height = -height
+	}
+	binary.LittleEndian.PutUint32(info[0:], uint32(infoSize))
+	binary.LittleEndian.PutUint32(info[4:], h.PixelWidth)
+	binary.LittleEndian.PutUint32(info[8:], uint32(height))
+	binary.LittleEndian.PutUint16(info[12:], 1)
+	binary.LittleEndian.PutUint16(info[14:], 32)
+	binary.LittleEndian.PutUint32(info[16:], compression)
+	binary.LittleEndian.PutUint32(info[20:], h.ImageSize)
+	if compression == bmpBitfields {
+		masks := make([]byte, 16)
+		for i, m := range []uint32{0x00ff0000, 0x0000ff00, 0x000000ff, 0xff000000} {
+			binary.LittleEndian.PutUint32(masks[4*i:], m)
+		}
+		if infoSize == bmpInfoHeaderSize {
+			info = append(info, masks[:12]...)
+		} else {
+			copy(info[bmpInfoHeaderSize:], masks)
+		}
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0))
+	offset := 14 + len(info) + gap
+	out.WriteString("BM")
+	binary.Write(out, binary.LittleEndian, uint32(offset+len(pixels)))
+	binary.Write(out, binary.LittleEndian, uint32(0))
+	binary.Write(out, binary.LittleEndian, uint32(offset))
+	out.Write(info)
+	out.Write(make([]byte, gap))
+	if !topDown {
+		out.Write(pixels)
+		return out.Bytes()
+	}
+	stride := 4 * int(h.PixelWidth)
+	for off := len(pixels) - stride; off >= 0; off -= stride {
+		out.Write(pixels[off : off+stride])
+	}
+	return out.Bytes()
+}
+
+func Test_bmpDecodesWithXImage(t *testing.T) {
+	for _, size := range []int{0, 1, chunkSize + 1} {
+		cleartext := make([]byte, size)
+		rand.Read(cleartext)
+		buf := encryptToBmp(t, cleartext)
+
+		var h bmpHeader
+		binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h)
+		img, err := bmp.Decode(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if b := img.Bounds(); b.Dx() != int(h.PixelWidth) || b.Dy() != int(h.PixelHeight) {
+			t.Errorf("%d bytes: decoded a %v image, the header says %dx%d", size, b, h.PixelWidth, h.PixelHeight)
+		}
+	}
+}
+
+func Test_readBmpVersions(t *testing.T) {
+	cleartext := make([]byte, chunkSize+3)
+	rand.Read(cleartext)
+	buf := encryptToBmp(t, cleartext)
+	ids := identities{NewPasswordIdentity("foobar")}
+
+	for name, img := range map[string][]byte{
+		"info masks":       rewriteBmp(buf, bmpInfoHeaderSize, bmpBitfields, 0, false),
+		"info top-down":    rewriteBmp(buf, bmpInfoHeaderSize, bmpRGB, 0, true),
+		"v4":               rewriteBmp(buf, bmpV4InfoHeaderSize, bmpBitfields, 0, false),
+		"v5 gap top-down":  rewriteBmp(buf, bmpV5InfoHeaderSize, bmpBitfields, 20, true),
+		"v5 rgb top-down":  rewriteBmp(buf, bmpV5InfoHeaderSize, bmpRGB, 0, true),
+		"v3 masks and gap": rewriteBmp(buf, bmpV3InfoHeaderSize, bmpBitfields, 1024, false),
+	} {
+		out := bytes.NewBuffer(make([]byte, 0))
+		if err := decrypt(bytes.NewReader(img), out, ids); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(cleartext, out.Bytes()) {
+			t.Errorf("%s: the decrypted data differs", name)
+		}
+	}
+}
+
+// unusedIdentity fails the test when it is asked to unwrap a file key.
+type unusedIdentity struct {
+	t *testing.T
+}
+
+func (id unusedIdentity) unwrap(s stanza) ([]byte, error) {
+	id.t.Errorf("the identity should not be used")
+	return nil, errNoMatch
+}
+
+func (id unusedIdentity) coverMask(seed []byte) ([]byte, error) {
+	id.t.Errorf("the identity should not be used")
+	return nil, errNoMatch
+}
+
+func Test_readBmpMalformed(t *testing.T) {
+	buf := encryptToBmp(t, []byte("roe"))
+
+	// each case changes the header at an offset
+	put16 := func(off int, v uint16) []byte {
+		b := append([]byte{}, buf...)
+		binary.LittleEndian.PutUint16(b[off:], v)
+		return b
+	}
+	put32 := func(off int, v uint32) []byte {
+		b := append([]byte{}, buf...)
+		binary.LittleEndian.PutUint32(b[off:], v)
+		return b
+	}
+	for _, tc := range []struct {
+		name string
+		img  []byte
+		kind error
+	}{
+		{"file size", put32(2, 100), ErrCorrupted},
+		{"offset", put32(10, 20), ErrCorrupted},
+		{"core header", put32(14, 12), ErrNotRoeImage},
+		{"width", put32(18, 0), ErrCorrupted},
+		{"height", put32(22, 0), ErrCorrupted},
+		{"huge", put32(18, 1<<30), ErrCorrupted},
+		{"planes", put16(26, 2), ErrCorrupted},
+		{"24 bits", put16(28, 24), ErrNotRoeImage},
+		{"rle", put32(30, 1), ErrNotRoeImage},
+		{"masks", rewriteBmp(put32(54, 0), bmpV4InfoHeaderSize, bmpBitfields, 0, false)[:14+40], ErrTruncated},
+		{"image size", put32(34, 16), ErrCorrupted},
+		{"truncated", buf[:30], ErrTruncated},
+		{"truncated pixels", rewriteBmp(buf, bmpInfoHeaderSize, bmpRGB, 0, true)[:len(buf)-1], ErrTruncated},
+	} {
+		err := decrypt(bytes.NewReader(tc.img), ioutil.Discard, identities{unusedIdentity{t}})
+		if !errors.Is(err, tc.kind) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.kind, err)
+		}
+	}
+}
+
+func Test_readBmpHugeHeader(t *testing.T) {
+	// a 54 bytes image claiming 30000 x 30000 top-down pixels, without the sizes
+	buf := make([]byte, 14+bmpInfoHeaderSize)
+	copy(buf, "BM")
+	binary.LittleEndian.PutUint32(buf[10:], uint32(len(buf)))
+	binary.LittleEndian.PutUint32(buf[14:], bmpInfoHeaderSize)
+	binary.LittleEndian.PutUint32(buf[18:], 30000)
+	height := int32(-30000)
+	binary.LittleEndian.PutUint32(buf[22:], uint32(height))
+	binary.LittleEndian.PutUint16(buf[26:], 1)
+	binary.LittleEndian.PutUint16(buf[28:], 32)
+
+	for _, topDown := range []bool{true, false} {
+		img := append([]byte{}, buf...)
+		if !topDown {
+			binary.LittleEndian.PutUint32(img[22:], 30000)
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		// without pixels there is no payload either
+		err := decrypt(bytes.NewReader(img), ioutil.Discard, identities{unusedIdentity{t}})
+		if !errors.Is(err, ErrTruncated) && !errors.Is(err, ErrNotRoeImage) {
+			t.Errorf("top-down %v: expected %v, got %v", topDown, ErrTruncated, err)
+		}
+		if _, err := decodeImage(bytes.NewReader(img)); !errors.Is(err, ErrTruncated) {
+			t.Errorf("top-down %v: decode expected %v, got %v", topDown, ErrTruncated, err)
+		}
+		runtime.ReadMemStats(&after)
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Errorf("top-down %v: %d bytes allocated reading a 54 bytes image", topDown, n)
+		}
+	}
+}
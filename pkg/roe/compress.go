@@ -0,0 +1,230 @@
+package roe
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression identifies the algorithm used to compress a file before encrypting it.
+type Compression uint8
+
+// Supported compression algorithms. The values are stored in the payload header.
+const (
+	NoCompression Compression = 0
+	Deflate       Compression = 1
+	Zstd          Compression = 2
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Deflate:
+		return "deflate"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("compression(%d)", uint8(c))
+}
+
+// CompressionParams describes the algorithm and the level used to compress the files.
+type CompressionParams struct {
+	Algorithm Compression
+	Level     int // 1 to 9 for Deflate, 1 to 22 for Zstd
+}
+
+// default levels of the compression algorithms
+const (
+	defaultDeflateLevel = 6
+	defaultZstdLevel    = 3
+)
+
+// Validate returns an error when the parameters are not usable.
+func (p CompressionParams) Validate() error {
+	switch p.Algorithm {
+	case NoCompression:
+	case Deflate:
+		if p.Level < flate.BestSpeed || p.Level > flate.BestCompression {
+			return fmt.Errorf("deflate level must be between %d and %d", flate.BestSpeed, flate.BestCompression)
+		}
+	case Zstd:
+		if p.Level < 1 || p.Level > 22 {
+			return fmt.Errorf("zstd level must be between 1 and 22")
+		}
+	default:
+		return fmt.Errorf("unsupported compression %d", uint8(p.Algorithm))
+	}
+	return nil
+}
+
+// String returns the parameters in the format accepted by ParseCompressionParams.
+func (p CompressionParams) String() string {
+	if p.Algorithm == NoCompression {
+		return p.Algorithm.String()
+	}
+	return fmt.Sprintf("%s,level=%d", p.Algorithm, p.Level)
+}
+
+// ParseCompressionParams parses a string like "zstd", "zstd,level=19" or "deflate,level=9".
+// "none" disables the compression.
+func ParseCompressionParams(s string) (CompressionParams, error) {
+	parts := strings.Split(s, ",")
+
+	var p CompressionParams
+	switch strings.ToLower(strings.TrimSpace(parts[0])) {
+	case "none", "":
+		return CompressionParams{Algorithm: NoCompression}, nil
+	case "deflate":
+		p = CompressionParams{Algorithm: Deflate, Level: defaultDeflateLevel}
+	case "zstd":
+		p = CompressionParams{Algorithm: Zstd, Level: defaultZstdLevel}
+	default:
+		return p, fmt.Errorf("unknown compression '%s'", parts[0])
+	}
+
+	for _, kv := range parts[1:] {
+		pair := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(pair) != 2 || pair[0] != "level" {
+			return p, fmt.Errorf("invalid parameter '%s'", kv)
+		}
+		n, err := strconv.Atoi(pair[1])
+		if err != nil {
+			return p, fmt.Errorf("invalid level: %v", err)
+		}
+		p.Level = n
+	}
+
+	return p, p.Validate()
+}
+
+// newCompressor returns a writer compressing to w with the given parameters.
+func newCompressor(w io.Writer, p CompressionParams) (io.WriteCloser, error) {
+	switch p.Algorithm {
+	case Deflate:
+		return flate.NewWriter(w, p.Level)
+	case Zstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(p.Level)))
+	}
+	return nil, fmt.Errorf("unsupported compression %d", uint8(p.Algorithm))
+}
+
+// newDecompressor returns a reader decompressing the data read from r.
+func newDecompressor(r io.Reader, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case Deflate:
+		return flate.NewReader(r), nil
+	case Zstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %d", uint8(c))
+}
+
+// newSizedDecompressor is like newDecompressor, but the reader fails as soon as the
+// decompressed data is not exactly size bytes long.
+func newSizedDecompressor(r io.Reader, c Compression, size int64) (io.ReadCloser, error) {
+	d, err := newDecompressor(r, c)
+	if err != nil {
+		return nil, err
+	}
+	return &sizedReader{ReadCloser: d, size: size}, nil
+}
+
+// sizedReader reads exactly size bytes from the underlying reader.
+type sizedReader struct {
+	io.ReadCloser
+	size int64
+	n    int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	// never return more than the original size, in case of decompression bombs
+	if max := s.size - s.n + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := s.ReadCloser.Read(p)
+	s.n += int64(n)
+	if s.n > s.size {
+		return 0, newError(ErrCorrupted, "failed to decompress: more than %d bytes decompressed", s.size)
+	}
+	if err == io.EOF && s.n != s.size {
+		return n, newError(ErrCorrupted, "failed to decompress: %d bytes decompressed, expected %d", s.n, s.size)
+	}
+	return n, err
+}
+
+// compressFile compresses src to a spool, where the compressed data is kept encrypted
+// with an ephemeral key, in memory and then in a temporary file when it gets larger.
+// It returns a nil spool when the compression saves less than 5% of the size, in that
+// case the file is better stored as it is. src is read through t.
+// The last chunk of the spool is sealed, the caller must close it.
+func compressFile(t *tracker, src string, p CompressionParams) (*spool, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	sp, err := newSpool()
+	if err != nil {
+		return nil, err
+	}
+
+	// give up as soon as the compressed data is larger than the threshold
+	lw := &limitedWriter{w: sp, n: fi.Size() - fi.Size()/20}
+	w, err := newCompressor(lw, p)
+	if err != nil {
+		sp.close()
+		return nil, err
+	}
+	_, err = io.Copy(w, t.reader(bufio.NewReaderSize(f, bufferSize(fi.Size())), true))
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = sp.seal(true)
+	}
+	if lw.reached {
+		sp.close()
+		return nil, nil
+	}
+	if err != nil {
+		sp.close()
+		return nil, fmt.Errorf("failed to compress '%s': %v", src, err)
+	}
+
+	return sp, nil
+}
+
+var errLimitReached = fmt.Errorf("limit reached")
+
+// limitedWriter writes at most n bytes to w, then it fails with errLimitReached.
+type limitedWriter struct {
+	w       io.Writer
+	n       int64
+	reached bool
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		l.reached = true
+		return 0, errLimitReached
+	}
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	return n, err
+}
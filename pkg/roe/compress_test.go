@@ -0,0 +1,150 @@
+package roe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_encryptFileCompressed(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	// a log compresses well, random bytes do not
+	logpath := filepath.Join(tmpdir, "app.log")
+	logbuf := bytes.NewBuffer(make([]byte, 0))
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(logbuf, "2020-05-01 12:00:%02d INFO request %d served in %dms\n", i%60, i, i%97)
+	}
+	ioutil.WriteFile(logpath, logbuf.Bytes(), 0644)
+	randpath := filepath.Join(tmpdir, "random.bin")
+	createRandomFile(randpath, 100000)
+
+	params := []CompressionParams{
+		{Algorithm: Deflate, Level: 1},
+		{Algorithm: Deflate, Level: 9},
+		{Algorithm: Zstd, Level: 3},
+		{Algorithm: Zstd, Level: 19},
+	}
+	for _, p := range params {
+		for _, cleanpath := range []string{logpath, randpath} {
+			encdir := filepath.Join(tmpdir, "enc")
+			decdir := filepath.Join(tmpdir, "dec")
+			os.MkdirAll(decdir, os.ModePerm)
+
+			if err := encryptFile(cleanpath, encdir, "foobar", EncryptOptions{Split: 40000, Compression: p}); err != nil {
+				t.Fatal(err)
+			}
+			files, _ := ioutil.ReadDir(encdir)
+
+			// the header records whether the compression has been applied
+			f, _ := os.Open(filepath.Join(encdir, files[0].Name()))
+			f.Seek(54, 0)
+			header, err := readPayloadHeader(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressed := cleanpath == logpath
+			if (header.Compression == uint8(p.Algorithm)) != compressed || (header.Compression == 0) == compressed {
+				t.Errorf("%s, %s: unexpected compression %d", p, cleanpath, header.Compression)
+			}
+			total := int64(0)
+			for _, fi := range files {
+				total += fi.Size()
+			}
+			if cleansize := int64(logbuf.Len()); compressed && total > cleansize/5 {
+				t.Errorf("%s: the images of the log should be smaller than %d bytes, got %d", p, cleansize/5, total)
+			}
+
+			if err := decryptFile(filepath.Join(encdir, files[0].Name()), decdir, "foobar"); err != nil {
+				t.Fatal(err)
+			}
+			if !sameContent(t, cleanpath, filepath.Join(decdir, filepath.Base(cleanpath))) {
+				t.Errorf("%s, %s: decrypted file and original file differs", p, cleanpath)
+			}
+
+			os.RemoveAll(encdir)
+			os.RemoveAll(decdir)
+		}
+	}
+}
+
+func Test_encryptCompressedWritesOnlyImages(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	// half random and half zeros, larger than the memory of the spool once compressed
+	cleanpath := filepath.Join(tmpdir, "disk.img")
+	cleanbuf := bytes.NewBuffer(make([]byte, 0))
+	for cleanbuf.Len() < 3*spoolMemory {
+		chunk := make([]byte, 32*1024)
+		rand.Read(chunk[:16*1024])
+		cleanbuf.Write(chunk)
+	}
+	ioutil.WriteFile(cleanpath, cleanbuf.Bytes(), 0644)
+
+	// the output folder holds only the images, during and after the encryption
+	encdir := filepath.Join(tmpdir, "enc")
+	onlyImages := func(when string) {
+		files, _ := ioutil.ReadDir(encdir)
+		for _, fi := range files {
+			if filepath.Ext(fi.Name()) != ".bmp" {
+				t.Errorf("%s: unexpected file %s in the output folder", when, fi.Name())
+			}
+		}
+	}
+	e, err := NewEncrypter(EncryptOptions{
+		Recipients:  []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+		Split:       1024 * 1024,
+		Compression: CompressionParams{Algorithm: Deflate, Level: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := func(p Progress) {
+		onlyImages("during the encryption")
+	}
+	if err := e.EncryptFile(context.Background(), cleanpath, encdir, progress); err != nil {
+		t.Fatal(err)
+	}
+	onlyImages("after the encryption")
+
+	decdir := filepath.Join(tmpdir, "dec")
+	os.MkdirAll(decdir, os.ModePerm)
+	if err := decryptFile(filepath.Join(encdir, "disk.img.1-4.bmp"), decdir, "foobar"); err != nil {
+		t.Fatal(err)
+	}
+	if !sameContent(t, cleanpath, filepath.Join(decdir, "disk.img")) {
+		t.Errorf("decrypted file and original file differs")
+	}
+}
+
+func Test_parseCompressionParams(t *testing.T) {
+	valid := map[string]CompressionParams{
+		"none":            {Algorithm: NoCompression},
+		"zstd":            {Algorithm: Zstd, Level: defaultZstdLevel},
+		"zstd,level=19":   {Algorithm: Zstd, Level: 19},
+		"Deflate,level=9": {Algorithm: Deflate, Level: 9},
+	}
+	for s, expected := range valid {
+		p, err := ParseCompressionParams(s)
+		if err != nil {
+			t.Errorf("ParseCompressionParams(%q) failed: %v", s, err)
+		} else if p != expected {
+			t.Errorf("ParseCompressionParams(%q) = %s, expected %s", s, p, expected)
+		}
+	}
+
+	invalid := []string{"gzip", "zstd,level=23", "deflate,level=0", "zstd,l=3", "zstd,level=x"}
+	for _, s := range invalid {
+		if _, err := ParseCompressionParams(s); err == nil {
+			t.Errorf("ParseCompressionParams(%q) should fail", s)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package roe
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// Container is a file format carrying the payloads: the payload is stored as the data of
+// a valid file, the pixels of an image or the samples of a sound, followed by random bytes
+// up to the size required by the format. The format of a file is detected from its content
+// when decrypting it.
+type Container interface {
+	// Name returns the name of the format, as accepted by ParseContainer.
+	Name() string
+	// Ext returns the extension of the files, for e.g. ".bmp".
+	Ext() string
+	// Capacity returns the size of the largest payload a file can carry.
+	Capacity() int64
+
+	// newWriter writes to w the headers of a file carrying size bytes of payload and returns
+	// a writer of the payload. Close writes the rest of the file, filling it with bytes read
+	// from rnd, it does not close w.
+	newWriter(w io.Writer, size int64, rnd io.Reader) (io.WriteCloser, error)
+	// match reports whether a file starting with head, containerHeadSize bytes, has the format.
+	match(head []byte) bool
+	// newReader reads the headers of a file from r and returns a reader of the data carried,
+	// the payload followed by the filler.
+	newReader(r io.Reader) (io.Reader, error)
+}
+
+// Supported containers.
+var (
+	// BMP stores the payload in the pixels of a 32 bits bmp image.
+	BMP Container = bmpContainer{}
+	// PNG stores the payload in the pixels of a lossless RGBA png image.
+	PNG Container = pngContainer{}
+	// WAV stores the payload in the samples of a 16 bits stereo PCM wav sound.
+	WAV Container = wavContainer{}
+)
+
+// DefaultContainer is the container used when none is chosen.
+var DefaultContainer = BMP
+
+var containers = []Container{BMP, PNG, WAV}
+
+// maxPayloadSize is the maximum size of a payload, no container carries more.
+const maxPayloadSize = math.MaxUint32
+
+// containerHeadSize is the number of bytes needed to detect the format of a file.
+const containerHeadSize = 12
+
+// ParseContainer returns the container named s, "bmp", "png" or "wav".
+func ParseContainer(s string) (Container, error) {
+	for _, c := range containers {
+		if strings.EqualFold(s, c.Name()) {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported format '%s', choose between bmp, png or wav", s)
+}
+
+// convertedExts are the extensions of the other lossless image formats the images
+// can be converted to, they are decrypted from their pixels.
+var convertedExts = []string{".tif", ".tiff"}
+
+// HasContainerExt returns true when the given filename ends with the extension of one of
+// the containers, for e.g. .bmp or .png, or of an image converted to .tif or .tiff.
+func HasContainerExt(fp string) bool {
+	return containerExt(fp) != ""
+}
+
+// containerExt returns the extension of fp when it is the one of a container, or of a
+// converted image.
+func containerExt(fp string) string {
+	ext := filepath.Ext(fp)
+	for _, c := range containers {
+		if strings.EqualFold(ext, c.Ext()) {
+			return ext
+		}
+	}
+	for _, e := range convertedExts {
+		if strings.EqualFold(ext, e) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// openContainer detects the format of the file read from r, reads its headers and returns
+// the container with a reader of the data carried.
+func openContainer(r io.Reader) (Container, io.Reader, error) {
+	head := make([]byte, containerHeadSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, errNotRoePayload
+		}
+		return nil, nil, err
+	}
+	for _, c := range containers {
+		if c.match(head) {
+			data, err := c.newReader(io.MultiReader(bytes.NewReader(head), r))
+			return c, data, err
+		}
+	}
+	return nil, nil, errNotRoePayload
+}
+
+// squareSide returns the side of the smallest square image of 4 bytes pixels able to
+// hold size bytes.
+func squareSide(size int64) int64 {
+	return int64(math.Ceil(math.Sqrt(float64(size) / 4.0)))
+}
+
+// fillWriter writes the data of a file carrying size bytes, the payload is followed by
+// bytes read from rnd. The trailer, if any, is written by done.
+type fillWriter struct {
+	w    io.Writer
+	size int64
+	n    int64
+	rnd  io.Reader
+	done func() error
+}
+
+func (f *fillWriter) Write(p []byte) (int, error) {
+	if f.n+int64(len(p)) > f.size {
+		return 0, fmt.Errorf("the payload is larger than the %d bytes announced", f.size)
+	}
+	n, err := f.w.Write(p)
+	f.n += int64(n)
+	return n, err
+}
+
+// Close writes the filler and the trailer.
+func (f *fillWriter) Close() error {
+	if left := f.size - f.n; left > 0 {
+		if _, err := io.CopyN(f.w, f.rnd, left); err != nil {
+			return err
+		}
+		f.n = f.size
+	}
+	if f.done != nil {
+		return f.done()
+	}
+	return nil
+}
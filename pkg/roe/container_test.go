@@ -0,0 +1,162 @@
+package roe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_containers(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "testfile")
+	clearbuf := createRandomFile(cleanpath, 3*chunkSize+5)
+	alice := []Identity{NewPasswordIdentity("alice")}
+
+	for _, c := range containers {
+		e, err := NewEncrypter(EncryptOptions{
+			Recipients: []Recipient{NewPasswordRecipient("alice", testKDFParams)},
+			Split:      2 * chunkSize,
+			Container:  c,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encdir := filepath.Join(tmpdir, "enc-"+c.Name())
+		if err := e.EncryptFile(context.Background(), cleanpath, encdir, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// the parts are valid files of the format
+		for i := 0; i < 2; i++ {
+			fp := filepath.Join(encdir, encryptedFilename("testfile", i, 2, c.Ext()))
+			buf, err := ioutil.ReadFile(fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch c {
+			case BMP:
+				var h bmpHeader
+				binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h)
+				if int(h.FileSize) != len(buf) {
+					t.Errorf("%s: the image is %d bytes, its header says %d", fp, len(buf), h.FileSize)
+				}
+			case PNG:
+				img, err := png.Decode(bytes.NewReader(buf))
+				if err != nil {
+					t.Errorf("%s: %v", fp, err)
+				} else if b := img.Bounds(); b.Dx() != b.Dy() {
+					t.Errorf("%s: the image is not square, %v", fp, b)
+				}
+			case WAV:
+				size := binary.LittleEndian.Uint32(buf[4:])
+				datasize := binary.LittleEndian.Uint32(buf[40:])
+				if int(size) != len(buf)-8 || datasize%4 != 0 {
+					t.Errorf("%s: the sound is %d bytes, its header says %d, data %d", fp, len(buf), size, datasize)
+				}
+			}
+		}
+
+		// the format is detected, the slots are rewritten in the same one
+		encpath := filepath.Join(encdir, encryptedFilename("testfile", 1, 2, c.Ext()))
+		if err := AddSlot(encpath, alice, NewPasswordRecipient("bob", testKDFParams)); err != nil {
+			t.Fatal(err)
+		}
+		if slots, err := ListSlots(encpath); err != nil || len(slots) != 2 {
+			t.Errorf("%s: unexpected slots %v, %v", c.Name(), slots, err)
+		}
+		decdir := filepath.Join(tmpdir, "dec-"+c.Name())
+		os.MkdirAll(decdir, os.ModePerm)
+		if err := decryptFile(encpath, decdir, "bob"); err != nil {
+			t.Fatal(err)
+		}
+		decbuf, _ := ioutil.ReadFile(filepath.Join(decdir, "testfile"))
+		if !bytes.Equal(clearbuf, decbuf) {
+			t.Errorf("%s: decrypted file and original file differs", c.Name())
+		}
+	}
+}
+
+func Test_pngFilters(t *testing.T) {
+	cleartext := make([]byte, 100000)
+	rand.Read(cleartext)
+	recipients := []Recipient{NewPasswordRecipient("foobar", testKDFParams)}
+	ids := []Identity{NewPasswordIdentity("foobar")}
+
+	e, err := NewEncrypter(EncryptOptions{Recipients: recipients, Container: PNG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	w, err := e.NewWriter(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(cleartext)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an image saved again by another encoder uses filters and compression
+	img, err := png.Decode(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.NRGBA); !ok {
+		t.Fatalf("expected an RGBA image, got %T", img)
+	}
+	saved := bytes.NewBuffer(make([]byte, 0))
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(saved, img); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewDecryptReader(bytes.NewReader(saved.Bytes()), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cleartext, out) {
+		t.Errorf("the decrypted data differs")
+	}
+
+	// a truncated image
+	r, err = NewDecryptReader(bytes.NewReader(saved.Bytes()[:saved.Len()/2]), ids)
+	if err == nil {
+		_, err = ioutil.ReadAll(r)
+	}
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected %v, got %v", ErrTruncated, err)
+	}
+}
+
+func Test_decryptedFilenameContainers(t *testing.T) {
+	for fp, name := range map[string]string{
+		"a.txt.bmp":       "a.txt",
+		"a.txt.PNG":       "a.txt",
+		"a.txt.2-3.wav":   "a.txt",
+		"a.b.txt.1-3.png": "a.b.txt",
+	} {
+		if got, err := DecryptedFilename(fp); err != nil || got != name {
+			t.Errorf("%s: expected %s, got %s, %v", fp, name, got, err)
+		}
+	}
+	if _, err := DecryptedFilename("a.txt.2-3.jpg"); !errors.Is(err, ErrNotRoeImage) {
+		t.Errorf("expected %v, got %v", ErrNotRoeImage, err)
+	}
+	if _, err := ParseContainer("gif"); err == nil {
+		t.Errorf("expected an error parsing gif")
+	}
+}
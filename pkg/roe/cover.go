@@ -0,0 +1,417 @@
+package roe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// coverContainer hides the payload in the least significant bit of the red, green and blue
+// channels of the pixels of a cover image, instead of showing it as noise. The bits left
+// are random, so that the end of the payload cannot be told, and the payload is hidden
+// in a coverEnvelope, so that the bits cannot be told from random ones without a key.
+// The image is written by an image container with the size of the cover, the payload is
+// read back from its pixels (see imageData) as those of a converted image.
+type coverContainer struct {
+	image shapedContainer
+	cover *image.NRGBA
+	// recipients get a slot of the envelope
+	recipients []Recipient
+	// envelope is the one of the image being rewritten, its slots are kept
+	envelope *coverEnvelope
+}
+
+// newCoverContainers returns the containers hiding the payloads in the covers, in the
+// images written by c, for the recipients.
+func newCoverContainers(c Container, covers []image.Image, recipients []Recipient) ([]Container, error) {
+	ic, ok := c.(shapedContainer)
+	if !ok {
+		return nil, fmt.Errorf("the %s files are not images, they cannot have a cover", c.Name())
+	}
+	list := make([]Container, 0, len(covers))
+	for i, img := range covers {
+		b := img.Bounds()
+		if b.Empty() {
+			return nil, fmt.Errorf("the cover image %d is empty", i+1)
+		}
+		if int64(b.Dx()) > ic.maxWidth() || int64(b.Dx())*int64(b.Dy()) > maxImagePixels {
+			return nil, fmt.Errorf("the cover image %d of %dx%d pixels is too large for a %s image", i+1, b.Dx(), b.Dy(), ic.Name())
+		}
+		cover := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(cover, cover.Bounds(), img, b.Min, draw.Src)
+		list = append(list, coverContainer{image: ic, cover: cover, recipients: recipients})
+	}
+	return list, nil
+}
+
+func (c coverContainer) Name() string { return c.image.Name() }
+
+func (c coverContainer) Ext() string { return c.image.Ext() }
+
+// Capacity is a bit for each channel but alpha, less the envelope.
+func (c coverContainer) Capacity() int64 {
+	return lsbCapacity(c.cover.Bounds()) - c.overhead()
+}
+
+// overhead returns the size of the envelope, with a slot for each recipient.
+func (c coverContainer) overhead() int64 {
+	n := len(c.recipients)
+	if c.envelope != nil {
+		n += len(c.envelope.slots)
+	}
+	return coverSeedSize + int64(n)*coverSlotSize
+}
+
+// lsbCapacity returns the number of bytes hidden in an image of the given bounds.
+func lsbCapacity(b image.Rectangle) int64 {
+	return 3 * int64(b.Dx()) * int64(b.Dy()) / 8
+}
+
+func (c coverContainer) newWriter(w io.Writer, size int64, rnd io.Reader) (io.WriteCloser, error) {
+	b := c.cover.Bounds()
+	if size > c.Capacity() {
+		return nil, fmt.Errorf("%d bytes do not fit in the cover image of %dx%d pixels, it holds %d bytes", size, b.Dx(), b.Dy(), c.Capacity())
+	}
+	shape := &imageShape{width: int64(b.Dx()), height: int64(b.Dy()), fixed: true}
+	iw, err := c.image.withShape(shape).newWriter(w, shape.capacity(), rnd)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := c.newEnvelope(rnd)
+	if err != nil {
+		return nil, err
+	}
+
+	// the cover is shared, the bits are set in a copy of it
+	img := image.NewNRGBA(b)
+	copy(img.Pix, c.cover.Pix)
+	lw := &lsbWriter{w: iw, img: img, layout: c.image.layout(), rnd: rnd}
+	lw.Write(env.bytes())
+	return cipher.StreamWriter{S: env.stream(), W: lw}, nil
+}
+
+// newEnvelope returns the envelope of a new image: the one being rewritten with a new
+// whitening key, or a new one, with the slots of the recipients.
+func (c coverContainer) newEnvelope(rnd io.Reader) (*coverEnvelope, error) {
+	var env *coverEnvelope
+	var err error
+	if c.envelope != nil {
+		env, err = c.envelope.rekey(rnd)
+	} else {
+		env, err = newCoverEnvelope(rnd)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range c.recipients {
+		mask, err := r.coverMask(env.seed)
+		if err != nil {
+			return nil, err
+		}
+		if err := env.addSlot(mask); err != nil {
+			return nil, err
+		}
+	}
+	return env, nil
+}
+
+const (
+	// coverSeedSize is the size of the random seed starting the envelope
+	coverSeedSize = 16
+	// coverSlotSize is the size of a slot of the envelope: the whitening key, the number
+	// of slots as a little endian uint16 and 6 zero bytes, telling the slot has been found.
+	coverSlotSize = 40
+	// maxCoverSlots is the maximum number of slots of an envelope
+	maxCoverSlots = maxStanzas
+	coverInfo     = "roe/cover"
+)
+
+// coverEnvelope hides the payload written in a cover, so that the bits of the cover cannot
+// be told from random ones. The payload is encrypted with a random whitening key, stored
+// in a slot for each recipient after a random seed:
+//
+//	seed | slot 1 | ... | slot n | payload xor chacha20(key)
+//
+// Each slot is masked with a mask derived from the seed and the secret of a recipient,
+// see Recipient.coverMask: a key derived from the password as slow as the default password
+// slots, or a hash of the public key, which also tells whoever knows it that the image hides
+// a payload. The slots are found by trying each identity on each slot.
+// The slots are stored with the count set to 0, and a rewritten image keeps them: the masks
+// are xored with the slots, so the count and the key are changed without them.
+type coverEnvelope struct {
+	seed  []byte
+	key   []byte
+	slots [][]byte
+}
+
+func newCoverEnvelope(rnd io.Reader) (*coverEnvelope, error) {
+	env := &coverEnvelope{seed: make([]byte, coverSeedSize), key: make([]byte, chacha20.KeySize)}
+	if _, err := io.ReadFull(rnd, env.seed); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rnd, env.key); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// deriveCoverMask derives the mask of a cover slot from the secret of a recipient and the seed.
+func deriveCoverMask(secret, seed []byte) ([]byte, error) {
+	mask := make([]byte, coverSlotSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, seed, []byte(coverInfo)), mask); err != nil {
+		return nil, err
+	}
+	return mask, nil
+}
+
+// addSlot adds the slot masked by mask, unless the same mask already has one.
+func (env *coverEnvelope) addSlot(mask []byte) error {
+	slot := make([]byte, coverSlotSize)
+	copy(slot, env.key)
+	xorBytes(slot, mask)
+	for _, s := range env.slots {
+		if bytes.Equal(s, slot) {
+			return nil
+		}
+	}
+	if len(env.slots) == maxCoverSlots {
+		return fmt.Errorf("too many cover slots, the maximum is %d", maxCoverSlots)
+	}
+	env.slots = append(env.slots, slot)
+	return nil
+}
+
+// rekey returns a copy of env with a new whitening key.
+func (env *coverEnvelope) rekey(rnd io.Reader) (*coverEnvelope, error) {
+	key := make([]byte, chacha20.KeySize)
+	if _, err := io.ReadFull(rnd, key); err != nil {
+		return nil, err
+	}
+	c := &coverEnvelope{seed: env.seed, key: key}
+	for _, s := range env.slots {
+		slot := append([]byte{}, s...)
+		xorBytes(slot, env.key)
+		xorBytes(slot, key)
+		c.slots = append(c.slots, slot)
+	}
+	return c, nil
+}
+
+// bytes returns the seed and the slots, with their count.
+func (env *coverEnvelope) bytes() []byte {
+	var count [coverSlotSize]byte
+	binary.LittleEndian.PutUint16(count[chacha20.KeySize:], uint16(len(env.slots)))
+
+	buf := append([]byte{}, env.seed...)
+	for _, s := range env.slots {
+		slot := append([]byte{}, s...)
+		xorBytes(slot, count[:])
+		buf = append(buf, slot...)
+	}
+	return buf
+}
+
+// stream returns the keystream whitening the payload, the key is never reused.
+func (env *coverEnvelope) stream() cipher.Stream {
+	s, _ := chacha20.NewUnauthenticatedCipher(env.key, make([]byte, chacha20.NonceSize))
+	return s
+}
+
+// openCoverEnvelope reads the envelope hidden in a cover from r, trying each of the ids
+// on each slot. It returns the envelope and a reader of the payload.
+func openCoverEnvelope(r io.Reader, ids identities) (*coverEnvelope, io.Reader, error) {
+	head := make([]byte, coverSeedSize+maxCoverSlots*coverSlotSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, nil, errNotRoePayload
+	}
+	head = head[:n]
+	if n < coverSeedSize {
+		return nil, nil, errNotRoePayload
+	}
+	seed := head[:coverSeedSize]
+
+	for _, id := range ids {
+		mask, err := id.coverMask(seed)
+		if err != nil {
+			continue
+		}
+		for off := coverSeedSize; off+coverSlotSize <= n; off += coverSlotSize {
+			slot := append([]byte{}, head[off:off+coverSlotSize]...)
+			xorBytes(slot, mask)
+			if !bytes.Equal(slot[chacha20.KeySize+2:], make([]byte, coverSlotSize-chacha20.KeySize-2)) {
+				continue
+			}
+			count := int(binary.LittleEndian.Uint16(slot[chacha20.KeySize:]))
+			end := coverSeedSize + count*coverSlotSize
+			if end <= off || end > n {
+				continue
+			}
+
+			env := &coverEnvelope{seed: seed, key: slot[:chacha20.KeySize]}
+			env.slots = bytes2slots(head[coverSeedSize:end], count)
+			data := cipher.StreamReader{S: env.stream(), R: io.MultiReader(bytes.NewReader(head[end:]), r)}
+			return env, data, nil
+		}
+	}
+	return nil, nil, errNotRoePayload
+}
+
+// bytes2slots splits the slots written by coverEnvelope.bytes, setting their count to 0.
+func bytes2slots(buf []byte, count int) [][]byte {
+	var c [coverSlotSize]byte
+	binary.LittleEndian.PutUint16(c[chacha20.KeySize:], uint16(count))
+	slots := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		slot := append([]byte{}, buf[i*coverSlotSize:(i+1)*coverSlotSize]...)
+		xorBytes(slot, c[:])
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+// xorBytes xors dst with the first bytes of src.
+func xorBytes(dst, src []byte) {
+	for i := range src {
+		if i == len(dst) {
+			return
+		}
+		dst[i] ^= src[i]
+	}
+}
+
+func (coverContainer) match(head []byte) bool { return false }
+
+func (coverContainer) newReader(r io.Reader) (io.Reader, error) { return r, nil }
+
+// lsbWriter sets the bits written, most significant first, as the least significant bits
+// of the red, green and blue channels of the pixels of img, row by row from the top.
+// Close sets the other ones from rnd and writes the pixels to w, in the layout.
+type lsbWriter struct {
+	w      io.WriteCloser
+	img    *image.NRGBA
+	layout pixelLayout
+	rnd    io.Reader
+	bit    int64
+}
+
+// bits returns the number of bits of the image.
+func (lw *lsbWriter) bits() int64 {
+	return 8 * lsbCapacity(lw.img.Bounds())
+}
+
+// set sets the next bit to the lowest bit of b.
+func (lw *lsbWriter) set(b byte) {
+	i := lw.bit/3*4 + lw.bit%3
+	lw.img.Pix[i] = lw.img.Pix[i]&^1 | b&1
+	lw.bit++
+}
+
+func (lw *lsbWriter) Write(p []byte) (int, error) {
+	if lw.bit+8*int64(len(p)) > lw.bits() {
+		return 0, fmt.Errorf("the payload is larger than the cover image")
+	}
+	for _, b := range p {
+		for i := 7; i >= 0; i-- {
+			lw.set(b >> uint(i))
+		}
+	}
+	return len(p), nil
+}
+
+// Close writes the image.
+func (lw *lsbWriter) Close() error {
+	if left := lw.bits() - lw.bit; left > 0 {
+		buf := make([]byte, (left+7)/8)
+		if _, err := io.ReadFull(lw.rnd, buf); err != nil {
+			return err
+		}
+		for i := 0; lw.bit < lw.bits(); i++ {
+			lw.set(buf[i/8] >> uint(i%8))
+		}
+	}
+	if _, err := io.Copy(lw.w, newImageReader(lw.img, lw.layout)); err != nil {
+		return err
+	}
+	return lw.w.Close()
+}
+
+// lsbReader reads the bytes hidden in the pixels of an image by lsbWriter, the last bits
+// not making a whole byte are ignored.
+type lsbReader struct {
+	r  *bufio.Reader
+	ch int
+}
+
+func newLsbReader(img image.Image) *lsbReader {
+	return &lsbReader{r: bufio.NewReader(newImageReader(img, pngLayout))}
+}
+
+func (lr *lsbReader) Read(p []byte) (int, error) {
+	for n := range p {
+		var b byte
+		for i := 0; i < 8; i++ {
+			c, err := lr.next()
+			if err != nil {
+				if n > 0 {
+					return n, nil
+				}
+				return 0, err
+			}
+			b = b<<1 | c&1
+		}
+		p[n] = b
+	}
+	return len(p), nil
+}
+
+// next returns the next red, green or blue channel, skipping the alpha ones.
+func (lr *lsbReader) next() (byte, error) {
+	for {
+		c, err := lr.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		ch := lr.ch
+		lr.ch = (lr.ch + 1) % 4
+		if ch != 3 {
+			return c, nil
+		}
+	}
+}
+
+// coverRanges returns the parts of a file of size bytes, each one filling the next cover up
+// to split bytes. The payloads have a header of headerSize bytes and are encrypted with
+// the cipher c.
+func coverRanges(size int64, split int64, headerSize int, c Cipher, covers []Container) ([]byteRange, error) {
+	var list []byteRange
+	for off := int64(0); off < size; {
+		i := len(list)
+		if i == len(covers) {
+			return nil, fmt.Errorf("%d bytes do not fit in the covers, %d images holding %d bytes: more or larger covers are needed", size, len(covers), off)
+		}
+		n, err := maxClearSize(headerSize, c, covers[i].Capacity())
+		if err != nil {
+			return nil, fmt.Errorf("the cover image %d holds %d bytes, too few for the headers", i+1, covers[i].Capacity())
+		}
+		if n > split {
+			n = split
+		}
+		if n > size-off {
+			n = size - off
+		}
+		list = append(list, byteRange{off: off, len: n, index: i})
+		off += n
+	}
+	return list, nil
+}
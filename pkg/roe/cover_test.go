@@ -0,0 +1,230 @@
+package roe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newCover returns an opaque image of w x h pixels looking like a gradient.
+func newCover(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 0xff})
+		}
+	}
+	return img
+}
+
+func Test_encryptFileCovers(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "testfile")
+	clearbuf := createRandomFile(cleanpath, 40000)
+	covers := []image.Image{newCover(300, 200), newCover(200, 300), newCover(100, 100)}
+
+	for _, c := range []Container{BMP, PNG} {
+		e, err := NewEncrypter(EncryptOptions{
+			Recipients: []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+			Container:  c,
+			Covers:     covers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encdir := filepath.Join(tmpdir, "enc-"+c.Name())
+		if err := e.EncryptFile(context.Background(), cleanpath, encdir, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// each cover holds 22500 bytes, less the envelope: two covers are needed
+		for i := 0; i < 2; i++ {
+			f, err := os.Open(filepath.Join(encdir, encryptedFilename("testfile", i, 2, c.Ext())))
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := DecodeImage(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds() != covers[i].Bounds() {
+				t.Fatalf("%s: the image %d is %v, its cover %v", c.Name(), i, img.Bounds(), covers[i].Bounds())
+			}
+			// only the lowest bits of the colors change
+			cover := covers[i].(*image.RGBA)
+			for j, p := range toNRGBA(img).Pix {
+				if j%4 == 3 && p != cover.Pix[j] || p|1 != cover.Pix[j]|1 {
+					t.Fatalf("%s: the image %d differs from its cover at %d", c.Name(), i, j)
+				}
+			}
+		}
+
+		decdir := filepath.Join(tmpdir, "dec-"+c.Name())
+		os.MkdirAll(decdir, os.ModePerm)
+		if err := decryptFile(filepath.Join(encdir, encryptedFilename("testfile", 1, 2, c.Ext())), decdir, "foobar"); err != nil {
+			t.Fatal(err)
+		}
+		decbuf, _ := ioutil.ReadFile(filepath.Join(decdir, "testfile"))
+		if !bytes.Equal(clearbuf, decbuf) {
+			t.Errorf("%s: decrypted file and original file differs", c.Name())
+		}
+	}
+
+	// the file does not fit in a single cover
+	e, _ := NewEncrypter(EncryptOptions{
+		Recipients: []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+		Covers:     covers[:1],
+	})
+	err := e.EncryptFile(context.Background(), cleanpath, filepath.Join(tmpdir, "small"), nil)
+	if err == nil || !strings.Contains(err.Error(), "more or larger covers are needed") {
+		t.Errorf("expected a capacity error, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(tmpdir, "small")); len(files) != 0 {
+		t.Errorf("no image should be written, got %d", len(files))
+	}
+}
+
+func Test_encryptFileCoversOfDifferentSizes(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "testfile")
+	clearbuf := createRandomFile(cleanpath, 50000)
+	// the covers hold 3750, 45000 and 7500 bytes
+	covers := []image.Image{newCover(100, 100), newCover(400, 300), newCover(200, 100)}
+
+	for name, comp := range map[string]CompressionParams{
+		"plain":   {},
+		"deflate": {Algorithm: Deflate, Level: 1},
+	} {
+		e, err := NewEncrypter(EncryptOptions{
+			Recipients:  []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+			Covers:      covers,
+			Compression: comp,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encdir := filepath.Join(tmpdir, "enc-"+name)
+		if err := e.EncryptFile(context.Background(), cleanpath, encdir, nil); err != nil {
+			t.Fatal(err)
+		}
+		files, _ := ioutil.ReadDir(encdir)
+		if len(files) != 3 {
+			t.Fatalf("%s: expected 3 parts, got %d", name, len(files))
+		}
+
+		decdir := filepath.Join(tmpdir, "dec-"+name)
+		os.MkdirAll(decdir, os.ModePerm)
+		if err := decryptFile(filepath.Join(encdir, encryptedFilename("testfile", 0, 3, BMP.Ext())), decdir, "foobar"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		decbuf, _ := ioutil.ReadFile(filepath.Join(decdir, "testfile"))
+		if !bytes.Equal(clearbuf, decbuf) {
+			t.Errorf("%s: decrypted file and original file differs", name)
+		}
+	}
+}
+
+func Test_encryptWriterCover(t *testing.T) {
+	e, _ := NewEncrypter(EncryptOptions{
+		Recipients: []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+		Covers:     []image.Image{newCover(64, 48)},
+	})
+	for _, size := range []int{0, 500, 2000} {
+		cleartext := make([]byte, size)
+		var buf bytes.Buffer
+		w, _ := e.NewWriter(&buf)
+		w.Write(cleartext)
+		err := w.Close()
+		if size > 1096 {
+			// the cover holds 1152 bytes, the envelope of 56 bytes and the headers included
+			if err == nil {
+				t.Errorf("%d bytes should not fit in the cover", size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewDecryptReader(&buf, []Identity{NewPasswordIdentity("foobar")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := ioutil.ReadAll(r)
+		if !bytes.Equal(cleartext, out) {
+			t.Errorf("%d bytes: the decrypted data differs", size)
+		}
+	}
+}
+
+func Test_coverLooksRandom(t *testing.T) {
+	id, _ := GenerateX25519Identity()
+	e, _ := NewEncrypter(EncryptOptions{
+		Recipients: []Recipient{NewPasswordRecipient("foobar", testKDFParams), id.Recipient()},
+		Covers:     []image.Image{newCover(64, 48)},
+	})
+	var buf bytes.Buffer
+	w, _ := e.NewWriter(&buf)
+	w.Write(make([]byte, 500))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	img, err := DecodeImage(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// neither the magic nor the zeros can be seen in the low bits
+	bits, _ := ioutil.ReadAll(newLsbReader(img))
+	if bytes.Contains(bits, payloadMagic[:]) {
+		t.Errorf("the magic can be seen in the cover")
+	}
+	ones := 0
+	for _, b := range bits {
+		for ; b != 0; b &= b - 1 {
+			ones++
+		}
+	}
+	if n := 8 * len(bits); ones < n*45/100 || ones > n*55/100 {
+		t.Errorf("%d bits of %d are set", ones, n)
+	}
+
+	if _, err := NewDecryptReader(bytes.NewReader(buf.Bytes()), []Identity{NewPasswordIdentity("wrong")}); !errors.Is(err, ErrNotRoeImage) {
+		t.Errorf("expected %v, got %v", ErrNotRoeImage, err)
+	}
+	for _, ids := range [][]Identity{{NewPasswordIdentity("foobar")}, {NewPasswordIdentity("wrong"), id}} {
+		r, err := NewDecryptReader(bytes.NewReader(buf.Bytes()), ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, _ := ioutil.ReadAll(r); !bytes.Equal(out, make([]byte, 500)) {
+			t.Errorf("the decrypted data differs")
+		}
+	}
+}
+
+// toNRGBA returns the pixels of img.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if n, ok := img.(*image.NRGBA); ok {
+		return n
+	}
+	b := img.Bounds()
+	n := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			n.Set(x, y, img.At(x, y))
+		}
+	}
+	return n
+}
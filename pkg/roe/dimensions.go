@@ -0,0 +1,169 @@
+package roe
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Dimensions constrains the size of the images written, for e.g. to the limits of a photo
+// host. The zero value selects square images, as large as the format allows. Otherwise the
+// images follow the aspect ratio within the limits, and the files larger than the largest
+// image are splitted, see EncryptOptions.Split. The random filler of an image is less than
+// a row, or a column, of pixels.
+type Dimensions struct {
+	// MaxWidth is the maximum width of the images in pixels, no limit when 0.
+	MaxWidth int64
+	// MaxHeight is the maximum height of the images in pixels, no limit when 0.
+	MaxHeight int64
+	// MaxPixels is the maximum number of pixels of the images, no limit when 0.
+	MaxPixels int64
+	// Aspect is the ratio of the width to the height of the images, 1 when 0.
+	Aspect float64
+}
+
+// ParseAspect parses an aspect ratio written as "4:3", "16/9" or "1.5".
+func ParseAspect(s string) (float64, error) {
+	num, den := s, "1"
+	if i := strings.IndexAny(s, ":/"); i >= 0 {
+		num, den = s[:i], s[i+1:]
+	}
+	w, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid aspect ratio '%s'", s)
+	}
+	h, err := strconv.ParseFloat(strings.TrimSpace(den), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid aspect ratio '%s'", s)
+	}
+	a := w / h
+	if !(a > 0) || math.IsInf(a, 0) {
+		return 0, fmt.Errorf("invalid aspect ratio '%s', it must be positive", s)
+	}
+	return a, nil
+}
+
+// shapedContainer is implemented by the containers storing the payload in the pixels of
+// an image, whose size can be constrained.
+type shapedContainer interface {
+	Container
+	// withShape returns the container writing images of the given shape.
+	withShape(shape *imageShape) Container
+	// maxWidth returns the width of the widest image the format can have.
+	maxWidth() int64
+	// layout returns the layout of the pixels written.
+	layout() pixelLayout
+}
+
+// withDimensions returns the container c writing images following d.
+func withDimensions(c Container, d Dimensions) (Container, error) {
+	ic, ok := c.(shapedContainer)
+	if !ok {
+		return nil, fmt.Errorf("the %s files are not images, they have no dimensions", c.Name())
+	}
+	shape, err := newImageShape(d, ic.maxWidth())
+	if err != nil {
+		return nil, err
+	}
+	return ic.withShape(shape), nil
+}
+
+// imageShape describes the images written following Dimensions: width and height are the
+// ones of the largest image. When fixed, all the images have that size.
+type imageShape struct {
+	width  int64
+	height int64
+	aspect float64
+	fixed  bool
+}
+
+// maxImagePixels is the number of pixels of the largest image, the size of the pixels is
+// stored in 32 bits.
+const maxImagePixels = maxBmpDataSize / 4
+
+// newImageShape returns the shape of the images following d, at most maxWidth pixels wide.
+func newImageShape(d Dimensions, maxWidth int64) (*imageShape, error) {
+	if d.MaxWidth < 0 || d.MaxHeight < 0 || d.MaxPixels < 0 {
+		return nil, fmt.Errorf("invalid dimensions, the limits cannot be negative")
+	}
+	if d.Aspect < 0 || math.IsInf(d.Aspect, 0) || math.IsNaN(d.Aspect) {
+		return nil, fmt.Errorf("invalid aspect ratio %g", d.Aspect)
+	}
+	aspect := d.Aspect
+	if aspect == 0 {
+		aspect = 1
+	}
+	pixels := int64(maxImagePixels)
+	if d.MaxPixels > 0 && d.MaxPixels < pixels {
+		pixels = d.MaxPixels
+	}
+	if d.MaxWidth > 0 && d.MaxWidth < maxWidth {
+		maxWidth = d.MaxWidth
+	}
+	maxHeight := pixels
+	if d.MaxHeight > 0 && d.MaxHeight < maxHeight {
+		maxHeight = d.MaxHeight
+	}
+
+	// the largest image of the aspect ratio, narrowed by the limits of its sides
+	w := int64(math.Sqrt(float64(pixels) * aspect))
+	h := int64(math.Sqrt(float64(pixels) / aspect))
+	if w > maxWidth {
+		w = maxWidth
+		h = int64(float64(w) / aspect)
+	}
+	if h > maxHeight {
+		h = maxHeight
+		if hw := int64(float64(h) * aspect); hw < w {
+			w = hw
+		}
+	}
+	for w > 0 && w*h > pixels {
+		h--
+	}
+	if w < 1 || h < 1 {
+		return nil, fmt.Errorf("no image of aspect ratio %g fits the dimensions", aspect)
+	}
+	return &imageShape{width: w, height: h, aspect: aspect}, nil
+}
+
+// capacity returns the size of the pixels of the largest image, the largest square one
+// when s is nil.
+func (s *imageShape) capacity() int64 {
+	if s == nil {
+		dim := int64(math.Sqrt(maxImagePixels))
+		return 4 * dim * dim
+	}
+	return 4 * s.width * s.height
+}
+
+// size returns the width and the height of the smallest image of 4 bytes pixels holding n
+// bytes, up to the capacity. When s is nil it is a square, otherwise it follows the aspect
+// ratio as much as the limits allow, with less than a row or a column of filler.
+func (s *imageShape) size(n int64) (int64, int64) {
+	if s == nil {
+		dim := squareSide(n)
+		return dim, dim
+	}
+	if s.fixed {
+		return s.width, s.height
+	}
+	pixels := (n + 3) / 4
+	if pixels == 0 {
+		pixels = 1
+	}
+	w := int64(math.Ceil(math.Sqrt(float64(pixels) * s.aspect)))
+	if w < 1 {
+		w = 1
+	}
+	if w > s.width {
+		w = s.width
+	}
+	h := (pixels + w - 1) / w
+	if h > s.height {
+		h = s.height
+		w = (pixels + h - 1) / h
+	}
+	return w, h
+}
@@ -0,0 +1,122 @@
+package roe
+
+import (
+	"bytes"
+	"context"
+	"image"
+	_ "image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "golang.org/x/image/bmp"
+)
+
+func Test_parseAspect(t *testing.T) {
+	for s, want := range map[string]float64{"4:3": 4.0 / 3, "16/9": 16.0 / 9, "1.5": 1.5, " 3 : 2 ": 1.5} {
+		if a, err := ParseAspect(s); err != nil || a != want {
+			t.Errorf("%q: expected %g, got %g, %v", s, want, a, err)
+		}
+	}
+	for _, s := range []string{"", "4:", "a:3", "0", "-4:3", "4:0"} {
+		if _, err := ParseAspect(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func Test_imageShape(t *testing.T) {
+	for _, d := range []Dimensions{
+		{MaxWidth: 100},
+		{MaxHeight: 50, Aspect: 4.0 / 3},
+		{MaxPixels: 10000, Aspect: 16.0 / 9},
+		{MaxWidth: 64, MaxHeight: 1000, Aspect: 0.1},
+		{MaxWidth: 7, MaxHeight: 3, MaxPixels: 20},
+	} {
+		shape, err := newImageShape(d, pngMaxWidth)
+		if err != nil {
+			t.Fatalf("%+v: %v", d, err)
+		}
+		for n := int64(1); n <= shape.capacity(); n += 1 + n/7 {
+			w, h := shape.size(n)
+			if 4*w*h < n {
+				t.Fatalf("%+v: %d bytes do not fit in %dx%d", d, n, w, h)
+			}
+			if d.MaxWidth > 0 && w > d.MaxWidth || d.MaxHeight > 0 && h > d.MaxHeight || d.MaxPixels > 0 && w*h > d.MaxPixels {
+				t.Fatalf("%+v: %d bytes in %dx%d, beyond the limits", d, n, w, h)
+			}
+			// the filler is less than a row or a column
+			if filler := w*h - (n+3)/4; filler >= w && filler >= h {
+				t.Errorf("%+v: %d bytes in %dx%d, %d pixels of filler", d, n, w, h, filler)
+			}
+		}
+	}
+
+	// without limits the largest image keeps the aspect ratio
+	shape, _ := newImageShape(Dimensions{Aspect: 16.0 / 9}, pngMaxWidth)
+	if a := float64(shape.width) / float64(shape.height); math.Abs(a-16.0/9) > 0.01 {
+		t.Errorf("unexpected largest image %dx%d", shape.width, shape.height)
+	}
+}
+
+func Test_encryptFileDimensions(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "testfile")
+	clearbuf := createRandomFile(cleanpath, 3*chunkSize)
+	d := Dimensions{MaxWidth: 300, MaxPixels: 300 * 150, Aspect: 3.0 / 2}
+
+	for _, c := range []Container{BMP, PNG} {
+		e, err := NewEncrypter(EncryptOptions{
+			Recipients: []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+			Container:  c,
+			Dimensions: d,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encdir := filepath.Join(tmpdir, "enc-"+c.Name())
+		if err := e.EncryptFile(context.Background(), cleanpath, encdir, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// 180000 bytes of pixels hold less than 3 chunks: the parts are derived from them
+		files, _ := ioutil.ReadDir(encdir)
+		if len(files) != 2 {
+			t.Fatalf("%s: expected 2 images, got %d", c.Name(), len(files))
+		}
+		for _, fi := range files {
+			f, _ := os.Open(filepath.Join(encdir, fi.Name()))
+			cfg, _, err := image.DecodeConfig(f)
+			f.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", fi.Name(), err)
+			}
+			if cfg.Width > 300 || cfg.Width*cfg.Height > 300*150 || cfg.Width < cfg.Height {
+				t.Errorf("%s: unexpected size %dx%d", fi.Name(), cfg.Width, cfg.Height)
+			}
+		}
+
+		decdir := filepath.Join(tmpdir, "dec-"+c.Name())
+		os.MkdirAll(decdir, os.ModePerm)
+		if err := decryptFile(filepath.Join(encdir, files[0].Name()), decdir, "foobar"); err != nil {
+			t.Fatal(err)
+		}
+		decbuf, _ := ioutil.ReadFile(filepath.Join(decdir, "testfile"))
+		if !bytes.Equal(clearbuf, decbuf) {
+			t.Errorf("%s: decrypted file and original file differs", c.Name())
+		}
+
+		// the images made in memory follow the dimensions too
+		img, err := e.EncryptToImage(bytes.NewReader(clearbuf[:chunkSize]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() > 300 || b.Dx()*b.Dy() > 300*150 || len(img.Pix) != 4*b.Dx()*b.Dy() {
+			t.Errorf("unexpected image %v", b)
+		}
+	}
+}
@@ -1,149 +1,396 @@
 package roe
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/aes"
+	"context"
 	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
-// KeyFromPassword derives a 256 bits key from the given passphrase.
-func KeyFromPassword(p string) []byte {
-	h := sha256.New()
-	h.Write([]byte(p))
-	for i := 0; i < 256; i++ {
-		h.Write(h.Sum(nil))
+// DecryptFile decrypts the given file into outdir with the key material, for the files
+// encrypted by EncryptFile. If the file is part of a larger original file,
+// DecryptFile automatically searches for all the other parts
+// in order to combine them. See Decrypter.DecryptFile for the other keys.
+func DecryptFile(srcpath string, outdir string, key []byte) error {
+	d, err := NewDecrypter(DecryptOptions{Identities: []Identity{NewKeyIdentity(key)}})
+	if err != nil {
+		return err
 	}
-	return h.Sum(nil)
+	return d.DecryptFile(context.Background(), srcpath, outdir, nil)
 }
 
-// randBuf fills the given buf with random bytes starting from start.
-// With start = 0 the whole buf is filled.
-func randBuf(buf []byte, start int) {
-	_ = buf[start] // guarantee safety of writes below
-	size := len(buf)
-	padding := make([]byte, size-start)
-	_, err := rand.Read(padding)
-	if err != nil {
-		log.Fatal(err)
+func (d *Decrypter) decryptFile(t *tracker, srcpath string, outdir string) error {
+	paths := []string{srcpath}
+
+	// search all the other parts
+	if isSplittedName(srcpath) {
+		names, err := findSplitNames(srcpath)
+		if err != nil {
+			return err
+		}
+		paths = paths[:0]
+		for _, n := range names {
+			paths = append(paths, filepath.Join(filepath.Dir(srcpath), n.String()))
+		}
 	}
-	for i := 0; i < len(padding); i++ {
-		buf[start+i] = padding[i]
+
+	// the progress counts the bytes of all the parts
+	size := int64(0)
+	for _, fp := range paths {
+		if fi, err := os.Stat(fp); err == nil {
+			size += fi.Size()
+		}
 	}
-}
+	t.startFile(size)
 
-func decryptSplittedFile(srcpath string, outdir string, key []byte) error {
-	// search all the other parts
-	names, err := findSplitNames(srcpath)
+	// the first part tells the name of the file and how it has been encrypted, the file
+	// is created in outdir using the original filename stored in the metadata, or the
+	// one derived from the part when there is none
+	t.startPart(paths[0], 1, len(paths))
+	first, err := d.openPart(t, paths[0])
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to decrypt '%s': %w", paths[0], err)
+	}
+	defer first.close()
+	if err := first.check(first, 0, len(paths)); err != nil {
+		return fmt.Errorf("failed to decrypt '%s': %w", paths[0], err)
+	}
+	name := first.p.meta.safeName()
+	if name == "" {
+		if name, err = DecryptedFilename(paths[0]); err != nil {
+			return fmt.Errorf("failed to decrypt '%s': %w", paths[0], err)
+		}
+	}
+	dst, err := createDecryptedFile(filepath.Join(outdir, name), first.p, d.opts.Overwrite)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt '%s': %w", paths[0], err)
 	}
 
-	// create the new file
-	base := DecryptedFilename(srcpath)
-	dst, err := os.Create(filepath.Join(outdir, base))
+	// the decompression needs the parts in order
+	if dst.pw != nil {
+		err = d.decryptSequential(t, paths, first, dst)
+	} else {
+		err = d.decryptAt(t, paths, first, dst)
+	}
 	if err != nil {
+		dst.abort()
 		return err
 	}
-	defer dst.Close()
+	if err := dst.close(); err != nil {
+		os.Remove(dst.f.Name())
+		return fmt.Errorf("failed to decrypt '%s': %w", srcpath, err)
+	}
 
-	for _, n := range names {
-		fp := filepath.Join(filepath.Dir(srcpath), n.String())
-		src, err := os.Open(fp)
-		if err != nil {
+	// the data is already decrypted, failing to restore an attribute is not fatal
+	if err := dst.meta.restore(dst.f.Name()); err != nil {
+		t.logf("cannot restore the attributes of %s: %v\n", dst.f.Name(), err)
+	}
+	return nil
+}
+
+// decryptSequential decrypts the parts one after the other, writing them to dst.
+func (d *Decrypter) decryptSequential(t *tracker, paths []string, first *part, dst *decryptedFile) error {
+	off := int64(0)
+	for i, fp := range paths {
+		pt := first
+		if i > 0 {
+			t.startPart(fp, i+1, len(paths))
+			var err error
+			if pt, err = d.openPart(t, fp); err != nil {
+				return fmt.Errorf("failed to decrypt '%s': %w", fp, err)
+			}
+			defer pt.close()
+			if err := pt.check(first, i, len(paths)); err != nil {
+				return fmt.Errorf("failed to decrypt '%s': %w", fp, err)
+			}
+		}
+
+		if pt.p.part.Offset != uint64(off) {
+			return fmt.Errorf("failed to decrypt '%s': %w", fp, newError(ErrCorrupted, "the part starts at %d, the previous ones end at %d", pt.p.part.Offset, off))
+		}
+
+		t.logf("decrypt %s -> %s\n", fp, dst.f.Name())
+		if err := pt.decrypt(t, dst.w); err != nil {
+			return fmt.Errorf("failed to decrypt '%s': %w", fp, err)
+		}
+		off += pt.r.size
+	}
+	return nil
+}
+
+// decryptAt decrypts the parts concurrently, writing each one into dst at the offset
+// stored in it: the parts can hold different sizes, for e.g. when written in covers of
+// different capacity. The parts must follow each other without gaps.
+func (d *Decrypter) decryptAt(t *tracker, paths []string, first *part, dst *decryptedFile) error {
+	if dst.meta.Size > 0 {
+		if err := dst.f.Truncate(dst.meta.Size); err != nil {
 			return err
 		}
-		log.Printf("decrypt %s -> %s\n", fp, dst.Name())
-		if err := decrypt(src, dst, key); err != nil {
-			src.Close()
-			os.Remove(dst.Name())
-			return fmt.Errorf("failed to decrypt '%s': %v", fp, err)
+	}
+
+	sizes := make([]int64, len(paths))
+	offsets := make([]int64, len(paths))
+	err := runParts(len(paths), d.opts.Concurrency, func(i int) error {
+		fp := paths[i]
+		pt := first
+		if i > 0 {
+			t.startPart(fp, i+1, len(paths))
+			var err error
+			if pt, err = d.openPart(t, fp); err != nil {
+				return fmt.Errorf("failed to decrypt '%s': %w", fp, err)
+			}
+			defer pt.close()
+			if err := pt.check(first, i, len(paths)); err != nil {
+				return fmt.Errorf("failed to decrypt '%s': %w", fp, err)
+			}
 		}
-		src.Close()
+		off := pt.p.part.Offset
+		if off > maxPayloadSize*uint64(len(paths)) || (dst.meta.Size > 0 && int64(off)+pt.r.size > dst.meta.Size) {
+			return fmt.Errorf("failed to decrypt '%s': %w", fp, newError(ErrCorrupted, "the part at %d holding %d bytes is out of the file", off, pt.r.size))
+		}
+
+		t.logf("decrypt %s -> %s\n", fp, dst.f.Name())
+		w := bufio.NewWriterSize(&offsetWriter{f: dst.f, off: int64(off)}, bufferSize(pt.r.size))
+		err := pt.decrypt(t, w)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decrypt '%s': %w", fp, err)
+		}
+		sizes[i] = pt.r.size
+		offsets[i] = int64(off)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
+	total := int64(0)
+	for i, size := range sizes {
+		if offsets[i] != total {
+			return fmt.Errorf("failed to decrypt '%s': %w", paths[i], newError(ErrCorrupted, "the part starts at %d, the previous ones end at %d", offsets[i], total))
+		}
+		total += size
+	}
+	if dst.meta.Size > 0 && total != dst.meta.Size {
+		return fmt.Errorf("failed to decrypt '%s': %w", paths[0], newError(ErrCorrupted, "%d bytes decrypted, expected %d", total, dst.meta.Size))
+	}
 	return nil
 }
 
-// DecryptFile decrypts the given .bmp file into outdir.
-// If the .bmp file is part of a larger original file,
-// DecryptFile automatically searches for all the other parts
-// in order to combine them.
-func DecryptFile(srcpath string, outdir string, key []byte) error {
-	if isSplittedName(srcpath) {
-		return decryptSplittedFile(srcpath, outdir, key)
+// part is an image being decrypted, read up to the beginning of the encrypted data.
+type part struct {
+	f    *os.File
+	size int64
+	src  *trackedReader
+	p    *payload
+	r    *streamReader
+}
+
+// openPart opens the image fp and reads its headers, unwrapping the file key.
+func (d *Decrypter) openPart(t *tracker, fp string) (*part, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := d.readPart(t, f)
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
+	return pt, nil
+}
+
+// readPart reads the headers of the image f, through t.
+func (d *Decrypter) readPart(t *tracker, f *os.File) (*part, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	src := t.reader(bufio.NewReaderSize(f, bufferSize(fi.Size())), true)
 
-	// open the src file
-	src, err := os.Open(srcpath)
+	p, err := openPayload(src, d.opts.Identities, d.opts.KDFLimits)
 	if err != nil {
+		return nil, err
+	}
+	r, err := p.reader()
+	if err != nil {
+		return nil, err
+	}
+	return &part{f: f, size: fi.Size(), src: src, p: p, r: r}, nil
+}
+
+// check verifies that the part is the part i of the n parts found of the file of first:
+// the parts of a file share the same header, with the same file ID.
+func (pt *part) check(first *part, i int, n int) error {
+	if !bytes.Equal(pt.p.header.bytes(), first.p.header.bytes()) {
+		return newError(ErrCorrupted, "the image is not a part of the same file")
+	}
+	if info := pt.p.part; int(info.Count) != n {
+		return newError(ErrMissingParts, "the file has %d parts, %d found", info.Count, n)
+	} else if int(info.Index) != i {
+		return newError(ErrCorrupted, "the image is the part %d of the file, not %d", info.Index+1, i+1)
+	}
+	return nil
+}
+
+// decrypt writes the data of the part to w.
+func (pt *part) decrypt(t *tracker, w io.Writer) error {
+	if _, err := io.Copy(w, pt.r); err != nil {
 		return err
 	}
-	defer src.Close()
 
-	// contruct the absolute destination path
-	base := DecryptedFilename(srcpath)
-	dst, err := os.Create(filepath.Join(outdir, base))
+	// the random filler is not read
+	t.add(pt.size - pt.src.n)
+	return nil
+}
+
+func (pt *part) close() error {
+	return pt.f.Close()
+}
+
+// decryptedFile is the destination of the decrypted parts of a file. When the file
+// has been compressed, the parts are written to a pipe read by the decompressor.
+type decryptedFile struct {
+	f    *os.File
+	meta metadata
+	w    io.Writer
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func createDecryptedFile(fp string, p *payload, overwrite Overwrite) (*decryptedFile, error) {
+	f, err := overwrite.create(fp)
+	if err != nil {
+		return nil, err
+	}
+	d := &decryptedFile{f: f, meta: p.meta, w: f}
+
+	if c := Compression(p.header.Compression); c != NoCompression {
+		pr, pw := io.Pipe()
+		d.w, d.pw, d.done = pw, pw, make(chan error, 1)
+		go func() {
+			buf := bufio.NewWriterSize(f, bufferSize(p.meta.Size))
+			err := decompress(pr, buf, c, p.meta.Size)
+			if err == nil {
+				err = buf.Flush()
+			}
+			// further writes fail, there is nothing after the compressed data
+			pr.CloseWithError(err)
+			d.done <- err
+		}()
+	}
+
+	return d, nil
+}
+
+// decompress writes to dst the data decompressed from src, which must be exactly size bytes.
+func decompress(src io.Reader, dst io.Writer, c Compression, size int64) error {
+	r, err := newSizedDecompressor(src, c, size)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
+	defer r.Close()
+
+	_, err = io.Copy(dst, r)
+	return err
+}
 
-	// write decrypted data
-	log.Printf("decrypt %s -> %s\n", srcpath, dst.Name())
-	if err := decrypt(src, dst, key); err != nil {
-		os.Remove(dst.Name())
-		return fmt.Errorf("failed to decrypt '%s': %v", srcpath, err)
+// close waits for the decompression, if any, and closes the file.
+func (d *decryptedFile) close() error {
+	var err error
+	if d.pw != nil {
+		d.pw.Close()
+		err = <-d.done
 	}
+	if cerr := d.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
 
-	return nil
+// abort closes and removes the file.
+func (d *decryptedFile) abort() {
+	if d.pw != nil {
+		d.pw.CloseWithError(fmt.Errorf("aborted"))
+		<-d.done
+	}
+	d.f.Close()
+	os.Remove(d.f.Name())
 }
 
 // DecryptDir walks srcdir and calls DecryptFile on each file.
 func DecryptDir(srcdir string, outdir string, key []byte) error {
+	d, err := NewDecrypter(DecryptOptions{Identities: []Identity{NewKeyIdentity(key)}})
+	if err != nil {
+		return err
+	}
+	return d.DecryptDir(context.Background(), srcdir, outdir, nil)
+}
+
+func (d *Decrypter) decryptDir(t *tracker, srcdir string, outdir string) error {
+	files, err := walkFiles(t, srcdir, outdir)
+	if err != nil {
+		return err
+	}
+
 	// dict is used to avoid decrypting twice the same file, for e.g.
 	// when Input is []string{"foo.mp4.1-3.bmp", "foo.mp4.2-3.bmp", "foo.mp4.3-3.bmp"}
 	// no matter what file is used as arg, DecryptFile is going to generate
-	// always the same file: "foo.mp4"
+	// always the same file: "foo.mp4". It is filled before the files are
+	// decrypted concurrently, the first part found is the one decrypted.
 	dict := make(map[string]bool)
-
-	walkFn := func(fp string, fi os.FileInfo, err error) error {
-		if err != nil || fi.IsDir() || fi.Size() == 0 {
-			return nil
-		}
-		rel, err := filepath.Rel(srcdir, filepath.Dir(fp))
+	skip := make([]bool, len(files))
+	for i, f := range files {
+		name, err := DecryptedFilename(f.fp)
 		if err != nil {
-			return err
+			continue
 		}
+		dp := filepath.Join(f.outdir, name)
+		skip[i] = dict[dp]
+		dict[dp] = true
+	}
 
-		reloutdir := filepath.Join(outdir, rel)
-
-		dp := filepath.Join(reloutdir, DecryptedFilename(fi.Name()))
-		if dict[dp] {
+	return t.runFiles(len(files), d.opts.Jobs, func(t *tracker, i int) error {
+		f := files[i]
+		if skip[i] {
 			return nil
 		}
-		dict[dp] = true
 
-		if err := os.MkdirAll(reloutdir, os.ModePerm); err != nil {
+		// only images can be decrypted, the other files are left alone
+		if _, err := DecryptedFilename(f.fp); err != nil {
+			t.logf("skip %s: %v\n", f.fp, err)
+			return nil
+		}
+		if err := os.MkdirAll(f.outdir, os.ModePerm); err != nil {
 			return err
 		}
-		return DecryptFile(fp, reloutdir, key)
-	}
+		return d.decryptFile(t, f.fp, f.outdir)
+	})
+}
 
-	return filepath.Walk(srcdir, walkFn)
+// dirFile is a file of a directory to encrypt or decrypt into outdir.
+type dirFile struct {
+	fp     string
+	outdir string
 }
 
-// EncryptDir walks srcdir and calls EncryptFile on each file.
-func EncryptDir(srcdir string, outdir string, key []byte, split int) error {
+// walkFiles returns the non-empty files of srcdir in lexical order, along with the folder
+// of outdir matching the one of srcdir where they are.
+func walkFiles(t *tracker, srcdir string, outdir string) ([]dirFile, error) {
+	var files []dirFile
 	walkFn := func(fp string, fi os.FileInfo, err error) error {
+		if t.err() != nil {
+			return t.err()
+		}
 		if err != nil || fi.IsDir() || fi.Size() == 0 {
 			return nil
 		}
@@ -151,197 +398,404 @@ func EncryptDir(srcdir string, outdir string, key []byte, split int) error {
 		if err != nil {
 			return err
 		}
-		return EncryptFile(fp, filepath.Join(outdir, rel), key, split)
+		files = append(files, dirFile{fp: fp, outdir: filepath.Join(outdir, rel)})
+		return nil
 	}
 
-	return filepath.Walk(srcdir, walkFn)
+	return files, filepath.Walk(srcdir, walkFn)
+}
+
+// walkSize returns the total size of the files of dir accepted by fn.
+func walkSize(dir string, fn func(fp string) bool) (int64, error) {
+	total := int64(0)
+	err := filepath.Walk(dir, func(fp string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && fn(fp) {
+			total += fi.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// EncryptDir walks srcdir and calls EncryptFile on each file.
+func EncryptDir(srcdir string, outdir string, key []byte, split int) error {
+	e, err := newKeyEncrypter(key, split)
+	if err != nil {
+		return err
+	}
+	return e.EncryptDir(context.Background(), srcdir, outdir, nil)
 }
 
+func (e *Encrypter) encryptDir(t *tracker, srcdir string, outdir string) error {
+	files, err := walkFiles(t, srcdir, outdir)
+	if err != nil {
+		return err
+	}
+	return t.runFiles(len(files), e.opts.Jobs, func(t *tracker, i int) error {
+		return e.encryptFile(t, files[i].fp, files[i].outdir)
+	})
+}
+
+// MaxSplit is the maximum size of the parts of a splitted file, the images holding them
+// cannot be larger than 4 GiB.
+const MaxSplit int64 = 4000 * 1000 * 1000
+
 // EncryptFile encrypts the given file into outdir, writing a new valid .bmp image.
-// Empty files are ignored.
+// The file key is wrapped with the key material, see NewKeyRecipient, and the other
+// options are the defaults of EncryptOptions. Files larger than split bytes are splitted,
+// see MaxSplit. See Encrypter.EncryptFile for the passwords and the other options.
 func EncryptFile(src string, outdir string, key []byte, split int) error {
-	f, err := os.Open(src)
+	e, err := newKeyEncrypter(key, split)
+	if err != nil {
+		return err
+	}
+	return e.EncryptFile(context.Background(), src, outdir, nil)
+}
+
+// newKeyEncrypter returns the Encrypter used by the functions taking a key.
+func newKeyEncrypter(key []byte, split int) (*Encrypter, error) {
+	if split < 1 {
+		return nil, fmt.Errorf("invalid split %d, it must be between 1 and %d", split, MaxSplit)
+	}
+	r, err := NewKeyRecipient(key)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncrypter(EncryptOptions{Recipients: []Recipient{r}, Split: int64(split)})
+}
+
+func (e *Encrypter) encryptFile(t *tracker, src string, outdir string) error {
+	opts := &e.opts
+	header, fileKey, err := newPayloadHeader(opts.Rand, opts.Recipients, opts.Cipher)
+	if err != nil {
+		return err
+	}
+
+	// the progress counts the bytes of src, read either by the compression or by the encryption
+	srcinfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	t.startFile(srcinfo.Size())
+
+	// compress the file, when it helps; the compressed data never reaches the disk in clear
+	var compressed *spool
+	if comp := opts.Compression; comp.Algorithm != NoCompression {
+		t.startPart(src, 0, 0)
+		if compressed, err = compressFile(t, src, comp); err != nil {
+			return err
+		}
+		if compressed != nil {
+			defer compressed.close()
+			header.Compression = uint8(comp.Algorithm)
+		} else {
+			t.rewindFile()
+		}
+	}
+	// the bytes of a compressed file have already been counted by the compression
+	counted := compressed != nil
+
+	// the parts read their range of the compressed data or of the file
+	var size int64
+	var section func(off, n int64) (io.Reader, error)
+	if compressed != nil {
+		size, section = compressed.size, compressed.section
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size = fi.Size()
+		section = func(off, n int64) (io.Reader, error) {
+			return io.NewSectionReader(f, off, n), nil
+		}
+	}
+
+	// store the original filename and attributes, and choose the name of the images
+	meta, err := newMetadata(src, opts.Preserve)
+	if err != nil {
+		return err
+	}
+	if err := header.sealMetadata(fileKey, meta); err != nil {
+		return err
+	}
+	base, err := expandNameTemplate(opts.Rand, opts.NameTemplate, meta.Name)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	// eventually split the file into many; each file will be a valid .bmp image
-	list := getByteRanges(GetFileSize(src), int64(split))
+	// eventually split the file into many; each file will be a valid file of the container,
+	// no larger than the container allows (see Dimensions), or filling its cover
+	var list []byteRange
+	if len(e.covers) > 0 {
+		if list, err = coverRanges(size, opts.Split, len(header.bytes()), opts.Cipher, e.covers); err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+	} else {
+		split, err := maxClearSize(len(header.bytes()), opts.Cipher, opts.Container.Capacity())
+		if err != nil {
+			return err
+		}
+		if split > opts.Split {
+			split = opts.Split
+		}
+		list = getByteRanges(size, split)
+	}
+
+	// the parts are encrypted concurrently, on failure no part must be left behind
+	created := make([]bool, len(list))
+	err = runParts(len(list), opts.Concurrency, func(i int) error {
+		r := list[i]
 
-	for _, r := range list {
 		// create the destination file
-		dstfile := filepath.Join(outdir, encryptedFilename(filepath.Base(src), r.index, len(list)))
+		dstfile := filepath.Join(outdir, encryptedFilename(base, r.index, len(list), opts.Container.Ext()))
 		os.MkdirAll(filepath.Dir(dstfile), os.ModePerm)
-		dst, err := os.Create(dstfile)
+		dst, err := opts.Overwrite.create(dstfile)
 		if err != nil {
 			return err
 		}
+		created[i] = true
 
 		// write the encrypted data
-		log.Printf("encrypt %s -> %s (%d bytes)\n", src, dstfile, r.len)
-		if err := encrypt(io.NewSectionReader(f, r.off, r.len), dst, key, int(r.len)); err != nil {
+		t.logf("encrypt %s -> %s (%d bytes)\n", src, dstfile, r.len)
+		t.startPart(src, r.index+1, len(list))
+		sr, err := section(r.off, r.len)
+		if err != nil {
 			dst.Close()
 			return err
 		}
-		dst.Close()
+		in := bufio.NewReaderSize(sr, bufferSize(r.len))
+		part := partInfo{Index: uint32(r.index), Count: uint32(len(list)), Offset: uint64(r.off)}
+		err = encryptPart(opts.Rand, t.reader(in, !counted), dst, e.container(i), header, fileKey, r.len, part)
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if err != nil {
+		for i, r := range list {
+			if created[i] {
+				os.Remove(filepath.Join(outdir, encryptedFilename(base, r.index, len(list), opts.Container.Ext())))
+			}
+		}
+		return err
 	}
 
 	return nil
 }
 
-func encrypt(src io.Reader, dst io.Writer, key []byte, clearsize int) error {
-	// iv + clearsize + data (padded) + hash
-	encsize := 16 + 16 + clearsize + (16 - clearsize%16) + 32
+// encrypt writes to dst the file of the container c carrying the clearsize bytes read from
+// src, the nonces and the filler are read from rnd. The writes to dst are buffered.
+func encrypt(rnd io.Reader, src io.Reader, dst io.Writer, c Container, header payloadHeader, fileKey []byte, clearsize int64) error {
+	return encryptPart(rnd, src, dst, c, header, fileKey, clearsize, singlePart)
+}
 
+// encryptPart is encrypt writing the part of a splitted file.
+func encryptPart(rnd io.Reader, src io.Reader, dst io.Writer, c Container, header payloadHeader, fileKey []byte, clearsize int64, part partInfo) error {
 	// prepare the cipher
-	block, err := aes.NewCipher(key)
+	key, err := payloadKey(fileKey)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(Cipher(header.Cipher), key)
 	if err != nil {
 		return err
 	}
 
-	// init the sha256 hash digest that will be appended at the end
-	// of the encrypted payload
-	h := sha256.New()
-
-	// write the bitmap header
-	dim := int(math.Ceil(math.Sqrt(float64(encsize) / 4.0)))
-	bmpHeader := newBmpHeader(dim, dim)
-	binary.Write(dst, binary.LittleEndian, bmpHeader)
-
-	// allocate 2 buffers of 16 bytes
-	buf := make([]byte, aes.BlockSize)
-	encBuf := make([]byte, aes.BlockSize)
-
-	// get a random IV and write it
-	randBuf(buf, 0)
-	mode := cipher.NewCBCEncrypter(block, buf)
-	dst.Write(buf)
-
-	// write the filesize
-	randBuf(buf, 0)
-	binary.LittleEndian.PutUint32(buf, uint32(clearsize))
-	mode.CryptBlocks(encBuf, buf)
-	dst.Write(encBuf)
-
-	// write the rest of the data
-	readed := 0
-	for {
-		n, err := src.Read(buf)
-
-		if err != nil && err != io.EOF {
-			return err
-		}
-
-		if err == io.EOF && n == 0 {
-			break
-		}
-
-		if n == 0 {
-			continue
-		}
+	// write the headers of the container, the file must be large enough for the payload
+	hb := header.bytes()
+	size := payloadSize(len(hb), aead, clearsize)
+	w := bufio.NewWriterSize(dst, bufferSize(size))
+	cw, err := c.newWriter(w, size, rnd)
+	if err != nil {
+		return err
+	}
 
-		readed += n
+	// write the payload header, the clearsize and the position of the part
+	cw.Write(hb)
+	binary.Write(cw, binary.LittleEndian, uint64(clearsize))
+	binary.Write(cw, binary.LittleEndian, part)
 
-		if n < len(buf) && readed != clearsize {
-			return fmt.Errorf("failed to read %d bytes", len(buf))
-		}
+	// get a random nonce prefix and write it
+	prefix := make([]byte, streamPrefixSize(aead))
+	if _, err := io.ReadFull(rnd, prefix); err != nil {
+		return err
+	}
+	cw.Write(prefix)
 
-		if n < len(buf) {
-			randBuf(buf, n)
-		}
+	// encrypt the data chunk by chunk
+	s, err := newStream(aead, prefix, header.additionalData(uint64(clearsize), part))
+	if err != nil {
+		return err
+	}
+	if err := s.encrypt(src, cw, clearsize); err != nil {
+		return err
+	}
 
-		h.Write(buf[0:n])
-		mode.CryptBlocks(encBuf, buf)
-		dst.Write(encBuf)
+	// fill the rest of the container with random bytes
+	if err := cw.Close(); err != nil {
+		return err
 	}
+	return w.Flush()
+}
 
-	// write the sha256 hash (32 bytes)
-	dst.Write(h.Sum(nil))
+// payloadSize returns the size of a payload: header, clearsize, part, nonce prefix and chunks.
+func payloadSize(headerSize int, aead cipher.AEAD, clearsize int64) int64 {
+	return int64(headerSize) + 8 + int64(partInfoSize) + streamOverhead(aead, clearsize) + clearsize
+}
 
-	// write the remaining bytes to fill the bmp data-section with random bytes
-	if left := int(bmpHeader.ImageSize) - encsize; left > 0 {
-		_, err := io.CopyN(dst, rand.Reader, int64(left))
-		if err != nil {
-			return err
-		}
+// maxClearSize returns the size of the largest data whose payload, with a header of
+// headerSize bytes and encrypted with the cipher c, fits in capacity bytes.
+func maxClearSize(headerSize int, c Cipher, capacity int64) (int64, error) {
+	aead, err := newAEAD(c, make([]byte, 32))
+	if err != nil {
+		return 0, err
 	}
-
-	return nil
+	overhead := int64(aead.Overhead())
+	avail := capacity - int64(headerSize) - 8 - int64(partInfoSize) - int64(streamPrefixSize(aead))
+	size := avail / (chunkSize + overhead) * chunkSize
+	if rem := avail % (chunkSize + overhead); rem > overhead {
+		size += rem - overhead
+	}
+	if size < 1 {
+		return 0, fmt.Errorf("the files of %d bytes are too small for the headers of %d bytes", capacity, headerSize)
+	}
+	return size, nil
 }
 
-func decrypt(src io.Reader, dst io.Writer, key []byte) error {
-	block, err := aes.NewCipher(key)
+func decrypt(src io.Reader, dst io.Writer, ids identities) error {
+	p, err := openPayload(src, ids, DefaultKDFLimits)
 	if err != nil {
 		return err
 	}
+	return p.decrypt(dst)
+}
 
-	// init the sha256 hash digest that will be used to verify if decryption is ok
-	h := sha256.New()
+// payload is a payload whose header has been read, unlocked and authenticated.
+type payload struct {
+	header  payloadHeader
+	fileKey []byte
+	meta    metadata
+	data    io.Reader
+	// part is read along with the clearsize, by reader
+	part partInfo
+}
 
-	// allocate 2 buffers of 16 bytes
-	buf := make([]byte, aes.BlockSize)
-	clearBuf := make([]byte, aes.BlockSize)
+// openPayload reads the headers of the container and of the payload from src, unwrapping
+// the file key with ids within limits. The data of the payload is left unread. When the payload is not
+// found where encrypt writes it, for e.g. after a lossless conversion to another format,
+// the whole file is decoded as an image and the payload is read from its pixels.
+func openPayload(src io.Reader, ids identities, limits KDFLimits) (*payload, error) {
+	rec := &recordReader{r: src}
+	_, data, err := openContainer(rec)
+	var p *payload
+	if err == nil {
+		p, err = unlockPayload(data, ids, limits)
+	}
+	rec.stop()
+	if !errors.Is(err, ErrNotRoeImage) {
+		return p, err
+	}
 
-	// read the bitmap header
-	hBuf := make([]byte, 54)
-	src.Read(hBuf)
+	img, derr := decodeImage(rec.rewind())
+	if derr != nil {
+		return nil, err
+	}
+	if data, derr = imageData(img, ids); derr != nil {
+		return nil, err
+	}
+	return unlockPayload(data, ids, limits)
+}
 
-	// read the iv and initialize the cipher
-	n, err := src.Read(buf)
+// unlockPayload reads the payload header from data, unwrapping the file key with ids
+// within limits and authenticating the header.
+func unlockPayload(data io.Reader, ids identities, limits KDFLimits) (*payload, error) {
+	header, err := readPayloadHeader(data)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	fileKey, err := ids.fileKey(header, limits)
+	if err != nil {
+		return nil, err
 	}
-	if n != len(buf) {
-		return fmt.Errorf("failed to read %d bytes", len(buf))
+	if err := header.verify(fileKey); err != nil {
+		return nil, err
+	}
+	meta, err := header.openMetadata(fileKey)
+	if err != nil {
+		return nil, err
 	}
-	mode := cipher.NewCBCDecrypter(block, buf)
 
-	// decrypt the filesize
-	src.Read(buf)
-	mode.CryptBlocks(clearBuf, buf)
-	clearsize := int(binary.LittleEndian.Uint32(clearBuf))
+	return &payload{header: header, fileKey: fileKey, meta: meta, data: data}, nil
+}
 
-	// decrypt the data-seciton
-	written := 0
-	for {
-		if clearsize == 0 {
-			break
-		}
+// decrypt reads the encrypted data, writing it to dst.
+func (p *payload) decrypt(dst io.Writer) error {
+	r, err := p.reader()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
 
-		n, err := src.Read(buf)
+// reader returns a reader of the data decrypted chunk by chunk.
+func (p *payload) reader() (*streamReader, error) {
+	src := p.data
+	key, err := payloadKey(p.fileKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(Cipher(p.header.Cipher), key)
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil && err != io.EOF {
-			return err
-		}
+	// read the clearsize, a container cannot hold more than 4 GiB
+	var clearsize uint64
+	if err := binary.Read(src, binary.LittleEndian, &clearsize); err != nil {
+		return nil, readError(err, "failed to read the payload size")
+	}
+	if clearsize > maxPayloadSize {
+		return nil, newError(ErrCorrupted, "invalid payload size %d", clearsize)
+	}
 
-		if err == io.EOF && n == 0 {
-			break
-		}
+	// read the position of the part, authenticated with the data
+	if err := binary.Read(src, binary.LittleEndian, &p.part); err != nil {
+		return nil, readError(err, "failed to read the payload part")
+	}
+	if p.part.Count == 0 || p.part.Index >= p.part.Count {
+		return nil, newError(ErrCorrupted, "invalid payload part %d of %d", p.part.Index+1, p.part.Count)
+	}
 
-		if n != len(buf) {
-			return fmt.Errorf("failed to read %d bytes, %d bytes were written", len(buf), written)
-		}
+	// read the nonce prefix
+	prefix := make([]byte, streamPrefixSize(aead))
+	if _, err := io.ReadFull(src, prefix); err != nil {
+		return nil, readError(err, "failed to read the nonce")
+	}
 
-		mode.CryptBlocks(clearBuf, buf)
-		written += n
+	// decrypt and verify the data chunk by chunk
+	s, err := newStream(aead, prefix, p.header.additionalData(clearsize, p.part))
+	if err != nil {
+		return nil, err
+	}
+	return s.reader(src, int64(clearsize)), nil
+}
 
-		if written >= clearsize {
-			n = len(buf) - (written - clearsize)
-			dst.Write(clearBuf[0:n])
-			h.Write(clearBuf[0:n])
-			break
-		} else {
-			dst.Write(clearBuf)
-			h.Write(clearBuf[0:n])
-		}
+// readCloser returns a reader of the data decrypted and decompressed.
+func (p *payload) readCloser() (io.ReadCloser, error) {
+	r, err := p.reader()
+	if err != nil {
+		return nil, err
 	}
 
-	// compare the checksum
-	expectedHash := make([]byte, 32)
-	src.Read(expectedHash)
-	if !bytes.Equal(expectedHash, h.Sum(nil)) {
-		return fmt.Errorf("sha256 hash check failed")
+	if c := Compression(p.header.Compression); c != NoCompression {
+		return newSizedDecompressor(r, c, p.meta.Size)
 	}
-	return nil
+	return ioutil.NopCloser(r), nil
 }
@@ -2,16 +2,61 @@ package roe
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
 	mrand "math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
+// testKDFParams are the cheapest argon2id params, to keep the tests fast
+var testKDFParams = KDFParams{Algorithm: Argon2id, Time: 1, Memory: 8, Threads: 1}
+
+// encryptWithPassword calls encrypt with a single password slot using testKDFParams.
+func encryptWithPassword(src io.Reader, dst io.Writer, password string, c Cipher, clearsize int) error {
+	header, fileKey, err := newPayloadHeader(rand.Reader, []Recipient{NewPasswordRecipient(password, testKDFParams)}, c)
+	if err != nil {
+		return err
+	}
+	return encrypt(rand.Reader, src, dst, BMP, header, fileKey, int64(clearsize))
+}
+
+// encryptFile encrypts src into outdir with a single password slot using testKDFParams,
+// the other options are the ones of opts.
+func encryptFile(src, outdir, password string, opts EncryptOptions) error {
+	opts.Recipients = []Recipient{NewPasswordRecipient(password, testKDFParams)}
+	e, err := NewEncrypter(opts)
+	if err != nil {
+		return err
+	}
+	return e.EncryptFile(context.Background(), src, outdir, nil)
+}
+
+// decryptFile decrypts srcpath into outdir with the password.
+func decryptFile(srcpath, outdir, password string) error {
+	d, err := NewDecrypter(DecryptOptions{Identities: []Identity{NewPasswordIdentity(password)}})
+	if err != nil {
+		return err
+	}
+	return d.DecryptFile(context.Background(), srcpath, outdir, nil)
+}
+
+// decryptDir decrypts srcdir into outdir with the password.
+func decryptDir(srcdir, outdir, password string) error {
+	d, err := NewDecrypter(DecryptOptions{Identities: []Identity{NewPasswordIdentity(password)}})
+	if err != nil {
+		return err
+	}
+	return d.DecryptDir(context.Background(), srcdir, outdir, nil)
+}
+
 func randInt(min, max int) int {
 	mrand.Seed(time.Now().UnixNano())
 	return mrand.Intn(max-min+1) + min
@@ -27,10 +72,7 @@ func createRandomFile(fp string, size int) []byte {
 }
 
 // encryptAndDecryptRand tests the encrypt/decrypt functions using a slice of random bytes of size n.
-func encryptAndDecryptRand(n int) error {
-	// encryption/decryption key
-	key := KeyFromPassword("foobar")
-
+func encryptAndDecryptRand(n int, c Cipher) error {
 	// cleartext, a buffer filled with random bytes
 	cleartext := make([]byte, n)
 	rand.Read(cleartext)
@@ -39,7 +81,7 @@ func encryptAndDecryptRand(n int) error {
 	buffer := bytes.NewBuffer(make([]byte, 0))
 
 	// encrypt
-	if err := encrypt(bytes.NewReader(cleartext), buffer, key, n); err != nil {
+	if err := encryptWithPassword(bytes.NewReader(cleartext), buffer, "foobar", c, n); err != nil {
 		return err
 	}
 
@@ -48,7 +90,7 @@ func encryptAndDecryptRand(n int) error {
 	buffer.Reset()
 
 	// decrypt
-	if err := decrypt(bytes.NewReader(enc), buffer, key); err != nil {
+	if err := decrypt(bytes.NewReader(enc), buffer, identities{NewPasswordIdentity("foobar")}); err != nil {
 		return err
 	}
 
@@ -67,13 +109,37 @@ func Test_encryptAndDecrypt(t *testing.T) {
 		clearsizes = append(clearsizes, i)
 	}
 
-	for _, clearsize := range clearsizes {
-		f := func(t2 *testing.T) {
-			if err := encryptAndDecryptRand(clearsize); err != nil {
-				t2.Error(err)
+	for _, c := range []Cipher{AES256GCM, XChaCha20Poly1305} {
+		for _, clearsize := range clearsizes {
+			f := func(t2 *testing.T) {
+				if err := encryptAndDecryptRand(clearsize, c); err != nil {
+					t2.Error(err)
+				}
 			}
+			t.Run(fmt.Sprintf("encryptAndDecryptRand(%d, %s)", clearsize, c), f)
 		}
-		t.Run(fmt.Sprintf("encryptAndDecryptRand(%d)", clearsize), f)
+	}
+}
+
+// countingWriter counts the calls to Write.
+type countingWriter struct {
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func Test_encryptBuffersWrites(t *testing.T) {
+	size := 3 * ioBufferSize
+	w := &countingWriter{}
+	if err := encryptWithPassword(bytes.NewReader(make([]byte, size)), w, "foobar", DefaultCipher, size); err != nil {
+		t.Fatal(err)
+	}
+	// the image is a bit larger than the cleartext
+	if w.writes > 4 {
+		t.Errorf("expected at most 4 writes of %d bytes, got %d", ioBufferSize, w.writes)
 	}
 }
 
@@ -84,8 +150,8 @@ func Test_encryptFileAndDecryptFile(t *testing.T) {
 	defer os.Remove(tmpdir)
 
 	for n := 1; n <= 1024; n++ {
-		// create a key
-		key := KeyFromPassword(fmt.Sprintf("my secret password %d", n))
+		// create a password
+		password := fmt.Sprintf("my secret password %d", n)
 
 		// ensure these temporary folders exist
 		cleandir := filepath.Join(tmpdir, "clean") // folder for clean files
@@ -106,7 +172,7 @@ func Test_encryptFileAndDecryptFile(t *testing.T) {
 		}
 
 		// call EncryptFile
-		if err := EncryptFile(cleanpath, encdir, key, split); err != nil {
+		if err := encryptFile(cleanpath, encdir, password, EncryptOptions{Split: int64(split), Preserve: PreserveAll}); err != nil {
 			t.Error(err)
 			return
 		}
@@ -118,7 +184,7 @@ func Test_encryptFileAndDecryptFile(t *testing.T) {
 			return
 		}
 		encpath := filepath.Join(encdir, files[0].Name())
-		if err := DecryptFile(encpath, decdir, key); err != nil {
+		if err := decryptFile(encpath, decdir, password); err != nil {
 			t.Error(err)
 			return
 		}
@@ -140,3 +206,77 @@ func Test_encryptFileAndDecryptFile(t *testing.T) {
 		os.RemoveAll(tmpdir)
 	}
 }
+
+func Test_decryptForeignBmp(t *testing.T) {
+	// a valid bmp image filled with random pixels
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	binary.Write(buffer, binary.LittleEndian, newBmpHeader(16, 16))
+	pixels := make([]byte, 4*16*16)
+	rand.Read(pixels)
+	buffer.Write(pixels)
+
+	err := decrypt(bytes.NewReader(buffer.Bytes()), ioutil.Discard, identities{NewPasswordIdentity("foobar")})
+	if err != errNotRoePayload {
+		t.Errorf("expected %v, got %v", errNotRoePayload, err)
+	}
+}
+
+func Test_decryptUnsupportedVersion(t *testing.T) {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := encryptWithPassword(bytes.NewReader([]byte("hello")), buffer, "foobar", DefaultCipher, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// the version byte is right after the magic, the older versions are not supported either
+	for _, version := range []uint8{payloadVersion + 1, payloadVersion - 1} {
+		enc := append([]byte{}, buffer.Bytes()...)
+		enc[54+len(payloadMagic)] = version
+
+		err := decrypt(bytes.NewReader(enc), ioutil.Discard, identities{NewPasswordIdentity("foobar")})
+		if err == nil || !strings.Contains(err.Error(), "unsupported format version") {
+			t.Errorf("version %d: expected an unsupported version error, got %v", version, err)
+		}
+	}
+}
+
+func Test_decryptWrongPassword(t *testing.T) {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := encryptWithPassword(bytes.NewReader([]byte("hello")), buffer, "foobar", DefaultCipher, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := decrypt(bytes.NewReader(buffer.Bytes()), ioutil.Discard, identities{NewPasswordIdentity("barfoo")}); err != errWrongPassword {
+		t.Errorf("expected %v, got %v", errWrongPassword, err)
+	}
+}
+
+func Test_decryptTampered(t *testing.T) {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := encryptWithPassword(bytes.NewReader([]byte("hello world")), buffer, "foobar", DefaultCipher, 11); err != nil {
+		t.Fatal(err)
+	}
+	enc := buffer.Bytes()
+	header, err := readPayloadHeader(bytes.NewReader(enc[54:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsize := len(header.bytes())
+
+	// flip one bit of the cipher, of the salt, of the mac, of the size, of the part, of the nonce prefix and of the data
+	offsets := map[string]int{
+		"cipher": 54 + len(payloadMagic) + 1,
+		"salt":   54 + fixedHeaderSize + 1 + 3 + 2,
+		"mac":    54 + hsize - 1,
+		"size":   54 + hsize,
+		"part":   54 + hsize + 8 + 4,
+		"nonce":  54 + hsize + 8 + partInfoSize,
+		"data":   54 + hsize + 8 + partInfoSize + 7,
+	}
+	for name, off := range offsets {
+		tampered := append([]byte{}, enc...)
+		tampered[off] ^= 1
+		if err := decrypt(bytes.NewReader(tampered), ioutil.Discard, identities{NewPasswordIdentity("foobar")}); err == nil {
+			t.Errorf("tampering the %s should be detected", name)
+		}
+	}
+}
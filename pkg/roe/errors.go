@@ -0,0 +1,54 @@
+package roe
+
+import (
+	"fmt"
+	"io"
+)
+
+// The kinds of errors returned when decrypting an image. The errors returned by roe
+// carry a more specific message, use errors.Is to test their kind.
+var (
+	// ErrWrongKey is returned when no password, keyfile or identity opens any of the key slots.
+	ErrWrongKey = fmt.Errorf("wrong password or key")
+
+	// ErrCorrupted is returned when the image has been modified after the encryption.
+	ErrCorrupted = fmt.Errorf("corrupted image")
+
+	// ErrTruncated is returned when the image ends before the encrypted data.
+	ErrTruncated = fmt.Errorf("truncated image")
+
+	// ErrNotRoeImage is returned when the image has not been created by roe.
+	ErrNotRoeImage = fmt.Errorf("not a roe image")
+
+	// ErrMissingParts is returned when some of the parts of a splitted file cannot be found.
+	ErrMissingParts = fmt.Errorf("missing parts")
+)
+
+// roeError is an error of one of the kinds above.
+type roeError struct {
+	kind error
+	msg  string
+}
+
+func (e *roeError) Error() string {
+	return e.msg
+}
+
+func (e *roeError) Unwrap() error {
+	return e.kind
+}
+
+// newError returns an error of the given kind with a formatted message.
+func newError(kind error, format string, a ...interface{}) error {
+	return &roeError{kind: kind, msg: fmt.Sprintf(format, a...)}
+}
+
+// readError describes the failure of a read, the error is an ErrTruncated when the
+// data ended too early.
+func readError(err error, format string, a ...interface{}) error {
+	msg := fmt.Sprintf(format, a...)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return newError(ErrTruncated, "%s: %v", msg, ErrTruncated)
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
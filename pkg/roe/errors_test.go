@@ -0,0 +1,118 @@
+package roe
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_decryptFileErrors(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "clean.bin")
+	createRandomFile(cleanpath, 2500)
+	encdir := filepath.Join(tmpdir, "enc")
+	if err := encryptFile(cleanpath, encdir, "foobar", EncryptOptions{Split: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	part := func(i int) string {
+		return filepath.Join(encdir, encryptedFilename("clean.bin", i, 3, ".bmp"))
+	}
+	// the images of a file which is not splitted
+	singlepath := filepath.Join(tmpdir, "single.bin")
+	createRandomFile(singlepath, 1000)
+	if err := encryptFile(singlepath, encdir, "foobar", EncryptOptions{Split: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	single := filepath.Join(encdir, encryptedFilename("single.bin", 0, 1, ".bmp"))
+	enc, _ := ioutil.ReadFile(single)
+
+	// a copy of the single image, modified by fn
+	modified := func(name string, fn func([]byte) []byte) string {
+		fp := filepath.Join(tmpdir, name+".bmp")
+		ioutil.WriteFile(fp, fn(append([]byte{}, enc...)), 0644)
+		return fp
+	}
+	header, err := readPayloadHeaderFile(single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datastart := 54 + len(header.bytes()) + 8 + partInfoSize + 7
+
+	foreign := filepath.Join(tmpdir, "foreign.bmp")
+	createRandomFile(foreign, 1000)
+
+	cases := []struct {
+		fp       string
+		password string
+		kind     error
+	}{
+		{part(0), "barfoo", ErrWrongKey},
+		{modified("corrupted", func(b []byte) []byte { b[datastart] ^= 1; return b }), "foobar", ErrCorrupted},
+		{modified("truncated", func(b []byte) []byte { return b[:datastart+10] }), "foobar", ErrTruncated},
+		{modified("header", func(b []byte) []byte { return b[:54+fixedHeaderSize+3] }), "foobar", ErrTruncated},
+		{foreign, "foobar", ErrNotRoeImage},
+	}
+	decdir := filepath.Join(tmpdir, "dec")
+	os.MkdirAll(decdir, os.ModePerm)
+	for _, c := range cases {
+		err := decryptFile(c.fp, decdir, c.password)
+		if !errors.Is(err, c.kind) {
+			t.Errorf("%s: expected %v, got %v", filepath.Base(c.fp), c.kind, err)
+		}
+	}
+
+	os.Remove(part(1))
+	if err := decryptFile(part(0), decdir, "foobar"); !errors.Is(err, ErrMissingParts) {
+		t.Errorf("expected %v, got %v", ErrMissingParts, err)
+	}
+}
+
+// readPayloadHeaderFile reads the payload header of the image fp.
+func readPayloadHeaderFile(fp string) (payloadHeader, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return payloadHeader{}, err
+	}
+	defer f.Close()
+	f.Seek(54, 0)
+	return readPayloadHeader(f)
+}
+
+func Test_decryptFileSwappedParts(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	encrypt := func(name string) func(i int) string {
+		fp := filepath.Join(tmpdir, name)
+		createRandomFile(fp, 2500)
+		encdir := filepath.Join(tmpdir, "enc")
+		if err := encryptFile(fp, encdir, "foobar", EncryptOptions{Split: 1000}); err != nil {
+			t.Fatal(err)
+		}
+		return func(i int) string {
+			return filepath.Join(encdir, encryptedFilename(name, i, 3, ".bmp"))
+		}
+	}
+	part := encrypt("clean.bin")
+	other := encrypt("other.bin")
+	decdir := filepath.Join(tmpdir, "dec")
+	os.MkdirAll(decdir, os.ModePerm)
+
+	// swap the second and the third part
+	os.Rename(part(1), part(1)+".tmp")
+	os.Rename(part(2), part(1))
+	os.Rename(part(1)+".tmp", part(2))
+	if err := decryptFile(part(0), decdir, "foobar"); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("swapped: expected %v, got %v", ErrCorrupted, err)
+	}
+
+	// a part of another file encrypted with the same password
+	os.Rename(other(1), part(1))
+	if err := decryptFile(part(0), decdir, "foobar"); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("mixed: expected %v, got %v", ErrCorrupted, err)
+	}
+}
@@ -0,0 +1,268 @@
+package roe
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg" // decode the covers
+	_ "image/png"  // decode the converted images
+	"io"
+
+	_ "golang.org/x/image/tiff"
+)
+
+// pixelLayout tells how the bytes of a payload are stored in the pixels of an image.
+type pixelLayout struct {
+	// bottomUp is true when the first row is the bottom one
+	bottomUp bool
+	// order is the channel, R, G, B or A, of each byte of a pixel
+	order [4]int
+}
+
+var (
+	// bmpLayout is the layout of the bmp images: B, G, R and A, from the bottom row.
+	bmpLayout = pixelLayout{bottomUp: true, order: [4]int{2, 1, 0, 3}}
+	// pngLayout is the layout of the png images and of EncryptToImage: R, G, B and A, from the top row.
+	pngLayout = pixelLayout{order: [4]int{0, 1, 2, 3}}
+)
+
+// imageReader reads the bytes stored in the pixels of an image, row by row.
+type imageReader struct {
+	img    image.Image
+	layout pixelLayout
+	row    []byte
+	y      int
+	off    int
+}
+
+func newImageReader(img image.Image, layout pixelLayout) *imageReader {
+	row := make([]byte, 4*img.Bounds().Dx())
+	return &imageReader{img: img, layout: layout, row: row, off: len(row)}
+}
+
+func (r *imageReader) Read(p []byte) (int, error) {
+	if r.off == len(r.row) {
+		b := r.img.Bounds()
+		if r.y == b.Dy() {
+			return 0, io.EOF
+		}
+		y := b.Min.Y + r.y
+		if r.layout.bottomUp {
+			y = b.Max.Y - 1 - r.y
+		}
+		r.readRow(y)
+		r.y++
+		r.off = 0
+	}
+	n := copy(p, r.row[r.off:])
+	r.off += n
+	return n, nil
+}
+
+// readRow reads the pixels of the row y, the images decoded as NRGBA are read directly.
+func (r *imageReader) readRow(y int) {
+	b := r.img.Bounds()
+	var pix []byte
+	if img, ok := r.img.(*image.NRGBA); ok {
+		i := img.PixOffset(b.Min.X, y)
+		pix = img.Pix[i : i+4*b.Dx()]
+	}
+
+	var c [4]byte
+	for x := 0; x < b.Dx(); x++ {
+		if pix != nil {
+			copy(c[:], pix[4*x:])
+		} else {
+			n := color.NRGBAModel.Convert(r.img.At(b.Min.X+x, y)).(color.NRGBA)
+			c = [4]byte{n.R, n.G, n.B, n.A}
+		}
+		for i, ch := range r.layout.order {
+			r.row[4*x+i] = c[ch]
+		}
+	}
+}
+
+// imageData returns a reader of the payload stored in the pixels of img, looking for it
+// in the layout of each container and then in the low bits of a cover image, opened with
+// one of the ids. The image must keep the alpha channel.
+func imageData(img image.Image, ids identities) (io.Reader, error) {
+	readers := []func() io.Reader{
+		func() io.Reader { return newImageReader(img, pngLayout) },
+		func() io.Reader { return newImageReader(img, bmpLayout) },
+	}
+	for _, newReader := range readers {
+		if data, ok := payloadStart(newReader()); ok {
+			return data, nil
+		}
+	}
+	if _, data, err := openCoverEnvelope(newLsbReader(img), ids); err == nil {
+		if data, ok := payloadStart(data); ok {
+			return data, nil
+		}
+	}
+	return nil, errNotRoePayload
+}
+
+// payloadStart reports whether the data read from r starts with a payload, it returns a
+// reader of the whole data.
+func payloadStart(r io.Reader) (io.Reader, bool) {
+	magic := make([]byte, len(payloadMagic))
+	n, err := io.ReadFull(r, magic)
+	return io.MultiReader(bytes.NewReader(magic[:n]), r), err == nil && bytes.Equal(magic, payloadMagic[:])
+}
+
+// imageSize returns the width and the height of the image read from r, only its header
+// is read.
+func imageSize(r io.Reader) (int64, int64, error) {
+	br := bufio.NewReader(r)
+	if head, err := br.Peek(2); err == nil && string(head) == "BM" {
+		info, err := readBmpInfo(br)
+		return info.width, info.height, err
+	}
+	cfg, _, err := image.DecodeConfig(br)
+	return int64(cfg.Width), int64(cfg.Height), err
+}
+
+// decodeImage decodes the image read from r: the bmp images are decoded by decodeBmp,
+// which keeps the alpha channel, the other ones by the decoder registered for their format.
+func decodeImage(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	if head, err := br.Peek(2); err == nil && string(head) == "BM" {
+		return decodeBmp(br)
+	}
+	img, _, err := image.Decode(br)
+	return img, err
+}
+
+// DecodeImage decodes a bmp, png, tiff or jpeg image read from r, for e.g. a cover (see
+// EncryptOptions.Covers). The alpha channel of the bmp images is kept.
+func DecodeImage(r io.Reader) (image.Image, error) {
+	return decodeImage(r)
+}
+
+// recordReader keeps the data read from r until stop, so that it can be read again.
+type recordReader struct {
+	r       io.Reader
+	buf     []byte
+	stopped bool
+}
+
+func (rr *recordReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if !rr.stopped {
+		rr.buf = append(rr.buf, p[:n]...)
+	}
+	return n, err
+}
+
+// stop stops recording the data read.
+func (rr *recordReader) stop() {
+	rr.stopped = true
+}
+
+// rewind returns a reader of the data of r from the start, the recorded data followed
+// by the rest of r.
+func (rr *recordReader) rewind() io.Reader {
+	buf := rr.buf
+	rr.buf = nil
+	return io.MultiReader(bytes.NewReader(buf), rr.r)
+}
+
+// imageContainer stores the payload in the pixels of an image in the png layout, without
+// any header, see EncryptToImage. The image is a square unless the shape is given, its
+// width is recorded by newWriter.
+type imageContainer struct {
+	shape *imageShape
+	width int64
+}
+
+func (*imageContainer) Name() string { return "image" }
+
+func (*imageContainer) Ext() string { return "" }
+
+func (c *imageContainer) Capacity() int64 {
+	return c.shape.capacity()
+}
+
+func (c *imageContainer) newWriter(w io.Writer, size int64, rnd io.Reader) (io.WriteCloser, error) {
+	if size > c.Capacity() {
+		return nil, fmt.Errorf("%d bytes do not fit in an image, the maximum is about %d bytes", size, c.Capacity())
+	}
+	width, height := c.shape.size(size)
+	c.width = width
+	return &fillWriter{w: w, size: 4 * width * height, rnd: rnd}, nil
+}
+
+func (*imageContainer) match(head []byte) bool { return false }
+
+func (*imageContainer) newReader(r io.Reader) (io.Reader, error) { return r, nil }
+
+// EncryptToImage encrypts the data read from src to the recipients using the cipher c and
+// returns the image holding it, see Encrypter.EncryptToImage.
+func EncryptToImage(src io.Reader, recipients []Recipient, c Cipher) (*image.NRGBA, error) {
+	e, err := NewEncrypter(EncryptOptions{Recipients: recipients, Cipher: c})
+	if err != nil {
+		return nil, err
+	}
+	return e.EncryptToImage(src)
+}
+
+// EncryptToImage encrypts the data read from src into the pixels of a new image, the same
+// ones of a png image written with the PNG container. The image can be saved in any
+// lossless format keeping the alpha channel, see DecryptFromImage. The data must fit in a
+// single image, about 4 GiB unless limited by the Dimensions, and it is kept in memory.
+// The options about files and the covers are ignored.
+func (e *Encrypter) EncryptToImage(src io.Reader) (*image.NRGBA, error) {
+	c := &imageContainer{}
+	if e.opts.Dimensions != (Dimensions{}) {
+		shape, err := newImageShape(e.opts.Dimensions, pngMaxWidth)
+		if err != nil {
+			return nil, err
+		}
+		c.shape = shape
+	}
+	var buf bytes.Buffer
+	w, err := e.newWriter(&buf, c)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.spool.close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	width := int(c.width)
+	height := buf.Len() / (4 * width)
+	return &image.NRGBA{Pix: buf.Bytes(), Stride: 4 * width, Rect: image.Rect(0, 0, width, height)}, nil
+}
+
+// DecryptFromImage returns a reader of the data decrypted from the pixels of img, see
+// Decrypter.DecryptFromImage.
+func DecryptFromImage(img image.Image, ids []Identity) (io.ReadCloser, error) {
+	d, err := NewDecrypter(DecryptOptions{Identities: ids})
+	if err != nil {
+		return nil, err
+	}
+	return d.DecryptFromImage(img)
+}
+
+// DecryptFromImage returns a reader of the data decrypted from the pixels of img, which can
+// be returned by EncryptToImage or decoded from an image written by EncryptFile, in its
+// format or in any other lossless one keeping the alpha channel. It is read as NewReader
+// reads a file.
+func (d *Decrypter) DecryptFromImage(img image.Image) (io.ReadCloser, error) {
+	data, err := imageData(img, d.opts.Identities)
+	if err != nil {
+		return nil, err
+	}
+	p, err := unlockPayload(data, d.opts.Identities, d.opts.KDFLimits)
+	if err != nil {
+		return nil, err
+	}
+	return p.readCloser()
+}
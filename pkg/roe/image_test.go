@@ -0,0 +1,165 @@
+package roe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func Test_encryptToImageAndDecryptFromImage(t *testing.T) {
+	recipients := []Recipient{NewPasswordRecipient("foobar", testKDFParams)}
+	ids := []Identity{NewPasswordIdentity("foobar")}
+
+	for _, size := range []int{0, 1, chunkSize + 1} {
+		cleartext := make([]byte, size)
+		rand.Read(cleartext)
+
+		img, err := EncryptToImage(bytes.NewReader(cleartext), recipients, DefaultCipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != b.Dy() || len(img.Pix) != 4*b.Dx()*b.Dy() {
+			t.Errorf("%d bytes: unexpected image %v, %d bytes", size, b, len(img.Pix))
+		}
+
+		// the image can be moved, only its pixels matter
+		moved := image.NewNRGBA(img.Bounds().Add(image.Pt(10, -7)))
+		draw.Draw(moved, moved.Bounds(), img, img.Bounds().Min, draw.Src)
+
+		for _, m := range []image.Image{img, moved} {
+			r, err := DecryptFromImage(m, ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(cleartext, out) {
+				t.Errorf("%d bytes: the decrypted data differs", size)
+			}
+		}
+	}
+
+	// an image without the alpha channel is not lossless
+	img, _ := EncryptToImage(bytes.NewReader([]byte("roe")), recipients, DefaultCipher)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	if _, err := DecryptFromImage(img, ids); !errors.Is(err, ErrNotRoeImage) {
+		t.Errorf("expected %v, got %v", ErrNotRoeImage, err)
+	}
+}
+
+// bmpPixels returns the image of the pixels of a bmp file written by encrypt, as a
+// converter keeping the alpha channel reads it.
+func bmpPixels(t *testing.T, fp string) *image.NRGBA {
+	buf, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h bmpHeader
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h)
+	w, ht := int(h.PixelWidth), int(h.PixelHeight)
+	img := image.NewNRGBA(image.Rect(0, 0, w, ht))
+	data := buf[h.BitmapOffset:]
+	for y := 0; y < ht; y++ {
+		row := data[4*w*(ht-1-y):]
+		for x := 0; x < w; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			p[0], p[1], p[2], p[3] = row[4*x+2], row[4*x+1], row[4*x], row[4*x+3]
+		}
+	}
+	return img
+}
+
+func Test_decryptConvertedImages(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "testfile")
+	clearbuf := createRandomFile(cleanpath, 3*chunkSize)
+
+	encrypt := func(c Container) string {
+		e, err := NewEncrypter(EncryptOptions{
+			Recipients: []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+			Split:      chunkSize,
+			Container:  c,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encdir := filepath.Join(tmpdir, "enc-"+c.Name())
+		if err := e.EncryptFile(context.Background(), cleanpath, encdir, nil); err != nil {
+			t.Fatal(err)
+		}
+		return encdir
+	}
+	decrypt := func(fp string) error {
+		decdir := filepath.Join(tmpdir, "dec")
+		os.RemoveAll(decdir)
+		os.MkdirAll(decdir, os.ModePerm)
+		if err := decryptFile(fp, decdir, "foobar"); err != nil {
+			return err
+		}
+		decbuf, _ := ioutil.ReadFile(filepath.Join(decdir, "testfile"))
+		if !bytes.Equal(clearbuf, decbuf) {
+			t.Errorf("%s: decrypted file and original file differs", fp)
+		}
+		return nil
+	}
+
+	// bmp images saved as png, with filters and compression
+	bmpdir := encrypt(BMP)
+	for i := 0; i < 3; i++ {
+		fp := filepath.Join(bmpdir, encryptedFilename("testfile", i, 3, ".bmp"))
+		f, _ := os.Create(strings.TrimSuffix(fp, ".bmp") + ".png")
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := enc.Encode(f, bmpPixels(t, fp)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		os.Remove(fp)
+	}
+	if err := decrypt(filepath.Join(bmpdir, "testfile.2-3.png")); err != nil {
+		t.Errorf("bmp to png: %v", err)
+	}
+
+	// png images saved as tiff
+	pngdir := encrypt(PNG)
+	for i := 0; i < 3; i++ {
+		fp := filepath.Join(pngdir, encryptedFilename("testfile", i, 3, ".png"))
+		buf, _ := ioutil.ReadFile(fp)
+		img, err := png.Decode(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, _ := os.Create(strings.TrimSuffix(fp, ".png") + ".tiff")
+		if err := tiff.Encode(f, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true}); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		os.Remove(fp)
+	}
+	if err := decrypt(filepath.Join(pngdir, "testfile.1-3.tiff")); err != nil {
+		t.Errorf("png to tiff: %v", err)
+	}
+
+	// the wrong password is not mistaken for a foreign image
+	if err := decryptFile(filepath.Join(pngdir, "testfile.1-3.tiff"), tmpdir, "bad"); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("expected %v, got %v", ErrWrongKey, err)
+	}
+}
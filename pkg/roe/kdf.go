@@ -0,0 +1,559 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDF identifies a password-based key derivation function.
+type KDF uint8
+
+// Supported key derivation functions. The values are stored in the payload header.
+const (
+	Argon2id KDF = 2
+	Scrypt   KDF = 3
+)
+
+func (k KDF) String() string {
+	switch k {
+	case Argon2id:
+		return "argon2id"
+	case Scrypt:
+		return "scrypt"
+	}
+	return fmt.Sprintf("kdf(%d)", uint8(k))
+}
+
+// KDFParams describes the algorithm and the cost parameters used to derive
+// a key from a password. Time, Memory and Threads are used by Argon2id,
+// N, R and P are used by Scrypt.
+type KDFParams struct {
+	Algorithm KDF
+
+	Time    uint32 // number of passes over the memory
+	Memory  uint32 // memory in KiB
+	Threads uint8  // degree of parallelism
+
+	N uint32 // CPU/memory cost, must be a power of 2
+	R uint32 // block size
+	P uint32 // parallelization
+}
+
+// DefaultKDFParams are the parameters used when none are specified.
+var DefaultKDFParams = KDFParams{
+	Algorithm: Argon2id,
+	Time:      3,
+	Memory:    64 * 1024,
+	Threads:   4,
+}
+
+// DefaultScryptParams are the parameters used when Scrypt is selected
+// without specifying its costs.
+var DefaultScryptParams = KDFParams{
+	Algorithm: Scrypt,
+	N:         1 << 15,
+	R:         8,
+	P:         1,
+}
+
+// upper bounds of the cost parameters, they protect decrypt from images
+// crafted to exhaust the memory or the cpu
+const (
+	maxArgon2Time   = 64
+	maxArgon2Memory = 4 * 1024 * 1024
+	maxScryptN      = 1 << 24
+	maxScryptRP     = 1 << 20
+)
+
+// KDFLimits bounds the cost of the key derivations done to open the password slots of an
+// image. Their parameters are read from the image before it can be authenticated, so an
+// image could be crafted to exhaust the memory or the cpu of the decryption.
+type KDFLimits struct {
+	Memory uint32 // memory in KiB of a derivation, 128*N*r bytes for scrypt
+	Time   uint32 // number of passes over the memory for argon2id, parallelization for scrypt
+	Slots  int    // number of password slots tried on an image
+}
+
+// DefaultKDFLimits are the limits used by decryption when none are specified, well above
+// the costs of DefaultKDFParams and DefaultScryptParams.
+var DefaultKDFLimits = KDFLimits{
+	Memory: 1024 * 1024,
+	Time:   16,
+	Slots:  maxPasswordSlots,
+}
+
+// withDefaults returns l with the zero fields set to the ones of DefaultKDFLimits.
+func (l KDFLimits) withDefaults() KDFLimits {
+	if l.Memory == 0 {
+		l.Memory = DefaultKDFLimits.Memory
+	}
+	if l.Time == 0 {
+		l.Time = DefaultKDFLimits.Time
+	}
+	if l.Slots == 0 {
+		l.Slots = DefaultKDFLimits.Slots
+	}
+	return l
+}
+
+// check returns an error when deriving a key with the parameters p exceeds the limits.
+func (l KDFLimits) check(p KDFParams) error {
+	memory, time := uint64(p.Memory), uint64(p.Time)
+	if p.Algorithm == Scrypt {
+		memory, time = uint64(p.N)*uint64(p.R)/8, uint64(p.P)
+	}
+	if memory > uint64(l.Memory) {
+		return fmt.Errorf("the password slot needs %d KiB of memory, more than the limit of %d KiB", memory, l.Memory)
+	}
+	if time > uint64(l.Time) {
+		return fmt.Errorf("the password slot needs a time cost of %d, more than the limit of %d", time, l.Time)
+	}
+	return nil
+}
+
+// saltSize is the size in bytes of the random salt stored in the payload header
+const saltSize = 16
+
+// Validate returns an error when the parameters are not usable.
+func (p KDFParams) Validate() error {
+	switch p.Algorithm {
+	case Argon2id:
+		if p.Time < 1 || p.Time > maxArgon2Time {
+			return fmt.Errorf("argon2id time must be between 1 and %d", maxArgon2Time)
+		}
+		if p.Threads < 1 {
+			return fmt.Errorf("argon2id threads cannot be 0")
+		}
+		if p.Memory < 8*uint32(p.Threads) || p.Memory > maxArgon2Memory {
+			return fmt.Errorf("argon2id memory must be between %d and %d KiB", 8*uint32(p.Threads), maxArgon2Memory)
+		}
+	case Scrypt:
+		if p.N < 2 || p.N > maxScryptN || p.N&(p.N-1) != 0 {
+			return fmt.Errorf("scrypt N must be a power of 2 between 2 and %d", maxScryptN)
+		}
+		if p.R < 1 || p.P < 1 || uint64(p.R)*uint64(p.P) >= maxScryptRP {
+			return fmt.Errorf("scrypt r*p must be between 1 and %d", maxScryptRP)
+		}
+	default:
+		return fmt.Errorf("unsupported key derivation function %d", uint8(p.Algorithm))
+	}
+	return nil
+}
+
+// String returns the parameters in the format accepted by ParseKDFParams.
+func (p KDFParams) String() string {
+	if p.Algorithm == Scrypt {
+		return fmt.Sprintf("%s,n=%d,r=%d,p=%d", p.Algorithm, p.N, p.R, p.P)
+	}
+	return fmt.Sprintf("%s,t=%d,m=%d,p=%d", p.Algorithm, p.Time, p.Memory, p.Threads)
+}
+
+// ParseKDFParams parses a string like "argon2id,t=3,m=65536,p=4" or "scrypt,n=32768,r=8,p=1".
+// Parameters that are not specified get their default value,
+// for e.g. "scrypt" alone is equivalent to DefaultScryptParams.
+func ParseKDFParams(s string) (KDFParams, error) {
+	parts := strings.Split(s, ",")
+
+	var p KDFParams
+	switch strings.ToLower(strings.TrimSpace(parts[0])) {
+	case "argon2id":
+		p = DefaultKDFParams
+	case "scrypt":
+		p = DefaultScryptParams
+	default:
+		return p, fmt.Errorf("unknown key derivation function '%s'", parts[0])
+	}
+
+	for _, kv := range parts[1:] {
+		pair := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(pair) != 2 {
+			return p, fmt.Errorf("invalid parameter '%s'", kv)
+		}
+		n, err := strconv.ParseUint(pair[1], 10, 32)
+		if err != nil {
+			return p, fmt.Errorf("invalid value of parameter '%s': %v", pair[0], err)
+		}
+
+		switch {
+		case p.Algorithm == Argon2id && pair[0] == "t":
+			p.Time = uint32(n)
+		case p.Algorithm == Argon2id && pair[0] == "m":
+			p.Memory = uint32(n)
+		case p.Algorithm == Argon2id && pair[0] == "p" && n <= 255:
+			p.Threads = uint8(n)
+		case p.Algorithm == Scrypt && pair[0] == "n":
+			p.N = uint32(n)
+		case p.Algorithm == Scrypt && pair[0] == "r":
+			p.R = uint32(n)
+		case p.Algorithm == Scrypt && pair[0] == "p":
+			p.P = uint32(n)
+		default:
+			return p, fmt.Errorf("invalid parameter '%s' for %s", kv, p.Algorithm)
+		}
+	}
+
+	return p, p.Validate()
+}
+
+// kdfParams holds the salt and the cost parameters used to derive a key from
+// a password, as stored in the password stanzas. Their meaning depends on the kdf
+// (see newKDFHeader).
+type kdfParams struct {
+	Salt [saltSize]byte
+	P1   uint32
+	P2   uint32
+	P3   uint32
+}
+
+// newKDFHeader returns the kdf fields of a password stanza with a new random salt.
+func newKDFHeader(p KDFParams) (kdfParams, error) {
+	var h kdfParams
+
+	if err := p.Validate(); err != nil {
+		return h, err
+	}
+	if _, err := rand.Read(h.Salt[:]); err != nil {
+		return h, err
+	}
+
+	switch p.Algorithm {
+	case Argon2id:
+		h.P1, h.P2, h.P3 = p.Time, p.Memory, uint32(p.Threads)
+	case Scrypt:
+		h.P1, h.P2, h.P3 = p.N, p.R, p.P
+	}
+	return h, nil
+}
+
+// kdfParamsFromHeader is the inverse of newKDFHeader.
+func kdfParamsFromHeader(kdf uint8, h kdfParams) (KDFParams, error) {
+	p := KDFParams{Algorithm: KDF(kdf)}
+
+	switch p.Algorithm {
+	case Argon2id:
+		if h.P3 > 255 {
+			return p, fmt.Errorf("argon2id threads cannot be greater than 255")
+		}
+		p.Time, p.Memory, p.Threads = h.P1, h.P2, uint8(h.P3)
+	case Scrypt:
+		p.N, p.R, p.P = h.P1, h.P2, h.P3
+	}
+
+	return p, p.Validate()
+}
+
+// deriveKey derives a 256 bits key from the password using the kdf, the parameters and the salt.
+func deriveKey(password []byte, kdf uint8, h kdfParams) ([]byte, error) {
+	p, err := kdfParamsFromHeader(kdf, h)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.Algorithm {
+	case Argon2id:
+		return argon2.IDKey(password, h.Salt[:], p.Time, p.Memory, p.Threads, 32), nil
+	case Scrypt:
+		return scrypt.Key(password, h.Salt[:], int(p.N), int(p.R), int(p.P), 32)
+	}
+	return nil, fmt.Errorf("unsupported key derivation function %d", kdf)
+}
+
+// stanzaPassword is the type of the stanzas wrapping the file key with a password,
+// a keyfile or both
+const stanzaPassword uint8 = 4
+
+// factors of a password stanza, the secrets mixed into the key derivation
+const (
+	factorPassword uint8 = 1 << 0
+	factorKeyfile  uint8 = 1 << 1
+)
+
+// passwordStanzaSize is the size of the body of a password stanza:
+// kdf (1 byte), factors (1 byte), kdfParams and the wrapped file key
+var passwordStanzaSize = 2 + binary.Size(kdfParams{}) + wrappedKeySize
+
+// errWrongPassword is returned when none of the password slots can be opened
+var errWrongPassword = newError(ErrWrongKey, "wrong password")
+
+// errWrongKeyfile is returned when none of the slots needing a keyfile can be opened
+var errWrongKeyfile = newError(ErrWrongKey, "wrong password or keyfile")
+
+// secret returns the input of the kdf: the password followed by the sha256 of
+// the keyfile, when there is one. The digest has a fixed size so the two parts
+// cannot be confused. It also returns the factors of the secret.
+func secret(password string, keyfile []byte) ([]byte, uint8) {
+	var factors uint8
+	buf := []byte(password)
+	if len(password) > 0 {
+		factors |= factorPassword
+	}
+	if keyfile != nil {
+		h := sha256.Sum256(keyfile)
+		buf = append(buf, h[:]...)
+		factors |= factorKeyfile
+	}
+	return buf, factors
+}
+
+func describeFactors(factors uint8) string {
+	switch factors {
+	case factorPassword:
+		return "a password"
+	case factorKeyfile:
+		return "a keyfile"
+	case factorPassword | factorKeyfile:
+		return "a password and a keyfile"
+	}
+	return fmt.Sprintf("unknown factors %#x", factors)
+}
+
+type passwordRecipient struct {
+	secret  []byte
+	factors uint8
+	params  KDFParams
+}
+
+// NewPasswordRecipient returns a Recipient wrapping the file key with a key derived
+// from the password using params and a random salt. Every file encrypted to it gets
+// its own password slot, see AddSlot.
+func NewPasswordRecipient(password string, params KDFParams) Recipient {
+	return NewKeyfileRecipient(password, nil, params)
+}
+
+// NewKeyfileRecipient is like NewPasswordRecipient, but the content of a keyfile is mixed
+// into the key derivation along with the password. The password can be empty to use the
+// keyfile alone.
+func NewKeyfileRecipient(password string, keyfile []byte, params KDFParams) Recipient {
+	s, factors := secret(password, keyfile)
+	return &passwordRecipient{secret: s, factors: factors, params: params}
+}
+
+func (r *passwordRecipient) wrap(fileKey []byte) (stanza, error) {
+	if r.factors == 0 {
+		return stanza{}, fmt.Errorf("empty password")
+	}
+	kdf, err := newKDFHeader(r.params)
+	if err != nil {
+		return stanza{}, err
+	}
+	key, err := deriveKey(r.secret, uint8(r.params.Algorithm), kdf)
+	if err != nil {
+		return stanza{}, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return stanza{}, err
+	}
+
+	body := bytes.NewBuffer(make([]byte, 0, passwordStanzaSize))
+	body.WriteByte(uint8(r.params.Algorithm))
+	body.WriteByte(r.factors)
+	binary.Write(body, binary.LittleEndian, kdf)
+
+	// the salt is random, so the key and the zero nonce are never reused
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return stanza{Type: stanzaPassword, Body: aead.Seal(body.Bytes(), nonce, fileKey, nil)}, nil
+}
+
+// passwordIdentity unwraps the file keys wrapped by a passwordRecipient.
+// Keys are cached by salt, since all the parts of a splitted file share the same slots
+// and deriving a key is expensive on purpose. The cache is shared by the goroutines
+// decrypting with the identity.
+type passwordIdentity struct {
+	secret  []byte
+	factors uint8
+	mu      sync.Mutex
+	cache   map[string]*derivedKey
+}
+
+// derivedKey is a key of the cache of passwordIdentity, done is closed when the key, or
+// the error, is set.
+type derivedKey struct {
+	done chan struct{}
+	key  []byte
+	err  error
+}
+
+// NewPasswordIdentity returns an Identity able to open the password slots
+// created with the same password by NewPasswordRecipient.
+func NewPasswordIdentity(password string) Identity {
+	return NewKeyfileIdentity(password, nil)
+}
+
+// NewKeyfileIdentity returns an Identity able to open the slots created with
+// the same password and keyfile by NewKeyfileRecipient.
+func NewKeyfileIdentity(password string, keyfile []byte) Identity {
+	s, factors := secret(password, keyfile)
+	return &passwordIdentity{
+		secret:  s,
+		factors: factors,
+		cache:   make(map[string]*derivedKey),
+	}
+}
+
+func (i *passwordIdentity) unwrap(s stanza) ([]byte, error) {
+	if s.Type != stanzaPassword || len(s.Body) != passwordStanzaSize || s.Body[1] != i.factors {
+		return nil, errNoMatch
+	}
+
+	params := s.Body[:passwordStanzaSize-wrappedKeySize]
+	key, err := i.key(params)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	fileKey, err := aead.Open(nil, nonce, s.Body[len(params):], nil)
+	if err != nil {
+		return nil, errNoMatch
+	}
+	return fileKey, nil
+}
+
+// key returns the key derived with the kdf params of a stanza, from the cache when possible.
+// The lock is held only to look up the cache: the keys of different params are derived
+// concurrently, while the goroutines asking for a key being derived wait for it, so that a
+// key is derived only once.
+func (i *passwordIdentity) key(params []byte) ([]byte, error) {
+	i.mu.Lock()
+	dk, ok := i.cache[string(params)]
+	if !ok {
+		dk = &derivedKey{done: make(chan struct{})}
+		i.cache[string(params)] = dk
+	}
+	i.mu.Unlock()
+	if ok {
+		<-dk.done
+		return dk.key, dk.err
+	}
+
+	var kdf kdfParams
+	binary.Read(bytes.NewReader(params[2:]), binary.LittleEndian, &kdf)
+	dk.key, dk.err = deriveKey(i.secret, params[0], kdf)
+	close(dk.done)
+	return dk.key, dk.err
+}
+
+// coverKDFParams derive the masks of the password slots of the covers, see coverEnvelope.
+// They are fixed, since the parameters are not stored in the covers: each identity costs
+// a key derivation for each cover opened, not limited by KDFLimits.
+var coverKDFParams = KDFParams{Algorithm: Argon2id, Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// coverKDFHeader returns the kdf fields of a cover slot, the salt is the seed of the cover.
+func coverKDFHeader(factors uint8, seed []byte) []byte {
+	h := kdfParams{P1: coverKDFParams.Time, P2: coverKDFParams.Memory, P3: uint32(coverKDFParams.Threads)}
+	copy(h.Salt[:], seed)
+	buf := bytes.NewBuffer([]byte{uint8(coverKDFParams.Algorithm), factors})
+	binary.Write(buf, binary.LittleEndian, h)
+	return buf.Bytes()
+}
+
+func (r *passwordRecipient) coverMask(seed []byte) ([]byte, error) {
+	if r.factors == 0 {
+		return nil, fmt.Errorf("empty password")
+	}
+	params := coverKDFHeader(r.factors, seed)
+	var kdf kdfParams
+	binary.Read(bytes.NewReader(params[2:]), binary.LittleEndian, &kdf)
+	key, err := deriveKey(r.secret, params[0], kdf)
+	if err != nil {
+		return nil, err
+	}
+	return deriveCoverMask(key, seed)
+}
+
+// coverMask derives the key as for a password slot, so that the key of a cover opened
+// more than once is derived once.
+func (i *passwordIdentity) coverMask(seed []byte) ([]byte, error) {
+	if i.factors == 0 {
+		return nil, errNoMatch
+	}
+	key, err := i.key(coverKDFHeader(i.factors, seed))
+	if err != nil {
+		return nil, err
+	}
+	return deriveCoverMask(key, seed)
+}
+
+// checkPasswordSlots returns an error when opening the password slots of h with ids may
+// exceed the limits: too many slots, or the costs of one of them.
+func checkPasswordSlots(h payloadHeader, ids []Identity, limits KDFLimits) error {
+	password := false
+	for _, id := range ids {
+		if _, ok := id.(*passwordIdentity); ok {
+			password = true
+		}
+	}
+	if !password {
+		return nil
+	}
+
+	if n := countStanzas(h.Stanzas, stanzaPassword); n > limits.Slots {
+		return newError(ErrCorrupted, "the image has %d password slots, the maximum is %d", n, limits.Slots)
+	}
+	for _, s := range h.Stanzas {
+		if s.Type != stanzaPassword || len(s.Body) != passwordStanzaSize {
+			continue
+		}
+		var kdf kdfParams
+		binary.Read(bytes.NewReader(s.Body[2:]), binary.LittleEndian, &kdf)
+		p, err := kdfParamsFromHeader(s.Body[0], kdf)
+		if err != nil {
+			// not derived, deriveKey fails with the same error
+			continue
+		}
+		if err := limits.check(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrongPasswordError explains why none of the password slots of h can be opened with ids,
+// it returns nil when ids are not all password identities or h has no password slots.
+func wrongPasswordError(h payloadHeader, ids []Identity) error {
+	var factors []uint8
+	for _, id := range ids {
+		p, ok := id.(*passwordIdentity)
+		if !ok {
+			return nil
+		}
+		factors = append(factors, p.factors)
+	}
+
+	var needed uint8
+	for _, s := range h.Stanzas {
+		if s.Type != stanzaPassword || len(s.Body) != passwordStanzaSize {
+			continue
+		}
+		needed = s.Body[1]
+		for _, f := range factors {
+			if f != needed {
+				continue
+			}
+			if f&factorKeyfile != 0 {
+				return errWrongKeyfile
+			}
+			return errWrongPassword
+		}
+	}
+
+	if needed != 0 {
+		return newError(ErrWrongKey, "the image must be opened with %s", describeFactors(needed))
+	}
+	return nil
+}
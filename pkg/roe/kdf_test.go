@@ -0,0 +1,102 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// encryptWithPasswords encrypts size random bytes with a password slot for each password.
+func encryptWithPasswords(t *testing.T, size int, params KDFParams, passwords ...string) []byte {
+	recipients := make([]Recipient, 0)
+	for _, password := range passwords {
+		recipients = append(recipients, NewPasswordRecipient(password, params))
+	}
+	header, fileKey, err := newPayloadHeader(rand.Reader, recipients, DefaultCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err := encrypt(rand.Reader, io.LimitReader(rand.Reader, int64(size)), buf, BMP, header, fileKey, int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func Test_decryptKDFLimits(t *testing.T) {
+	enc := encryptWithPasswords(t, 100, testKDFParams, "alice", "bob", "carol")
+	scrypt := encryptWithPasswords(t, 100, KDFParams{Algorithm: Scrypt, N: 1 << 10, R: 8, P: 1}, "alice")
+
+	decryptWith := func(enc []byte, limits KDFLimits) error {
+		d, err := NewDecrypter(DecryptOptions{Identities: []Identity{NewPasswordIdentity("carol")}, KDFLimits: limits})
+		if err != nil {
+			return err
+		}
+		r, err := d.NewReader(bytes.NewReader(enc))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(ioutil.Discard, r)
+		return err
+	}
+
+	for _, tc := range []struct {
+		name   string
+		enc    []byte
+		limits KDFLimits
+		err    string
+	}{
+		{"default", enc, KDFLimits{}, ""},
+		{"memory", enc, KDFLimits{Memory: 4}, "needs 8 KiB of memory"},
+		{"time", enc, KDFLimits{Memory: 8, Time: 1}, ""},
+		{"slots", enc, KDFLimits{Slots: 2}, "3 password slots"},
+		{"scrypt memory", scrypt, KDFLimits{Memory: 512}, "needs 1024 KiB of memory"},
+	} {
+		err := decryptWith(tc.enc, tc.limits)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func Test_encryptTooManyPasswords(t *testing.T) {
+	recipients := make([]Recipient, maxPasswordSlots+1)
+	for i := range recipients {
+		recipients[i] = NewPasswordRecipient("foobar", testKDFParams)
+	}
+	if _, _, err := newPayloadHeader(rand.Reader, recipients, DefaultCipher); err == nil {
+		t.Errorf("encrypting with %d passwords should fail", len(recipients))
+	}
+}
+
+func Test_parseKDFParams(t *testing.T) {
+	valid := map[string]KDFParams{
+		"argon2id":                DefaultKDFParams,
+		"scrypt":                  DefaultScryptParams,
+		"argon2id,t=1,m=1024,p=2": {Algorithm: Argon2id, Time: 1, Memory: 1024, Threads: 2},
+		"scrypt,n=1024,r=4,p=2":   {Algorithm: Scrypt, N: 1024, R: 4, P: 2},
+		"Argon2id, m=131072":      {Algorithm: Argon2id, Time: 3, Memory: 131072, Threads: 4},
+	}
+	for s, expected := range valid {
+		p, err := ParseKDFParams(s)
+		if err != nil {
+			t.Errorf("ParseKDFParams(%q) failed: %v", s, err)
+		} else if p != expected {
+			t.Errorf("ParseKDFParams(%q) = %+v, expected %+v", s, p, expected)
+		}
+	}
+
+	invalid := []string{"", "sha256", "argon2id,t=0", "argon2id,n=1024", "scrypt,n=1000", "scrypt,r"}
+	for _, s := range invalid {
+		if _, err := ParseKDFParams(s); err == nil {
+			t.Errorf("ParseKDFParams(%q) should fail", s)
+		}
+	}
+}
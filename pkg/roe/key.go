@@ -0,0 +1,112 @@
+package roe
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// stanzaKey is the type of the stanzas wrapping the file key with raw key material
+const stanzaKey uint8 = 5
+
+const keyInfo = "roe/key"
+
+// minKeySize is the minimum size of the raw key material accepted by NewKeyRecipient
+const minKeySize = 16
+
+// keyStanzaSize is the size of the body of a key stanza: salt and wrapped file key
+const keyStanzaSize = saltSize + wrappedKeySize
+
+// keyRecipient wraps the file key with raw key material, without any key derivation
+// function, for the services already holding high-entropy secrets.
+type keyRecipient struct {
+	key []byte
+}
+
+// NewKeyRecipient returns a Recipient wrapping the file key with the raw key material,
+// that must be at least 16 bytes long and as random as a key. Use NewPasswordRecipient
+// for secrets chosen by humans.
+func NewKeyRecipient(key []byte) (Recipient, error) {
+	if len(key) < minKeySize {
+		return nil, fmt.Errorf("the key must be at least %d bytes long", minKeySize)
+	}
+	return &keyRecipient{key: key}, nil
+}
+
+// keyWrapAEAD returns the cipher wrapping the file key, keyed by the key material and the salt.
+func keyWrapAEAD(key, salt []byte) (cipher.AEAD, error) {
+	wrapKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(keyInfo)), wrapKey); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(wrapKey)
+}
+
+func (r *keyRecipient) wrap(fileKey []byte) (stanza, error) {
+	salt := make([]byte, saltSize, keyStanzaSize)
+	if _, err := rand.Read(salt); err != nil {
+		return stanza{}, err
+	}
+	aead, err := keyWrapAEAD(r.key, salt)
+	if err != nil {
+		return stanza{}, err
+	}
+
+	// the salt is random, so the wrap key and the zero nonce are never reused
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return stanza{Type: stanzaKey, Body: aead.Seal(salt, nonce, fileKey, nil)}, nil
+}
+
+type keyIdentity struct {
+	key []byte
+}
+
+// NewKeyIdentity returns an Identity able to open the slots created by NewKeyRecipient
+// with the same key material.
+func NewKeyIdentity(key []byte) Identity {
+	return &keyIdentity{key: key}
+}
+
+func (i *keyIdentity) unwrap(s stanza) ([]byte, error) {
+	if s.Type != stanzaKey || len(s.Body) != keyStanzaSize {
+		return nil, errNoMatch
+	}
+	aead, err := keyWrapAEAD(i.key, s.Body[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	fileKey, err := aead.Open(nil, nonce, s.Body[saltSize:], nil)
+	if err != nil {
+		return nil, errNoMatch
+	}
+	return fileKey, nil
+}
+
+// coverMask is derived from the key material, as the wrap key.
+func (r *keyRecipient) coverMask(seed []byte) ([]byte, error) {
+	return deriveCoverMask(r.key, seed)
+}
+
+func (i *keyIdentity) coverMask(seed []byte) ([]byte, error) {
+	return deriveCoverMask(i.key, seed)
+}
+
+// KeyFromPassword derives a 256 bits key from the given passphrase, for the functions
+// taking a key like EncryptFile.
+//
+// Deprecated: the key is derived with a fast hash and without salt, use the password
+// slots of NewPasswordRecipient and NewPasswordIdentity instead.
+func KeyFromPassword(p string) []byte {
+	h := sha256.New()
+	h.Write([]byte(p))
+	for i := 0; i < 256; i++ {
+		h.Write(h.Sum(nil))
+	}
+	return h.Sum(nil)
+}
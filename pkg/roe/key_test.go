@@ -0,0 +1,109 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encryptTo encrypts cleartext to the recipients, returning the encrypted image.
+func encryptTo(t *testing.T, cleartext []byte, recipients ...Recipient) []byte {
+	header, fileKey, err := newPayloadHeader(rand.Reader, recipients, DefaultCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := encrypt(rand.Reader, bytes.NewReader(cleartext), buffer, BMP, header, fileKey, int64(len(cleartext))); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func Test_decryptWithKeyfile(t *testing.T) {
+	cleartext := []byte("hello keyfile")
+	keyfile := []byte("the content of a random blob")
+	enc := encryptTo(t, cleartext,
+		NewKeyfileRecipient("", keyfile, testKDFParams),
+		NewKeyfileRecipient("foobar", keyfile, testKDFParams),
+	)
+
+	for _, id := range []Identity{NewKeyfileIdentity("", keyfile), NewKeyfileIdentity("foobar", keyfile)} {
+		out := bytes.NewBuffer(make([]byte, 0))
+		if err := decrypt(bytes.NewReader(enc), out, identities{id}); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(out.Bytes(), cleartext) {
+			t.Errorf("decrypted data differs")
+		}
+	}
+
+	if err := decrypt(bytes.NewReader(enc), ioutil.Discard, identities{NewKeyfileIdentity("foobar", []byte("another blob"))}); err != errWrongKeyfile {
+		t.Errorf("expected %v, got %v", errWrongKeyfile, err)
+	}
+	if err := decrypt(bytes.NewReader(enc), ioutil.Discard, identities{NewPasswordIdentity("foobar")}); err == nil || err == errWrongPassword {
+		t.Errorf("expected an error asking for the keyfile, got %v", err)
+	}
+}
+
+func Test_decryptWithKey(t *testing.T) {
+	if _, err := NewKeyRecipient([]byte("short")); err == nil {
+		t.Errorf("short keys should be rejected")
+	}
+
+	key := bytes.Repeat([]byte{42}, 32)
+	r, err := NewKeyRecipient(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleartext := []byte("hello key")
+	enc := encryptTo(t, cleartext, r)
+
+	out := bytes.NewBuffer(make([]byte, 0))
+	if err := decrypt(bytes.NewReader(enc), out, identities{NewKeyIdentity(key)}); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(out.Bytes(), cleartext) {
+		t.Errorf("decrypted data differs")
+	}
+
+	if err := decrypt(bytes.NewReader(enc), ioutil.Discard, identities{NewKeyIdentity(bytes.Repeat([]byte{43}, 32))}); err != errNoMatch {
+		t.Errorf("expected %v, got %v", errNoMatch, err)
+	}
+}
+
+func Test_encryptFileWithKey(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	srcdir := filepath.Join(tmpdir, "src")
+	os.MkdirAll(filepath.Join(srcdir, "sub"), os.ModePerm)
+	createRandomFile(filepath.Join(srcdir, "a.bin"), 2500)
+	createRandomFile(filepath.Join(srcdir, "sub", "b.bin"), 500)
+
+	key := KeyFromPassword("foobar")
+	if len(key) != 32 || !bytes.Equal(key, KeyFromPassword("foobar")) {
+		t.Fatalf("unexpected key %x", key)
+	}
+	if err := EncryptFile(filepath.Join(srcdir, "a.bin"), tmpdir, key, 0); err == nil {
+		t.Errorf("a split of 0 should be rejected")
+	}
+
+	encdir := filepath.Join(tmpdir, "enc")
+	if err := EncryptDir(srcdir, encdir, key, 1000); err != nil {
+		t.Fatal(err)
+	}
+	decdir := filepath.Join(tmpdir, "dec")
+	if err := DecryptDir(encdir, decdir, key); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.bin", filepath.Join("sub", "b.bin")} {
+		if !sameContent(t, filepath.Join(srcdir, name), filepath.Join(decdir, name)) {
+			t.Errorf("decrypted file and original file %s differs", name)
+		}
+	}
+	if err := DecryptFile(filepath.Join(encdir, "a.bin.2-3.bmp"), tmpdir, KeyFromPassword("bad")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("expected %v, got %v", ErrWrongKey, err)
+	}
+}
@@ -0,0 +1,146 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_newPayloadBmpHeader(t *testing.T) {
+	for _, size := range []int64{0, 1, 1 << 31, maxBmpDataSize - 4*math.MaxUint16} {
+		h, err := newPayloadBmpHeader(nil, size)
+		if err != nil {
+			t.Errorf("%d bytes should fit in a bmp image: %v", size, err)
+		} else if int64(h.ImageSize) < size || int64(h.FileSize) != int64(h.ImageSize)+bmpHeaderSize {
+			t.Errorf("invalid header for %d bytes: %+v", size, h)
+		}
+	}
+	for _, size := range []int64{maxBmpDataSize + 1, 1 << 32, 1 << 40} {
+		if _, err := newPayloadBmpHeader(nil, size); err == nil {
+			t.Errorf("%d bytes should not fit in a bmp image", size)
+		}
+	}
+}
+
+// createSparseFile creates a file of the given size, filled with zeros except for
+// a few marks around the 32 bits boundaries, without allocating the disk space.
+func createSparseFile(t *testing.T, fp string, size int64) {
+	f, err := os.Create(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{0, 1<<31 - 1, 1 << 32, size - 1} {
+		if _, err := f.WriteAt([]byte{0xaa}, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_encryptTooLargePart(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	// 5 GiB cannot fit in a single image
+	cleanpath := filepath.Join(tmpdir, "large")
+	createSparseFile(t, cleanpath, 5<<30)
+	f, _ := os.Open(cleanpath)
+	defer f.Close()
+
+	header, fileKey, err := newPayloadHeader(rand.Reader, []Recipient{NewPasswordRecipient("foobar", testKDFParams)}, DefaultCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := encrypt(rand.Reader, f, buffer, BMP, header, fileKey, 5<<30); err == nil {
+		t.Errorf("encrypting 5 GiB in a single image should fail")
+	}
+	if buffer.Len() != 0 {
+		t.Errorf("nothing should be written when the payload does not fit, %d bytes written", buffer.Len())
+	}
+
+	if err := encryptFile(cleanpath, tmpdir, "foobar", EncryptOptions{Split: MaxSplit + 1}); err == nil {
+		t.Errorf("a split larger than MaxSplit should be rejected")
+	}
+}
+
+func Test_encryptFileLargerThan4GiB(t *testing.T) {
+	// about 10 GiB of disk are needed
+	if os.Getenv("ROE_LARGE_TESTS") == "" {
+		t.Skip("encrypts 5 GiB, set ROE_LARGE_TESTS to run it")
+	}
+
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	const size = 5 << 30
+	cleanpath := filepath.Join(tmpdir, "large")
+	createSparseFile(t, cleanpath, size)
+	encdir := filepath.Join(tmpdir, "enc")
+	decdir := filepath.Join(tmpdir, "dec")
+	os.MkdirAll(decdir, os.ModePerm)
+
+	if err := encryptFile(cleanpath, encdir, "foobar", EncryptOptions{Split: MaxSplit}); err != nil {
+		t.Fatal(err)
+	}
+
+	// every image must be a valid bmp whose size matches its header
+	for _, name := range []string{"large.1-2.bmp", "large.2-2.bmp"} {
+		fp := filepath.Join(encdir, name)
+		f, err := os.Open(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h bmpHeader
+		binary.Read(f, binary.LittleEndian, &h)
+		f.Close()
+		if fi, _ := os.Stat(fp); int64(h.FileSize) != fi.Size() {
+			t.Errorf("%s: the header says %d bytes, the file has %d", name, h.FileSize, fi.Size())
+		}
+	}
+
+	if err := decryptFile(filepath.Join(encdir, "large.1-2.bmp"), decdir, "foobar"); err != nil {
+		t.Fatal(err)
+	}
+	// remove the images to save space
+	os.RemoveAll(encdir)
+
+	if !sameContent(t, cleanpath, filepath.Join(decdir, "large")) {
+		t.Errorf("decrypted file and original file differs")
+	}
+}
+
+func sameContent(t *testing.T, fp1, fp2 string) bool {
+	f1, err := os.Open(fp1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.Open(fp2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	b1 := make([]byte, 1<<20)
+	b2 := make([]byte, 1<<20)
+	for {
+		n1, err1 := io.ReadFull(f1, b1)
+		n2, err2 := io.ReadFull(f2, b2)
+		if n1 != n2 || !bytes.Equal(b1[:n1], b2[:n2]) {
+			return false
+		}
+		if err1 != nil || err2 != nil {
+			return err1 == err2
+		}
+	}
+}
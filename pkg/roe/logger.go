@@ -0,0 +1,39 @@
+package roe
+
+import "sync/atomic"
+
+// Logger receives the messages describing what roe is doing, for e.g. the name of
+// each image written. A *log.Logger is a Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// nopLogger discards every message, it is the default logger.
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
+// loggerBox wraps the logger, an atomic.Value must always store the same concrete type.
+type loggerBox struct {
+	Logger
+}
+
+var logger atomic.Value
+
+func init() {
+	logger.Store(loggerBox{nopLogger{}})
+}
+
+// SetLogger sets the logger of the package, nil discards the messages, which is the default.
+// It is safe to call it while files are being encrypted or decrypted.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger.Store(loggerBox{l})
+}
+
+// logf sends a message to the logger of the package.
+func logf(format string, v ...interface{}) {
+	logger.Load().(loggerBox).Printf(format, v...)
+}
@@ -0,0 +1,45 @@
+package roe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// messages collects the messages sent to a Logger.
+type messages []string
+
+func (m *messages) Printf(format string, v ...interface{}) {
+	*m = append(*m, fmt.Sprintf(format, v...))
+}
+
+func Test_decryptDirSkipsOtherFiles(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	var log messages
+	SetLogger(&log)
+	defer SetLogger(nil)
+
+	encdir := filepath.Join(tmpdir, "enc")
+	cleanpath := filepath.Join(tmpdir, "clean.bin")
+	createRandomFile(cleanpath, 100)
+	if err := encryptFile(cleanpath, encdir, "foobar", EncryptOptions{Split: MaxSplit}); err != nil {
+		t.Fatal(err)
+	}
+	createRandomFile(filepath.Join(encdir, "notes.txt"), 100)
+
+	decdir := filepath.Join(tmpdir, "dec")
+	if err := decryptDir(encdir, decdir, "foobar"); err != nil {
+		t.Fatal(err)
+	}
+	if !sameContent(t, cleanpath, filepath.Join(decdir, "clean.bin")) {
+		t.Errorf("decrypted file and original file differs")
+	}
+	if len(log) != 3 || !strings.HasPrefix(log[2], "skip ") {
+		t.Errorf("unexpected messages %q", log)
+	}
+}
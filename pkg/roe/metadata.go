@@ -0,0 +1,289 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// maxMetadataSize is the maximum size of the encrypted metadata of a payload header
+const maxMetadataSize = 1 << 20
+
+// types of the records of the metadata
+const (
+	metaName    uint8 = 1
+	metaModTime uint8 = 2
+	metaMode    uint8 = 3
+	metaXattr   uint8 = 4
+	metaSize    uint8 = 5
+)
+
+// Preserve selects the attributes of the original files stored in the images,
+// which are restored on decryption.
+type Preserve uint8
+
+// Attributes that can be preserved.
+const (
+	PreserveModTime Preserve = 1 << iota
+	PreserveMode
+	PreserveXattrs
+
+	PreserveNone Preserve = 0
+	PreserveAll           = PreserveModTime | PreserveMode | PreserveXattrs
+)
+
+var preserveNames = []struct {
+	p    Preserve
+	name string
+}{
+	{PreserveModTime, "mtime"},
+	{PreserveMode, "mode"},
+	{PreserveXattrs, "xattrs"},
+}
+
+// String returns the attributes in the format accepted by ParsePreserve.
+func (p Preserve) String() string {
+	if p == PreserveNone {
+		return "none"
+	}
+	names := make([]string, 0)
+	for _, n := range preserveNames {
+		if p&n.p != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParsePreserve parses a comma separated list of attributes among "mtime", "mode" and
+// "xattrs", or one of the words "all" and "none".
+func ParsePreserve(s string) (Preserve, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "all":
+		return PreserveAll, nil
+	case "none", "":
+		return PreserveNone, nil
+	}
+
+	var p Preserve
+outer:
+	for _, part := range strings.Split(s, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		for _, n := range preserveNames {
+			if part == n.name {
+				p |= n.p
+				continue outer
+			}
+		}
+		return p, fmt.Errorf("unknown attribute '%s'", part)
+	}
+	return p, nil
+}
+
+// xattr is an extended attribute of a file
+type xattr struct {
+	Name  string
+	Value []byte
+}
+
+// metadata describes the original file. It is stored encrypted in the payload header,
+// so that it is shared by all the parts of a splitted file.
+type metadata struct {
+	Name    string
+	Size    int64     // size of the original file, before the compression
+	ModTime time.Time // zero when not preserved
+	Mode    os.FileMode
+	HasMode bool
+	Xattrs  []xattr
+}
+
+// newMetadata returns the metadata of the file fp, keeping the attributes selected by preserve.
+func newMetadata(fp string, preserve Preserve) (metadata, error) {
+	m := metadata{Name: filepath.Base(fp)}
+
+	fi, err := os.Stat(fp)
+	if err != nil {
+		return m, err
+	}
+	m.Size = fi.Size()
+	if preserve&PreserveModTime != 0 {
+		m.ModTime = fi.ModTime()
+	}
+	if preserve&PreserveMode != 0 {
+		m.Mode, m.HasMode = fi.Mode().Perm(), true
+	}
+	if preserve&PreserveXattrs != 0 {
+		if m.Xattrs, err = readXattrs(fp); err != nil {
+			return m, fmt.Errorf("failed to read the extended attributes of '%s': %v", fp, err)
+		}
+	}
+
+	return m, nil
+}
+
+// restore applies the preserved attributes to the decrypted file fp. The modification
+// time is set last, since changing the others may update it.
+func (m metadata) restore(fp string) error {
+	if len(m.Xattrs) > 0 {
+		if err := writeXattrs(fp, m.Xattrs); err != nil {
+			return fmt.Errorf("failed to restore the extended attributes: %v", err)
+		}
+	}
+	if m.HasMode {
+		if err := os.Chmod(fp, m.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if !m.ModTime.IsZero() {
+		if err := os.Chtimes(fp, time.Now(), m.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bytes encodes the metadata as a list of records: type (1 byte), length (4 bytes) and value.
+// Records of unknown types are skipped by parseMetadata, so new ones can be added freely.
+func (m metadata) bytes() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	writeRecord := func(t uint8, value []byte) {
+		buf.WriteByte(t)
+		binary.Write(buf, binary.LittleEndian, uint32(len(value)))
+		buf.Write(value)
+	}
+
+	if m.Name != "" {
+		writeRecord(metaName, []byte(m.Name))
+	}
+	if m.Size > 0 {
+		v := make([]byte, 8)
+		binary.LittleEndian.PutUint64(v, uint64(m.Size))
+		writeRecord(metaSize, v)
+	}
+	if !m.ModTime.IsZero() {
+		v := make([]byte, 8)
+		binary.LittleEndian.PutUint64(v, uint64(m.ModTime.UnixNano()))
+		writeRecord(metaModTime, v)
+	}
+	if m.HasMode {
+		v := make([]byte, 4)
+		binary.LittleEndian.PutUint32(v, uint32(m.Mode.Perm()))
+		writeRecord(metaMode, v)
+	}
+	for _, a := range m.Xattrs {
+		// the name cannot contain zeros, the value can
+		writeRecord(metaXattr, append(append([]byte(a.Name), 0), a.Value...))
+	}
+
+	return buf.Bytes()
+}
+
+func parseMetadata(b []byte) (metadata, error) {
+	var m metadata
+	r := bytes.NewReader(b)
+
+	for r.Len() > 0 {
+		var t uint8
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &t); err != nil {
+			return m, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return m, fmt.Errorf("invalid metadata: %v", err)
+		}
+		if int64(size) > int64(r.Len()) {
+			return m, fmt.Errorf("invalid metadata: record %d is truncated", t)
+		}
+		value := make([]byte, size)
+		r.Read(value)
+
+		switch t {
+		case metaName:
+			m.Name = string(value)
+		case metaSize:
+			if size != 8 || binary.LittleEndian.Uint64(value) > math.MaxInt64 {
+				return m, fmt.Errorf("invalid metadata: invalid size")
+			}
+			m.Size = int64(binary.LittleEndian.Uint64(value))
+		case metaModTime:
+			if size != 8 {
+				return m, fmt.Errorf("invalid metadata: invalid modification time")
+			}
+			m.ModTime = time.Unix(0, int64(binary.LittleEndian.Uint64(value)))
+		case metaMode:
+			if size != 4 {
+				return m, fmt.Errorf("invalid metadata: invalid mode")
+			}
+			m.Mode, m.HasMode = os.FileMode(binary.LittleEndian.Uint32(value)).Perm(), true
+		case metaXattr:
+			i := bytes.IndexByte(value, 0)
+			if i <= 0 {
+				return m, fmt.Errorf("invalid metadata: invalid extended attribute")
+			}
+			m.Xattrs = append(m.Xattrs, xattr{Name: string(value[:i]), Value: value[i+1:]})
+		}
+	}
+
+	return m, nil
+}
+
+// safeName returns the original filename stored in the metadata, or an empty string
+// when there is none or it is not a plain filename: it is chosen by whoever encrypted
+// the file, so it must not be able to point outside of the output folder.
+func (m metadata) safeName() string {
+	name := m.Name
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") || filepath.Base(name) != name {
+		return ""
+	}
+	return name
+}
+
+func metadataAEAD(fileKey []byte) (cipher.AEAD, error) {
+	key, err := subkey(fileKey, "roe/metadata")
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// sealMetadata encrypts m into the header, that is signed again.
+func (h *payloadHeader) sealMetadata(fileKey []byte, m metadata) error {
+	aead, err := metadataAEAD(fileKey)
+	if err != nil {
+		return err
+	}
+
+	// the metadata are encrypted only once with a key derived from the random file key,
+	// so the nonce can be zero
+	nonce := make([]byte, aead.NonceSize())
+	h.Metadata = aead.Seal(nil, nonce, m.bytes(), nil)
+	if len(h.Metadata) > maxMetadataSize {
+		return fmt.Errorf("metadata too large: %d bytes", len(h.Metadata))
+	}
+	return h.sign(fileKey)
+}
+
+// openMetadata decrypts the metadata of the header, which must have been verified.
+func (h payloadHeader) openMetadata(fileKey []byte) (metadata, error) {
+	if len(h.Metadata) == 0 {
+		return metadata{}, nil
+	}
+	aead, err := metadataAEAD(fileKey)
+	if err != nil {
+		return metadata{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	b, err := aead.Open(nil, nonce, h.Metadata, nil)
+	if err != nil {
+		return metadata{}, errHeaderMAC
+	}
+	return parseMetadata(b)
+}
@@ -0,0 +1,98 @@
+package roe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_preserveMetadata(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "script.sh")
+	createRandomFile(cleanpath, 3000)
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	os.Chmod(cleanpath, 0751)
+	os.Chtimes(cleanpath, mtime, mtime)
+	attrs := []xattr{{Name: "user.roe.test", Value: []byte("a\x00b")}}
+	hasXattrs := xattrSupported && writeXattrs(cleanpath, attrs) == nil
+	if a, _ := readXattrs(cleanpath); len(a) == 0 {
+		hasXattrs = false
+	}
+
+	for _, preserve := range []Preserve{PreserveAll, PreserveNone} {
+		encdir := filepath.Join(tmpdir, "enc")
+		decdir := filepath.Join(tmpdir, "dec")
+		os.MkdirAll(decdir, os.ModePerm)
+
+		if err := encryptFile(cleanpath, encdir, "foobar", EncryptOptions{Split: 1000, Preserve: preserve}); err != nil {
+			t.Fatal(err)
+		}
+		if err := decryptFile(filepath.Join(encdir, "script.sh.1-3.bmp"), decdir, "foobar"); err != nil {
+			t.Fatal(err)
+		}
+
+		decpath := filepath.Join(decdir, "script.sh")
+		fi, err := os.Stat(decpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		preserved := preserve == PreserveAll
+		if fi.Mode().Perm() == 0751 != preserved {
+			t.Errorf("preserve %s: unexpected mode %s", preserve, fi.Mode())
+		}
+		if fi.ModTime().Equal(mtime) != preserved {
+			t.Errorf("preserve %s: unexpected modification time %s", preserve, fi.ModTime())
+		}
+		if hasXattrs {
+			a, _ := readXattrs(decpath)
+			if (len(a) == 1 && a[0].Name == attrs[0].Name && bytes.Equal(a[0].Value, attrs[0].Value)) != preserved {
+				t.Errorf("preserve %s: unexpected extended attributes %v", preserve, a)
+			}
+		}
+
+		os.RemoveAll(encdir)
+		os.RemoveAll(decdir)
+	}
+}
+
+func Test_parsePreserve(t *testing.T) {
+	valid := map[string]Preserve{
+		"all":          PreserveAll,
+		"none":         PreserveNone,
+		"mtime":        PreserveModTime,
+		"mode, xattrs": PreserveMode | PreserveXattrs,
+	}
+	for s, expected := range valid {
+		p, err := ParsePreserve(s)
+		if err != nil {
+			t.Errorf("ParsePreserve(%q) failed: %v", s, err)
+		} else if p != expected {
+			t.Errorf("ParsePreserve(%q) = %s, expected %s", s, p, expected)
+		}
+	}
+
+	if _, err := ParsePreserve("mtime,owner"); err == nil {
+		t.Errorf("ParsePreserve should fail on unknown attributes")
+	}
+}
+
+func Test_metadataSafeName(t *testing.T) {
+	names := map[string]string{
+		"invoice.pdf":   "invoice.pdf",
+		"":              "",
+		"..":            "",
+		"../etc/passwd": "",
+		"/etc/passwd":   "",
+		"a\\b":          "",
+	}
+	for name, expected := range names {
+		if s := (metadata{Name: name}).safeName(); s != expected {
+			t.Errorf("safeName(%q) = %q, expected %q", name, s, expected)
+		}
+	}
+}
@@ -1,38 +1,44 @@
 package roe
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // errBasenameNotValid is an error used by newSplittedName when the given file
-// does not resemple an encrypted .bmp image that is part of larger original file.
+// does not resemple an encrypted image that is part of larger original file.
 var errBasenameNotValid = fmt.Errorf("not a splitted file")
 
 type splitName struct {
 	base  string
 	index int
 	count int
+	ext   string
 }
 
 func (s splitName) String() string {
-	return encryptedFilename(s.base, s.index, s.count)
+	return encryptedFilename(s.base, s.index, s.count, s.ext)
 }
 
 func newSplittedName(fp string) (*splitName, error) {
 	base := filepath.Base(fp)
 
-	if !HasBmpExt(fp) {
+	ext := containerExt(fp)
+	if ext == "" {
 		return nil, errBasenameNotValid
 	}
 
-	r := regexp.MustCompile("^(.+)\\.(\\d+)-(\\d+)\\.bmp$")
+	r := regexp.MustCompile("^(.+)\\.(\\d+)-(\\d+)\\.[^.]+$")
 	parts := r.FindAllStringSubmatch(base, 3)
 
 	if len(parts) != 1 || len(parts[0]) != 4 {
@@ -58,31 +64,35 @@ func newSplittedName(fp string) (*splitName, error) {
 		base:  parts[0][1],
 		index: index,
 		count: count,
+		ext:   ext,
 	}, nil
 }
 
-// isSplittedName returns true if the given filename ends with "{n}-{total}.bmp"
-// where {n} and {total} are numbers, for e.g. "/tmp/foobar.2-10.bmp".
+// isSplittedName returns true if the given filename ends with "{n}-{total}.bmp", or the
+// extension of another container, where {n} and {total} are numbers, for e.g. "/tmp/foobar.2-10.bmp".
 // {n} must be less than or equal to {total} and cannot be less than or equal to zero.
 func isSplittedName(fp string) bool {
 	_, err := newSplittedName(fp)
 	return err == nil
 }
 
-// DecryptedFilename returns the filename that will be used for the decrypted (the original) version of a file
-func DecryptedFilename(fp string) string {
-	if !HasBmpExt(fp) {
-		log.Fatal("expected .bmp ext")
+// DecryptedFilename returns the filename that will be used for the decrypted (the original) version of a file,
+// when its images do not store the original filename. fp must have the extension of a
+// container, .bmp, .png or .wav, or of a converted image, .tif or .tiff.
+func DecryptedFilename(fp string) (string, error) {
+	ext := containerExt(fp)
+	if ext == "" {
+		return "", newError(ErrNotRoeImage, "'%s' does not have the .bmp, .png, .wav or .tiff extension", fp)
 	}
 
 	base := filepath.Base(fp)
 
 	if isSplittedName(fp) {
 		parts := strings.Split(base, ".")
-		return strings.Join(parts[0:len(parts)-2], ".")
+		return strings.Join(parts[0:len(parts)-2], "."), nil
 	}
 
-	return base[0 : len(base)-4]
+	return base[0 : len(base)-len(ext)], nil
 }
 
 // HasBmpExt returns true when the given filename ends with .bmp
@@ -90,11 +100,56 @@ func HasBmpExt(fp string) bool {
 	return strings.EqualFold(filepath.Ext(fp), ".bmp")
 }
 
-func encryptedFilename(base string, index, count int) string {
+// Templates of the names of the encrypted images, see ExpandNameTemplate.
+const (
+	// DefaultNameTemplate keeps the original filename, for e.g. "invoice.pdf.bmp"
+	DefaultNameTemplate = "{name}"
+	// RandomNameTemplate hides the original filename behind a random one, for e.g. "3f9a0c71d2e84b56.bmp"
+	RandomNameTemplate = "{rand}"
+)
+
+// ValidateNameTemplate returns an error when the template cannot be used to name the images.
+func ValidateNameTemplate(t string) error {
+	if !strings.Contains(t, "{name}") && !strings.Contains(t, "{rand}") {
+		return fmt.Errorf("the name template must contain {name} or {rand}")
+	}
+	if strings.ContainsAny(t, "/\\") {
+		return fmt.Errorf("the name template cannot contain path separators")
+	}
+	return nil
+}
+
+// ExpandNameTemplate returns the name given to the images of the file named name,
+// without the extension and the index of the part. In the template "{name}"
+// is replaced by name, "{rand}" by 16 random hex digits and "{date}" by the current
+// date formatted as YYYYMMDD, for e.g. "IMG_{date}_{rand}".
+func ExpandNameTemplate(t string, name string) (string, error) {
+	return expandNameTemplate(rand.Reader, t, name)
+}
+
+// expandNameTemplate is ExpandNameTemplate reading the random digits from rnd.
+func expandNameTemplate(rnd io.Reader, t string, name string) (string, error) {
+	if err := ValidateNameTemplate(t); err != nil {
+		return "", err
+	}
+
+	r := make([]byte, 8)
+	if _, err := io.ReadFull(rnd, r); err != nil {
+		return "", err
+	}
+
+	return strings.NewReplacer(
+		"{name}", name,
+		"{rand}", hex.EncodeToString(r),
+		"{date}", time.Now().Format("20060102"),
+	).Replace(t), nil
+}
+
+func encryptedFilename(base string, index, count int, ext string) string {
 	if count == 1 {
-		return fmt.Sprintf("%s.bmp", base)
+		return base + ext
 	}
-	return fmt.Sprintf("%s.%d-%d.bmp", base, index+1, count)
+	return fmt.Sprintf("%s.%d-%d%s", base, index+1, count, ext)
 }
 
 func findSplitNames(fp string) ([]splitName, error) {
@@ -113,25 +168,25 @@ func findSplitNames(fp string) ([]splitName, error) {
 	}
 	for _, f := range files {
 		sn2, err := newSplittedName(f.Name())
-		if err == nil && sn2.base == sn.base {
+		if err == nil && sn2.base == sn.base && sn2.ext == sn.ext {
 			ary = append(ary, *sn2)
 		}
 	}
 
 	// verify we have all the parts
 	if len(ary) == 0 {
-		return ary, fmt.Errorf("there should be other parts of '%s'", fp)
+		return ary, newError(ErrMissingParts, "there should be other parts of '%s'", fp)
 	}
 	if len(ary) != ary[0].count {
-		return ary, fmt.Errorf("there should be %d parts of '%s', founded %d", ary[0].count, fp, len(ary))
+		return ary, newError(ErrMissingParts, "there should be %d parts of '%s', founded %d", ary[0].count, fp, len(ary))
 	}
 
-	// sort them
-	for i := 0; i < len(ary); i++ {
-		b1 := ary[i]
-		b2 := ary[b1.index]
-		ary[b1.index] = b1
-		ary[i] = b2
+	// sort them, each index must be found once
+	sort.Slice(ary, func(i, j int) bool { return ary[i].index < ary[j].index })
+	for i, n := range ary {
+		if n.index != i || n.count != len(ary) {
+			return ary, newError(ErrMissingParts, "part %d of %d of '%s' not found", i+1, len(ary), fp)
+		}
 	}
 	return ary, nil
 }
@@ -166,11 +221,11 @@ func getByteRanges(total int64, step int64) []byteRange {
 	return output
 }
 
-// GetFileSize returns the size of fp or panic in case of error
-func GetFileSize(fp string) int64 {
+// GetFileSize returns the size of fp.
+func GetFileSize(fp string) (int64, error) {
 	info, err := os.Stat(fp)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	return info.Size()
+	return info.Size(), nil
 }
@@ -0,0 +1,45 @@
+package roe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_encryptFileHidingName(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "invoice.pdf")
+	clearbuf := createRandomFile(cleanpath, 3000)
+	encdir := filepath.Join(tmpdir, "enc")
+	decdir := filepath.Join(tmpdir, "dec")
+	os.MkdirAll(decdir, os.ModePerm)
+
+	if err := encryptFile(cleanpath, encdir, "foobar", EncryptOptions{Split: 1000, NameTemplate: "IMG_{rand}", Preserve: PreserveAll}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(encdir)
+	if len(files) != 3 {
+		t.Fatalf("expected 3 parts, found %d", len(files))
+	}
+	for _, f := range files {
+		if strings.Contains(f.Name(), "invoice") || !strings.HasPrefix(f.Name(), "IMG_") {
+			t.Errorf("unexpected name %s", f.Name())
+		}
+	}
+
+	if err := decryptFile(filepath.Join(encdir, files[1].Name()), decdir, "foobar"); err != nil {
+		t.Fatal(err)
+	}
+	decbuf, err := ioutil.ReadFile(filepath.Join(decdir, "invoice.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clearbuf, decbuf) {
+		t.Errorf("decrypted file and original file differs")
+	}
+}
@@ -0,0 +1,305 @@
+package roe
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Overwrite tells what to do when an output file already exists.
+type Overwrite int
+
+const (
+	// OverwriteAlways replaces the existing files, it is the default.
+	OverwriteAlways Overwrite = iota
+	// OverwriteNever fails with an error matching os.ErrExist.
+	OverwriteNever
+)
+
+// create creates the file fp following the policy.
+func (o Overwrite) create(fp string) (*os.File, error) {
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if o == OverwriteNever {
+		flags |= os.O_EXCL
+	}
+	return os.OpenFile(fp, flags, 0666)
+}
+
+// EncryptOptions configures an Encrypter. Only Recipients is required, the zero value
+// of the other fields selects the default.
+type EncryptOptions struct {
+	// Recipients of the files, any of the matching identities can decrypt them.
+	Recipients []Recipient
+	// Cipher of the payload, DefaultCipher when 0.
+	Cipher Cipher
+	// Split is the maximum size of the parts of a file, see MaxSplit, the default.
+	Split int64
+	// NameTemplate is the name of the images, see ExpandNameTemplate, DefaultNameTemplate when empty.
+	NameTemplate string
+	// Overwrite tells what to do when an image already exists.
+	Overwrite Overwrite
+	// Preserve selects the attributes stored in the images and restored by the decryption.
+	Preserve Preserve
+	// Compression is applied to the files before the encryption, when it reduces their size.
+	Compression CompressionParams
+	// Container is the format of the files written, DefaultContainer when nil.
+	Container Container
+	// Dimensions constrains the size of the images, the files are splitted to fit them.
+	// It is accepted only with the containers writing images.
+	Dimensions Dimensions
+	// Covers are photos hiding the payloads in the low bits of their pixels, instead of
+	// images of noise: the parts of a file are written in the covers in order, each one as
+	// large as its cover holds, about 3/8 of a byte per pixel, less 56 bytes and 40 more for
+	// each recipient after the first one. The images have the size of the covers, see
+	// DecodeImage, and they are written in the Container, bmp or png. The same covers are
+	// used for each file. The images cannot be converted to a lossy format.
+	// The low bits cannot be told from random ones without one of the identities: they are
+	// found by trying each identity, which costs a key derivation per password and per image
+	// decrypted, and ListSlots does not see them.
+	Covers []image.Image
+	// Logger receives a message for each image written, the package logger when nil (see SetLogger).
+	// It must be safe for concurrent use when the Encrypter is.
+	Logger Logger
+	// Concurrency is the maximum number of parts of a file encrypted at the same time,
+	// the number of CPUs when 0.
+	Concurrency int
+	// Jobs is the maximum number of files of a directory encrypted at the same time, 1 when 0.
+	// The error returned is the one of the first file failing in lexical order, and the messages
+	// of the files are logged in the same order.
+	Jobs int
+	// Rand is the source of the file keys, the nonces, the random names and the filler of the
+	// images, crypto/rand when nil. The key slots are always made with crypto/rand.
+	// The reads are serialized, Rand does not need to be safe for concurrent use.
+	Rand io.Reader
+}
+
+// DecryptOptions configures a Decrypter. Only Identities is required.
+type DecryptOptions struct {
+	// Identities tried on the key slots of the images, see NewPasswordIdentity.
+	Identities []Identity
+	// Overwrite tells what to do when a decrypted file already exists.
+	Overwrite Overwrite
+	// Logger receives a message for each image decrypted, the package logger when nil (see SetLogger).
+	// It must be safe for concurrent use when the Decrypter is.
+	Logger Logger
+	// Concurrency is the maximum number of parts of a file decrypted at the same time,
+	// the number of CPUs when 0. The parts of a compressed file are decrypted in order,
+	// one at a time, as the decompression needs them.
+	Concurrency int
+	// Jobs is the maximum number of files of a directory decrypted at the same time, 1 when 0.
+	// The error returned is the one of the first file failing in lexical order, and the messages
+	// of the files are logged in the same order.
+	Jobs int
+	// KDFLimits bounds the cost of opening the password slots, the zero fields get the value
+	// of DefaultKDFLimits. The images whose slots exceed them are not decrypted.
+	KDFLimits KDFLimits
+}
+
+// lockedReader serializes the reads of a reader shared by several goroutines.
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Read(p)
+}
+
+// Encrypter encrypts files with the same options, it is safe for concurrent use.
+type Encrypter struct {
+	opts   EncryptOptions
+	covers []Container
+}
+
+// NewEncrypter validates the options and returns an Encrypter using them.
+func NewEncrypter(opts EncryptOptions) (*Encrypter, error) {
+	if len(opts.Recipients) == 0 {
+		return nil, fmt.Errorf("no recipients")
+	}
+	opts.Recipients = append([]Recipient{}, opts.Recipients...)
+	if opts.Cipher == 0 {
+		opts.Cipher = DefaultCipher
+	}
+	if _, err := newAEAD(opts.Cipher, make([]byte, 32)); err != nil {
+		return nil, err
+	}
+	if opts.Split == 0 {
+		opts.Split = MaxSplit
+	}
+	if opts.Split < 1 || opts.Split > MaxSplit {
+		return nil, fmt.Errorf("invalid split %d, it must be between 1 and %d", opts.Split, MaxSplit)
+	}
+	if opts.NameTemplate == "" {
+		opts.NameTemplate = DefaultNameTemplate
+	}
+	if err := ValidateNameTemplate(opts.NameTemplate); err != nil {
+		return nil, err
+	}
+	if err := opts.Compression.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Container == nil {
+		opts.Container = DefaultContainer
+	}
+	if opts.Dimensions != (Dimensions{}) {
+		c, err := withDimensions(opts.Container, opts.Dimensions)
+		if err != nil {
+			return nil, err
+		}
+		opts.Container = c
+	}
+	var covers []Container
+	if len(opts.Covers) > 0 {
+		if opts.Dimensions != (Dimensions{}) {
+			return nil, fmt.Errorf("the images have the dimensions of the covers")
+		}
+		var err error
+		if covers, err = newCoverContainers(opts.Container, opts.Covers, opts.Recipients); err != nil {
+			return nil, err
+		}
+		opts.Covers = append([]image.Image{}, opts.Covers...)
+	}
+	if opts.Concurrency < 0 {
+		return nil, fmt.Errorf("invalid concurrency %d", opts.Concurrency)
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = runtime.NumCPU()
+	}
+	if opts.Jobs < 0 {
+		return nil, fmt.Errorf("invalid jobs %d", opts.Jobs)
+	}
+	if opts.Jobs == 0 {
+		opts.Jobs = 1
+	}
+	if opts.Rand == nil {
+		opts.Rand = rand.Reader
+	} else {
+		opts.Rand = &lockedReader{r: opts.Rand}
+	}
+	return &Encrypter{opts: opts, covers: covers}, nil
+}
+
+// EncryptFile encrypts the file src into outdir, writing a new valid image of the Container.
+// The data is encrypted with the Cipher using a random file key, wrapped for each of the
+// Recipients, so that any of the matching identities can decrypt it.
+// All the parts of a splitted file share the same key slots.
+// The images are named after the NameTemplate (see ExpandNameTemplate), the original
+// filename and the attributes selected by Preserve are stored encrypted and
+// restored by DecryptFile. With Compression the file is compressed before the encryption,
+// unless the compression does not reduce its size.
+// Files larger than Split bytes are splitted, see MaxSplit. Empty files are ignored.
+// It stops as soon as ctx is done, removing the images already written, and it reports
+// its progress to progress, which can be nil. While the file is being compressed,
+// Part and Parts are 0.
+func (e *Encrypter) EncryptFile(ctx context.Context, src string, outdir string, progress ProgressFunc) error {
+	return e.encryptFile(newTracker(ctx, progress, e.opts.Logger), src, outdir)
+}
+
+// EncryptDir walks srcdir and encrypts each file into the same relative folder of outdir,
+// the progress covers all the files of srcdir.
+func (e *Encrypter) EncryptDir(ctx context.Context, srcdir string, outdir string, progress ProgressFunc) error {
+	t := newTracker(ctx, progress, e.opts.Logger)
+	total, err := walkSize(srcdir, func(string) bool { return true })
+	if err != nil {
+		return err
+	}
+	t.setTotal(total)
+	return e.encryptDir(t, srcdir, outdir)
+}
+
+// NewWriter returns a writer encrypting the data written to it into a single image
+// written to dst on Close, see NewEncryptWriter. The options about files are ignored,
+// the image hides the data in the first cover, if any.
+func (e *Encrypter) NewWriter(dst io.Writer) (io.WriteCloser, error) {
+	return e.newWriter(dst, e.container(0))
+}
+
+// container returns the container of the part i of a file, its cover when there are covers.
+func (e *Encrypter) container(i int) Container {
+	if len(e.covers) > 0 {
+		return e.covers[i]
+	}
+	return e.opts.Container
+}
+
+// newWriter is NewWriter writing a file of the container c.
+func (e *Encrypter) newWriter(dst io.Writer, c Container) (*encryptWriter, error) {
+	header, fileKey, err := newPayloadHeader(e.opts.Rand, e.opts.Recipients, e.opts.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	sp, err := newSpool()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{dst: dst, rand: e.opts.Rand, container: c, header: header, fileKey: fileKey, spool: sp}, nil
+}
+
+// Decrypter decrypts files with the same options, it is safe for concurrent use.
+type Decrypter struct {
+	opts DecryptOptions
+}
+
+// NewDecrypter validates the options and returns a Decrypter using them.
+func NewDecrypter(opts DecryptOptions) (*Decrypter, error) {
+	if len(opts.Identities) == 0 {
+		return nil, fmt.Errorf("no identities")
+	}
+	opts.Identities = append([]Identity{}, opts.Identities...)
+	if opts.Concurrency < 0 {
+		return nil, fmt.Errorf("invalid concurrency %d", opts.Concurrency)
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = runtime.NumCPU()
+	}
+	if opts.Jobs < 0 {
+		return nil, fmt.Errorf("invalid jobs %d", opts.Jobs)
+	}
+	if opts.Jobs == 0 {
+		opts.Jobs = 1
+	}
+	if opts.KDFLimits.Slots < 0 {
+		return nil, fmt.Errorf("invalid password slots limit %d", opts.KDFLimits.Slots)
+	}
+	opts.KDFLimits = opts.KDFLimits.withDefaults()
+	return &Decrypter{opts: opts}, nil
+}
+
+// DecryptFile decrypts the image srcpath into outdir. The .bmp, .png and .wav files are
+// detected from their content; images converted to another lossless format keeping the
+// alpha channel, for e.g. from .bmp to .png or .tiff, are decrypted from their pixels.
+// If the file is part of a larger original file, all the other parts are searched
+// in order to combine them. It stops as soon as ctx is done, removing the partially decrypted file, and it reports
+// its progress to progress, which can be nil.
+func (d *Decrypter) DecryptFile(ctx context.Context, srcpath string, outdir string, progress ProgressFunc) error {
+	return d.decryptFile(newTracker(ctx, progress, d.opts.Logger), srcpath, outdir)
+}
+
+// DecryptDir walks srcdir and decrypts each image into the same relative folder of outdir,
+// the files which are not images are skipped. The progress covers all the images of srcdir.
+func (d *Decrypter) DecryptDir(ctx context.Context, srcdir string, outdir string, progress ProgressFunc) error {
+	t := newTracker(ctx, progress, d.opts.Logger)
+	total, err := walkSize(srcdir, HasContainerExt)
+	if err != nil {
+		return err
+	}
+	t.setTotal(total)
+	return d.decryptDir(t, srcdir, outdir)
+}
+
+// NewReader returns a reader of the data decrypted from the image read from src,
+// see NewDecryptReader.
+func (d *Decrypter) NewReader(src io.Reader) (io.ReadCloser, error) {
+	p, err := openPayload(src, d.opts.Identities, d.opts.KDFLimits)
+	if err != nil {
+		return nil, err
+	}
+	return p.readCloser()
+}
@@ -0,0 +1,146 @@
+package roe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func Test_encrypterConcurrentUse(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	e, err := NewEncrypter(EncryptOptions{
+		Recipients: []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+		Split:      1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDecrypter(DecryptOptions{Identities: []Identity{NewPasswordIdentity("foobar")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same Encrypter and Decrypter are used by all the goroutines
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("clean%d.bin", i)
+			cleanpath := filepath.Join(tmpdir, name)
+			createRandomFile(cleanpath, 1500+i*100)
+			encdir := filepath.Join(tmpdir, fmt.Sprintf("enc%d", i))
+			if err := e.EncryptFile(context.Background(), cleanpath, encdir, nil); err != nil {
+				errs <- err
+				return
+			}
+			decdir := filepath.Join(tmpdir, fmt.Sprintf("dec%d", i))
+			os.MkdirAll(decdir, os.ModePerm)
+			if err := d.DecryptFile(context.Background(), filepath.Join(encdir, name+".1-2.bmp"), decdir, nil); err != nil {
+				errs <- err
+				return
+			}
+			clean, _ := ioutil.ReadFile(cleanpath)
+			dec, _ := ioutil.ReadFile(filepath.Join(decdir, name))
+			if !bytes.Equal(clean, dec) {
+				errs <- fmt.Errorf("%s: the decrypted file differs", name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func Test_encryptOptionsRand(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "clean.bin")
+	createRandomFile(cleanpath, 1000)
+
+	// only the key slots are random, everything else comes from Rand
+	opts := EncryptOptions{
+		Recipients:   []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+		NameTemplate: RandomNameTemplate,
+		Rand:         bytes.NewReader(bytes.Repeat([]byte{7}, 1<<20)),
+	}
+	e, err := NewEncrypter(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.EncryptFile(context.Background(), cleanpath, tmpdir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, "0707070707070707.bmp")); err != nil {
+		t.Errorf("the random name should come from Rand: %v", err)
+	}
+}
+
+func Test_overwriteNever(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "clean.bin")
+	createRandomFile(cleanpath, 1000)
+	encdir := filepath.Join(tmpdir, "enc")
+
+	e, err := NewEncrypter(EncryptOptions{
+		Recipients: []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+		Overwrite:  OverwriteNever,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.EncryptFile(context.Background(), cleanpath, encdir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.EncryptFile(context.Background(), cleanpath, encdir, nil); !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected %v, got %v", os.ErrExist, err)
+	}
+
+	d, err := NewDecrypter(DecryptOptions{Identities: []Identity{NewPasswordIdentity("foobar")}, Overwrite: OverwriteNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DecryptFile(context.Background(), filepath.Join(encdir, "clean.bin.bmp"), tmpdir, nil); !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected %v, got %v", os.ErrExist, err)
+	}
+}
+
+func Test_newEncrypterErrors(t *testing.T) {
+	recipients := []Recipient{NewPasswordRecipient("foobar", testKDFParams)}
+	cases := []EncryptOptions{
+		{},
+		{Recipients: recipients, Split: -1},
+		{Recipients: recipients, Split: MaxSplit + 1},
+		{Recipients: recipients, Cipher: 42},
+		{Recipients: recipients, NameTemplate: "foo"},
+		{Recipients: recipients, Compression: CompressionParams{Algorithm: Zstd, Level: 99}},
+		{Recipients: recipients, Dimensions: Dimensions{MaxWidth: -1}},
+		{Recipients: recipients, Dimensions: Dimensions{MaxPixels: 10, Aspect: 100}},
+		{Recipients: recipients, Container: WAV, Dimensions: Dimensions{MaxPixels: 1000}},
+		{Recipients: recipients, Container: WAV, Covers: []image.Image{image.NewNRGBA(image.Rect(0, 0, 8, 8))}},
+		{Recipients: recipients, Covers: []image.Image{image.NewNRGBA(image.Rect(0, 0, 0, 8))}},
+	}
+	for _, opts := range cases {
+		if _, err := NewEncrypter(opts); err == nil {
+			t.Errorf("%+v should be invalid", opts)
+		}
+	}
+	if _, err := NewDecrypter(DecryptOptions{}); err == nil {
+		t.Errorf("a Decrypter without identities should be invalid")
+	}
+}
@@ -0,0 +1,71 @@
+package roe
+
+import (
+	"os"
+	"sync"
+)
+
+// runParts calls fn for each index from 0 to n-1, running at most workers calls at the
+// same time. The indexes are started in order and after a failure only the lower ones
+// are still started. It returns the error of the lowest failing index, so that it does
+// not depend on the scheduling.
+func runParts(n int, workers int, fn func(i int) error) error {
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	errs := make([]error, n)
+	var mu sync.Mutex
+	failed := n // the lowest failing index
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				mu.Lock()
+				skip := i > failed
+				mu.Unlock()
+				if skip {
+					continue
+				}
+				if errs[i] = fn(i); errs[i] != nil {
+					mu.Lock()
+					if i < failed {
+						failed = i
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// offsetWriter writes to f sequentially starting from off, so that several parts can be
+// written to the same file at the same time.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,218 @@
+package roe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_runPartsFirstError(t *testing.T) {
+	for workers := 1; workers <= 4; workers++ {
+		err := runParts(10, workers, func(i int) error {
+			if i >= 3 {
+				return fmt.Errorf("part %d", i)
+			}
+			return nil
+		})
+		if err == nil || err.Error() != "part 3" {
+			t.Errorf("%d workers: expected the error of part 3, got %v", workers, err)
+		}
+	}
+}
+
+func Test_concurrentParts(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	recipients := []Recipient{NewPasswordRecipient("foobar", testKDFParams)}
+	ids := []Identity{NewPasswordIdentity("foobar")}
+	d, err := NewDecrypter(DecryptOptions{Identities: ids, Concurrency: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// random data is never compressed, text is compressed and decrypted in order
+	random := filepath.Join(tmpdir, "random.bin")
+	createRandomFile(random, 20*chunkSize+123)
+	text := filepath.Join(tmpdir, "text.txt")
+	ioutil.WriteFile(text, bytes.Repeat([]byte("roe "), 5*chunkSize), 0644)
+
+	for _, fp := range []string{random, text} {
+		name := filepath.Base(fp)
+		e, err := NewEncrypter(EncryptOptions{
+			Recipients:  recipients,
+			Split:       chunkSize + 7,
+			Compression: CompressionParams{Algorithm: Deflate, Level: 1},
+			Concurrency: 4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encdir := filepath.Join(tmpdir, "enc-"+name)
+		if err := e.EncryptFile(context.Background(), fp, encdir, nil); err != nil {
+			t.Fatal(err)
+		}
+		images, _ := ioutil.ReadDir(encdir)
+
+		decdir := filepath.Join(tmpdir, "dec-"+name)
+		os.MkdirAll(decdir, os.ModePerm)
+		if err := d.DecryptFile(context.Background(), filepath.Join(encdir, images[0].Name()), decdir, nil); err != nil {
+			t.Fatal(err)
+		}
+		clean, _ := ioutil.ReadFile(fp)
+		dec, _ := ioutil.ReadFile(filepath.Join(decdir, name))
+		if !bytes.Equal(clean, dec) {
+			t.Errorf("%s: the decrypted file differs, %d parts", name, len(images))
+		}
+	}
+
+	// the parts are written at the offset given by the size of the first one
+	encdir := filepath.Join(tmpdir, "enc-random.bin")
+	part := func(i int) string {
+		return filepath.Join(encdir, encryptedFilename("random.bin", i, 20, ".bmp"))
+	}
+	os.Rename(part(1), filepath.Join(tmpdir, "tmp.bmp"))
+	os.Rename(part(19), part(1))
+	os.Rename(filepath.Join(tmpdir, "tmp.bmp"), part(19))
+	decdir := filepath.Join(tmpdir, "dec-swapped")
+	os.MkdirAll(decdir, os.ModePerm)
+	if err := d.DecryptFile(context.Background(), part(0), decdir, nil); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expected %v, got %v", ErrCorrupted, err)
+	}
+	if files, _ := ioutil.ReadDir(decdir); len(files) != 0 {
+		t.Errorf("the file of a failed decryption should be removed, found %d", len(files))
+	}
+}
+
+func Test_dirJobs(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	srcdir := filepath.Join(tmpdir, "src")
+	os.MkdirAll(filepath.Join(srcdir, "sub"), os.ModePerm)
+	var names []string
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("%02d.bin", i)
+		if i%2 == 1 {
+			name = filepath.Join("sub", name)
+		}
+		createRandomFile(filepath.Join(srcdir, name), 500+i*300)
+		names = append(names, name)
+	}
+
+	var log messages
+	e, err := NewEncrypter(EncryptOptions{
+		Recipients: []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+		Split:      1000,
+		Logger:     &log,
+		Jobs:       4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encdir := filepath.Join(tmpdir, "enc")
+	if err := e.EncryptDir(context.Background(), srcdir, encdir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the messages follow the lexical order of the files, whatever the one finishing first
+	var order []string
+	for _, msg := range log {
+		var src, dst string
+		var n int
+		fmt.Sscanf(msg, "encrypt %s -> %s (%d bytes)", &src, &dst, &n)
+		if len(order) == 0 || order[len(order)-1] != src {
+			order = append(order, src)
+		}
+	}
+	if len(order) != len(names) {
+		t.Fatalf("expected the messages of %d files, got %v", len(names), order)
+	}
+	for i, src := range order {
+		if i > 0 && src < order[i-1] {
+			t.Errorf("%s logged after %s", src, order[i-1])
+		}
+	}
+
+	d, err := NewDecrypter(DecryptOptions{Identities: []Identity{NewPasswordIdentity("foobar")}, Jobs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decdir := filepath.Join(tmpdir, "dec")
+	if err := d.DecryptDir(context.Background(), encdir, decdir, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		clean, _ := ioutil.ReadFile(filepath.Join(srcdir, name))
+		dec, _ := ioutil.ReadFile(filepath.Join(decdir, name))
+		if !bytes.Equal(clean, dec) {
+			t.Errorf("%s: the decrypted file differs", name)
+		}
+	}
+
+	// the error is the one of the first file failing in lexical order, sub comes last
+	for _, name := range []string{"08.bin.1-3.bmp", filepath.Join("sub", "03.bin.1-2.bmp")} {
+		fp := filepath.Join(encdir, name)
+		fi, _ := os.Stat(fp)
+		os.Truncate(fp, fi.Size()/2)
+	}
+	for i := 0; i < 5; i++ {
+		decdir := filepath.Join(tmpdir, fmt.Sprintf("dec%d", i))
+		err := d.DecryptDir(context.Background(), encdir, decdir, nil)
+		if !errors.Is(err, ErrTruncated) || !strings.Contains(err.Error(), "08.bin.1-3.bmp") {
+			t.Errorf("expected the error of 08.bin.1-3.bmp, got %v", err)
+		}
+	}
+}
+
+func Test_passwordIdentityConcurrentKeys(t *testing.T) {
+	r := NewPasswordRecipient("foobar", testKDFParams)
+	id := NewPasswordIdentity("foobar").(*passwordIdentity)
+	fileKey := make([]byte, fileKeySize)
+	var params [][]byte
+	for i := 0; i < 2; i++ {
+		s, err := r.wrap(fileKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params = append(params, s.Body[:passwordStanzaSize-wrappedKeySize])
+	}
+
+	// a key being derived does not block the keys of other salts
+	pending := &derivedKey{done: make(chan struct{})}
+	id.cache[string(params[0])] = pending
+	done := make(chan error)
+	go func() {
+		_, err := id.key(params[1])
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the key of another salt waits for the one being derived")
+	}
+
+	// the goroutines asking for the key being derived wait for it
+	go func() {
+		key, err := id.key(params[0])
+		if err == nil && string(key) != "derived" {
+			err = fmt.Errorf("got the key %q", key)
+		}
+		done <- err
+	}()
+	pending.key = []byte("derived")
+	close(pending.done)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
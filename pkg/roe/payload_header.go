@@ -0,0 +1,281 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// payloadMagic marks the beginning of a roe payload inside the bmp data-section
+var payloadMagic = [4]byte{'R', 'O', 'E', '!'}
+
+// payloadVersion is the version of the payload format written by encrypt.
+// It must be incremented every time the layout of the payload changes, so that the
+// images of another layout are reported as unsupported instead of corrupted.
+// Version 1 was written by the development builds, before the parts were numbered.
+const payloadVersion uint8 = 2
+
+// knownFlags is the bitmask of all the flags understood by this version of roe,
+// a payload with any other flag set is rejected.
+const knownFlags uint8 = 0
+
+// errNotRoePayload is returned when the data-section of an image does not start
+// with a roe payload header, for e.g. when trying to decrypt a regular .bmp image.
+var errNotRoePayload = newError(ErrNotRoeImage, "not a roe image")
+
+// errHeaderMAC is returned when the key slots of the header have been tampered with.
+var errHeaderMAC = newError(ErrCorrupted, "header authentication failed: corrupted image")
+
+// fixedHeader holds the fields found at the beginning of every payload header.
+// FileID is random, it is the same in all the parts of a file.
+type fixedHeader struct {
+	Magic       [4]byte
+	Version     uint8
+	Cipher      uint8
+	Flags       uint8
+	Compression uint8
+	FileID      [16]byte
+}
+
+// fixedHeaderSize is the size in bytes of an encoded fixedHeader
+var fixedHeaderSize = binary.Size(fixedHeader{})
+
+// partInfo tells which part of a file a payload holds, it follows the clearsize. Offset
+// is the position of the data of the part in the file, the parts can hold different sizes.
+type partInfo struct {
+	Index  uint32
+	Count  uint32
+	Offset uint64
+}
+
+// partInfoSize is the size in bytes of an encoded partInfo
+var partInfoSize = binary.Size(partInfo{})
+
+// singlePart is the partInfo of a file which is not splitted.
+var singlePart = partInfo{Index: 0, Count: 1, Offset: 0}
+
+// payloadHeader is written in clear at the beginning of the bmp data-section and
+// describes how the rest of the payload has been encrypted.
+//
+// The payload is encrypted with a random file key, wrapped in each one of the
+// stanzas (the key slots) by a password or a public key. The stanzas are authenticated
+// by an HMAC keyed with the file key instead of being part of the additional data of the
+// chunks, so that slots can be added or removed without encrypting the data again.
+// The metadata of the original file follow the stanzas, encrypted with the file key.
+type payloadHeader struct {
+	fixedHeader
+	Stanzas  []stanza
+	Metadata []byte
+	MAC      [sha256.Size]byte
+}
+
+// stanza is a variable-length record of the payload header,
+// encoded as type (1 byte), length of the body (2 bytes) and body.
+type stanza struct {
+	Type uint8
+	Body []byte
+}
+
+// maxStanzas is the maximum number of stanzas of a payload header
+const maxStanzas = 255
+
+// newPayloadHeader returns a header for a payload encrypted with the cipher c using
+// a new file key read from rnd, wrapped for each recipient. The file key is returned
+// along with the header.
+func newPayloadHeader(rnd io.Reader, recipients []Recipient, c Cipher) (payloadHeader, []byte, error) {
+	h := payloadHeader{
+		fixedHeader: fixedHeader{
+			Magic:   payloadMagic,
+			Version: payloadVersion,
+			Cipher:  uint8(c),
+		},
+	}
+
+	if len(recipients) == 0 {
+		return h, nil, fmt.Errorf("no recipients")
+	}
+	if len(recipients) > maxStanzas {
+		return h, nil, fmt.Errorf("too many recipients, the maximum is %d", maxStanzas)
+	}
+	passwords := 0
+	for _, r := range recipients {
+		if _, ok := r.(*passwordRecipient); ok {
+			passwords++
+		}
+	}
+	if passwords > maxPasswordSlots {
+		return h, nil, fmt.Errorf("too many passwords, the maximum is %d", maxPasswordSlots)
+	}
+
+	fileKey := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(rnd, fileKey); err != nil {
+		return h, nil, err
+	}
+	if _, err := io.ReadFull(rnd, h.FileID[:]); err != nil {
+		return h, nil, err
+	}
+
+	for _, r := range recipients {
+		s, err := r.wrap(fileKey)
+		if err != nil {
+			return h, nil, err
+		}
+		h.Stanzas = append(h.Stanzas, s)
+	}
+
+	return h, fileKey, h.sign(fileKey)
+}
+
+// subkey derives from the file key the key used for the given purpose
+func subkey(fileKey []byte, info string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, fileKey, nil, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// payloadKey derives from the file key the key used to encrypt the chunks
+func payloadKey(fileKey []byte) ([]byte, error) {
+	return subkey(fileKey, "roe/payload")
+}
+
+// mac returns the HMAC of the encoded header, MAC excluded
+func (h payloadHeader) mac(fileKey []byte) ([]byte, error) {
+	key, err := subkey(fileKey, "roe/header")
+	if err != nil {
+		return nil, err
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write(h.unsignedBytes())
+	return m.Sum(nil), nil
+}
+
+// sign computes the MAC of the header
+func (h *payloadHeader) sign(fileKey []byte) error {
+	mac, err := h.mac(fileKey)
+	if err != nil {
+		return err
+	}
+	copy(h.MAC[:], mac)
+	return nil
+}
+
+// verify returns errHeaderMAC when the MAC of the header is not valid
+func (h payloadHeader) verify(fileKey []byte) error {
+	mac, err := h.mac(fileKey)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, h.MAC[:]) {
+		return errHeaderMAC
+	}
+	return nil
+}
+
+func (h payloadHeader) unsignedBytes() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, fixedHeaderSize))
+	binary.Write(buf, binary.LittleEndian, h.fixedHeader)
+
+	buf.WriteByte(uint8(len(h.Stanzas)))
+	for _, s := range h.Stanzas {
+		buf.WriteByte(s.Type)
+		binary.Write(buf, binary.LittleEndian, uint16(len(s.Body)))
+		buf.Write(s.Body)
+	}
+
+	binary.Write(buf, binary.LittleEndian, uint32(len(h.Metadata)))
+	buf.Write(h.Metadata)
+
+	return buf.Bytes()
+}
+
+// bytes returns the encoded header
+func (h payloadHeader) bytes() []byte {
+	return append(h.unsignedBytes(), h.MAC[:]...)
+}
+
+// additionalData returns the data authenticated along with every chunk of the payload:
+// the fixed part of the header, with the file ID, the size of the plaintext and the
+// position of the part, so that the parts cannot be swapped or mixed with other files.
+func (h payloadHeader) additionalData(clearsize uint64, part partInfo) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, fixedHeaderSize+8+partInfoSize))
+	binary.Write(buf, binary.LittleEndian, h.fixedHeader)
+	binary.Write(buf, binary.LittleEndian, clearsize)
+	binary.Write(buf, binary.LittleEndian, part)
+	return buf.Bytes()
+}
+
+// readPayloadHeader reads a payloadHeader from r and verifies that
+// it can be handled by this version of roe. The MAC is not verified.
+func readPayloadHeader(r io.Reader) (payloadHeader, error) {
+	var h payloadHeader
+
+	if err := binary.Read(r, binary.LittleEndian, &h.fixedHeader); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return h, errNotRoePayload
+		}
+		return h, err
+	}
+
+	if h.Magic != payloadMagic {
+		return h, errNotRoePayload
+	}
+	if h.Version != payloadVersion {
+		return h, fmt.Errorf("unsupported format version %d", h.Version)
+	}
+	if c := Cipher(h.Cipher); c != AES256GCM && c != XChaCha20Poly1305 {
+		return h, fmt.Errorf("unsupported cipher %d", h.Cipher)
+	}
+	if h.Flags&^knownFlags != 0 {
+		return h, fmt.Errorf("unsupported flags %#x", h.Flags)
+	}
+	if c := Compression(h.Compression); c != NoCompression && c != Deflate && c != Zstd {
+		return h, fmt.Errorf("unsupported compression %d", h.Compression)
+	}
+
+	// read the stanzas
+	var count uint8
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return h, readError(err, "failed to read the key slots")
+	}
+	for i := 0; i < int(count); i++ {
+		var s stanza
+		var size uint16
+		if err := binary.Read(r, binary.LittleEndian, &s.Type); err != nil {
+			return h, readError(err, "failed to read the key slots")
+		}
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return h, readError(err, "failed to read the key slots")
+		}
+		s.Body = make([]byte, size)
+		if _, err := io.ReadFull(r, s.Body); err != nil {
+			return h, readError(err, "failed to read the key slots")
+		}
+		h.Stanzas = append(h.Stanzas, s)
+	}
+
+	// read the encrypted metadata
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return h, readError(err, "failed to read the metadata")
+	}
+	if size > maxMetadataSize {
+		return h, newError(ErrCorrupted, "metadata too large: %d bytes", size)
+	}
+	h.Metadata = make([]byte, size)
+	if _, err := io.ReadFull(r, h.Metadata); err != nil {
+		return h, readError(err, "failed to read the metadata")
+	}
+
+	if _, err := io.ReadFull(r, h.MAC[:]); err != nil {
+		return h, readError(err, "failed to read the header")
+	}
+
+	return h, nil
+}
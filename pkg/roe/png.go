@@ -0,0 +1,408 @@
+package roe
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// pngSignature starts every png file.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngChunkSize is the size of the IDAT chunks written.
+const pngChunkSize = 64 * 1024
+
+// pngMaxWidth is the width of the widest png image read, a row of pixels is kept in memory.
+const pngMaxWidth = 1 << 20
+
+// pngContainer stores the payload in the pixels of an 8 bits RGBA image, a square unless
+// the shape is given. The rows are not filtered and the zlib stream is not compressed, the
+// payload could not be compressed anyway. When reading, any filter is supported.
+type pngContainer struct {
+	shape *imageShape
+}
+
+func (pngContainer) Name() string { return "png" }
+
+func (pngContainer) Ext() string { return ".png" }
+
+// Capacity is the one of the bmp images, the size of the pixels is the same.
+func (c pngContainer) Capacity() int64 {
+	return c.shape.capacity()
+}
+
+func (c pngContainer) newWriter(w io.Writer, size int64, rnd io.Reader) (io.WriteCloser, error) {
+	if size > c.Capacity() {
+		return nil, fmt.Errorf("%d bytes do not fit in a png image, the maximum is about %d bytes", size, c.Capacity())
+	}
+	width, height := c.shape.size(size)
+
+	// write the signature and the header
+	if _, err := w.Write(pngSignature); err != nil {
+		return nil, err
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // truecolor with alpha
+	if err := writePngChunk(w, "IHDR", ihdr); err != nil {
+		return nil, err
+	}
+
+	// the pixels are written through zlib into the IDAT chunks, the end of the zlib
+	// stream and the IEND chunk are written once the image is full
+	idat := &pngIdatWriter{w: w, buf: make([]byte, 0, pngChunkSize)}
+	zw, err := zlib.NewWriterLevel(idat, zlib.NoCompression)
+	if err != nil {
+		return nil, err
+	}
+	done := func() error {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if err := idat.flush(); err != nil {
+			return err
+		}
+		return writePngChunk(w, "IEND", nil)
+	}
+	rows := &pngRowWriter{w: zw, stride: 4 * width}
+	return &fillWriter{w: rows, size: 4 * width * height, rnd: rnd, done: done}, nil
+}
+
+func (pngContainer) withShape(shape *imageShape) Container {
+	return pngContainer{shape: shape}
+}
+
+// maxWidth is the one of the images read, see pngMaxWidth.
+func (pngContainer) maxWidth() int64 {
+	return pngMaxWidth
+}
+
+func (pngContainer) layout() pixelLayout {
+	return pngLayout
+}
+
+func (pngContainer) match(head []byte) bool {
+	return bytes.HasPrefix(head, pngSignature)
+}
+
+func (pngContainer) newReader(r io.Reader) (io.Reader, error) {
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return nil, readError(err, "failed to read the png signature")
+	}
+
+	// read the header, the first chunk
+	c := &pngChunkReader{r: r}
+	typ, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+	if typ != "IHDR" || c.left != 13 {
+		return nil, newError(ErrCorrupted, "the png image does not start with its header")
+	}
+	ihdr := make([]byte, 13)
+	if _, err := io.ReadFull(c, ihdr); err != nil {
+		return nil, readError(err, "failed to read the png header")
+	}
+	if err := c.end(); err != nil {
+		return nil, err
+	}
+
+	// only 8 bits RGBA images can hold a payload
+	width := int64(binary.BigEndian.Uint32(ihdr[0:]))
+	height := int64(binary.BigEndian.Uint32(ihdr[4:]))
+	if ihdr[8] != 8 || ihdr[9] != 6 || ihdr[10] != 0 || ihdr[11] != 0 || ihdr[12] != 0 {
+		return nil, errNotRoePayload
+	}
+	if width == 0 || height == 0 || width > pngMaxWidth {
+		return nil, newError(ErrCorrupted, "invalid png size %dx%d", width, height)
+	}
+
+	zr, err := zlib.NewReader(&pngIdatReader{c: c})
+	if err != nil {
+		return nil, pngReadError(err)
+	}
+	return &pngRowReader{
+		r:    zr,
+		rows: height,
+		prev: make([]byte, 1+4*width),
+		cur:  make([]byte, 1+4*width),
+		off:  1 + 4*width,
+	}, nil
+}
+
+// writePngChunk writes a chunk with its length and its checksum.
+func writePngChunk(w io.Writer, typ string, data []byte) error {
+	b := make([]byte, 8+len(data)+4)
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], typ)
+	copy(b[8:], data)
+	binary.BigEndian.PutUint32(b[8+len(data):], crc32.ChecksumIEEE(b[4:8+len(data)]))
+	_, err := w.Write(b)
+	return err
+}
+
+// pngIdatWriter writes the zlib stream in IDAT chunks of pngChunkSize bytes.
+type pngIdatWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (iw *pngIdatWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := cap(iw.buf) - len(iw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		iw.buf = append(iw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(iw.buf) == cap(iw.buf) {
+			if err := iw.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush writes the pending data as an IDAT chunk.
+func (iw *pngIdatWriter) flush() error {
+	if len(iw.buf) == 0 {
+		return nil
+	}
+	err := writePngChunk(iw.w, "IDAT", iw.buf)
+	iw.buf = iw.buf[:0]
+	return err
+}
+
+// pngRowWriter writes the pixels row by row, each one preceded by the filter type none.
+type pngRowWriter struct {
+	w      io.Writer
+	stride int64
+	left   int64
+}
+
+func (rw *pngRowWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if rw.left == 0 {
+			if _, err := rw.w.Write([]byte{0}); err != nil {
+				return written, err
+			}
+			rw.left = rw.stride
+		}
+		n := int64(len(p))
+		if n > rw.left {
+			n = rw.left
+		}
+		n2, err := rw.w.Write(p[:n])
+		written += n2
+		rw.left -= int64(n2)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// pngChunkReader reads the data of a chunk, Read returns io.EOF at the end of the data.
+type pngChunkReader struct {
+	r     io.Reader
+	typ   string
+	left  int64
+	crc   hash.Hash32
+	ended bool
+}
+
+// next reads the header of the next chunk and returns its type.
+func (c *pngChunkReader) next() (string, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return "", readError(err, "failed to read a png chunk")
+	}
+	c.left = int64(binary.BigEndian.Uint32(b))
+	if c.left > math.MaxInt32 {
+		return "", newError(ErrCorrupted, "invalid png chunk length %d", c.left)
+	}
+	c.typ = string(b[4:])
+	c.ended = false
+	c.crc = crc32.NewIEEE()
+	c.crc.Write(b[4:])
+	return c.typ, nil
+}
+
+func (c *pngChunkReader) Read(p []byte) (int, error) {
+	if c.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	c.left -= int64(n)
+	if err == io.EOF && c.left > 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// end skips the rest of the data of the chunk and verifies its checksum, once.
+func (c *pngChunkReader) end() error {
+	if c.ended {
+		return nil
+	}
+	c.ended = true
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		return readError(err, "failed to read the png chunk %s", c.typ)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return readError(err, "failed to read the png chunk %s", c.typ)
+	}
+	if binary.BigEndian.Uint32(b) != c.crc.Sum32() {
+		return newError(ErrCorrupted, "invalid checksum of the png chunk %s", c.typ)
+	}
+	return nil
+}
+
+// pngIdatReader reads the data of the IDAT chunks, skipping the other ones, up to the
+// IEND chunk.
+type pngIdatReader struct {
+	c   *pngChunkReader
+	eof bool
+}
+
+func (ir *pngIdatReader) Read(p []byte) (int, error) {
+	for !ir.eof {
+		if ir.c.typ == "IDAT" && ir.c.left > 0 {
+			return ir.c.Read(p)
+		}
+		if err := ir.c.end(); err != nil {
+			return 0, err
+		}
+		typ, err := ir.c.next()
+		if err != nil {
+			return 0, err
+		}
+		ir.eof = typ == "IEND"
+	}
+	return 0, io.EOF
+}
+
+// pngRowReader reads the pixels of an image row by row, reversing the filters.
+type pngRowReader struct {
+	r    io.Reader
+	rows int64
+	prev []byte
+	cur  []byte
+	off  int64
+}
+
+func (rr *pngRowReader) Read(p []byte) (int, error) {
+	if rr.off == int64(len(rr.cur)) {
+		if rr.rows == 0 {
+			return 0, io.EOF
+		}
+		rr.prev, rr.cur = rr.cur, rr.prev
+		if _, err := io.ReadFull(rr.r, rr.cur); err != nil {
+			return 0, pngReadError(err)
+		}
+		if err := unfilterPngRow(rr.cur, rr.prev); err != nil {
+			return 0, err
+		}
+		rr.rows--
+		rr.off = 1
+	}
+	n := copy(p, rr.cur[rr.off:])
+	rr.off += int64(n)
+	return n, nil
+}
+
+// unfilterPngRow reverses the filter of the row cur, its first byte is the filter type,
+// prev is the previous row already unfiltered, of 4 bytes pixels.
+func unfilterPngRow(cur []byte, prev []byte) error {
+	const bpp = 4
+	row, up := cur[1:], prev[1:]
+	switch cur[0] {
+	case 0:
+	case 1:
+		for i := bpp; i < len(row); i++ {
+			row[i] += row[i-bpp]
+		}
+	case 2:
+		for i := range row {
+			row[i] += up[i]
+		}
+	case 3:
+		for i := range row {
+			left := 0
+			if i >= bpp {
+				left = int(row[i-bpp])
+			}
+			row[i] += byte((left + int(up[i])) / 2)
+		}
+	case 4:
+		for i := range row {
+			var a, c byte
+			if i >= bpp {
+				a, c = row[i-bpp], up[i-bpp]
+			}
+			row[i] += paeth(a, up[i], c)
+		}
+	default:
+		return newError(ErrCorrupted, "invalid png filter %d", cur[0])
+	}
+	return nil
+}
+
+// paeth returns the predictor of the Paeth filter.
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// pngReadError converts the errors of the zlib stream.
+func pngReadError(err error) error {
+	switch err.(type) {
+	case *roeError:
+		return err
+	case flate.CorruptInputError:
+		return newError(ErrCorrupted, "invalid png data: %v", err)
+	}
+	if err == zlib.ErrHeader || err == zlib.ErrChecksum || err == zlib.ErrDictionary {
+		return newError(ErrCorrupted, "invalid png data: %v", err)
+	}
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
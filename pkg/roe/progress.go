@@ -0,0 +1,220 @@
+package roe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Progress describes the progress of an encryption or a decryption.
+// The bytes are counted on the input files: the original files when encrypting,
+// the images when decrypting. When the files of a directory are processed at the
+// same time, the fields about the current file describe the one reporting.
+type Progress struct {
+	File     string // the file being read, the original file or the current image
+	Part     int    // index of the current part starting from 1, the last one started when they run concurrently
+	Parts    int    // number of parts of the current file
+	FileDone int64  // bytes read of the current file, of all its parts when decrypting
+	FileSize int64  // size of the current file, of all its parts when decrypting
+	Done     int64  // bytes read of all the files
+	Total    int64  // size of all the files
+}
+
+// ProgressFunc is called with the progress of an operation every time a chunk of data
+// has been processed, and when a new part is started. The calls are never concurrent,
+// but they can come from the goroutines processing the parts, so it should return quickly.
+type ProgressFunc func(Progress)
+
+// tracker checks the cancellation of an operation, reports its progress and logs
+// what it is doing. It is shared by the goroutines processing the parts of a file.
+// The files of a directory processed at the same time get their own child tracker,
+// whose messages are logged in the order of the files, see runFiles.
+// The mutex of the root tracker serializes the updates of the progress and the calls
+// to fn and log.
+type tracker struct {
+	ctx    context.Context
+	fn     ProgressFunc
+	log    Logger
+	mu     sync.Mutex
+	p      Progress // Done and Total are only kept by the root tracker
+	fixed  bool     // Total has been computed in advance
+	parent *tracker
+	index  int       // index of the file of a child tracker
+	queue  *logQueue // of the files run by the root tracker
+}
+
+// newTracker returns a tracker of an operation, log is nil to use the logger of the package.
+func newTracker(ctx context.Context, fn ProgressFunc, log Logger) *tracker {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &tracker{ctx: ctx, fn: fn, log: log}
+}
+
+func (t *tracker) root() *tracker {
+	if t.parent != nil {
+		return t.parent
+	}
+	return t
+}
+
+// setTotal sets the size of all the files, otherwise it grows with each file.
+func (t *tracker) setTotal(total int64) {
+	r := t.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.p.Total, r.fixed = total, true
+}
+
+func (t *tracker) startFile(size int64) {
+	r := t.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t.p.FileDone, t.p.FileSize = 0, size
+	if !r.fixed {
+		r.p.Total += size
+	}
+}
+
+func (t *tracker) startPart(fp string, part, parts int) {
+	r := t.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t.p.File, t.p.Part, t.p.Parts = fp, part, parts
+	t.report()
+}
+
+// add counts n more bytes read, negative to discard bytes already counted.
+func (t *tracker) add(n int64) {
+	if n == 0 {
+		return
+	}
+	r := t.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t.p.FileDone += n
+	r.p.Done += n
+	t.report()
+}
+
+// rewindFile discards the bytes counted for the current file.
+func (t *tracker) rewindFile() {
+	r := t.root()
+	r.mu.Lock()
+	n := t.p.FileDone
+	r.mu.Unlock()
+	t.add(-n)
+}
+
+// report calls fn, the mutex of the root tracker must be held.
+func (t *tracker) report() {
+	if t.fn != nil {
+		p, r := t.p, t.root()
+		p.Done, p.Total = r.p.Done, r.p.Total
+		t.fn(p)
+	}
+}
+
+func (t *tracker) logf(format string, v ...interface{}) {
+	r := t.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msg := fmt.Sprintf(format, v...)
+	if t.parent != nil && t.index != r.queue.next {
+		r.queue.msgs[t.index] = append(r.queue.msgs[t.index], msg)
+		return
+	}
+	r.print(msg)
+}
+
+// print sends msg to the logger, the mutex must be held.
+func (t *tracker) print(msg string) {
+	if t.log != nil {
+		t.log.Printf("%s", msg)
+		return
+	}
+	logf("%s", msg)
+}
+
+// logQueue holds the messages of the files of a directory processed at the same time:
+// the messages of the first unfinished file are logged as they come, the ones of the
+// following files are kept until it is their turn.
+type logQueue struct {
+	next int // the first unfinished file
+	done []bool
+	msgs [][]string
+}
+
+// runFiles calls fn for n files, running at most jobs calls at the same time, see runParts.
+// Each call gets a child tracker, so that the messages are logged in the order of the files.
+func (t *tracker) runFiles(n int, jobs int, fn func(t *tracker, i int) error) error {
+	t.mu.Lock()
+	t.queue = &logQueue{done: make([]bool, n), msgs: make([][]string, n)}
+	t.mu.Unlock()
+
+	err := runParts(n, jobs, func(i int) error {
+		c := &tracker{ctx: t.ctx, fn: t.fn, parent: t, index: i}
+		defer c.finish()
+		return fn(c, i)
+	})
+
+	// the files not started after a failure leave the messages of the following ones behind
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, msgs := range t.queue.msgs {
+		for _, msg := range msgs {
+			t.print(msg)
+		}
+	}
+	t.queue = nil
+	return err
+}
+
+// finish logs the messages of the files waiting for the file of a child tracker.
+func (t *tracker) finish() {
+	r := t.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	q := r.queue
+	q.done[t.index] = true
+	for q.next < len(q.done) && q.done[q.next] {
+		q.next++
+		if q.next < len(q.done) {
+			for _, msg := range q.msgs[q.next] {
+				r.print(msg)
+			}
+			q.msgs[q.next] = nil
+		}
+	}
+}
+
+// err returns the error of the context, once the operation has been cancelled.
+func (t *tracker) err() error {
+	return t.ctx.Err()
+}
+
+// reader returns a reader of r failing once the operation is cancelled.
+// When count is true, the bytes read are added to the progress.
+func (t *tracker) reader(r io.Reader, count bool) *trackedReader {
+	return &trackedReader{r: r, t: t, count: count}
+}
+
+type trackedReader struct {
+	r     io.Reader
+	t     *tracker
+	count bool
+	n     int64
+}
+
+func (r *trackedReader) Read(p []byte) (int, error) {
+	if err := r.t.err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.count {
+		r.t.add(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,135 @@
+package roe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// progressLog records the progress reported by an operation.
+type progressLog []Progress
+
+func (l *progressLog) record(p Progress) {
+	*l = append(*l, p)
+}
+
+// check verifies that the progress never goes past the total and ends with it.
+func (l progressLog) check(t *testing.T, name string, total int64) {
+	if len(l) == 0 {
+		t.Fatalf("%s: no progress reported", name)
+	}
+	for _, p := range l {
+		if p.Done > p.Total || p.FileDone > p.FileSize || p.Part > p.Parts {
+			t.Fatalf("%s: invalid progress %+v", name, p)
+		}
+	}
+	if last := l[len(l)-1]; last.Done != total || last.Total != total {
+		t.Errorf("%s: expected %d bytes, the last progress is %+v", name, total, last)
+	}
+}
+
+func Test_encryptDirProgress(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	// a file splitted in 3 parts, one compressed and one that does not compress
+	srcdir := filepath.Join(tmpdir, "src")
+	os.MkdirAll(filepath.Join(srcdir, "sub"), os.ModePerm)
+	createRandomFile(filepath.Join(srcdir, "split.bin"), 2500)
+	ioutil.WriteFile(filepath.Join(srcdir, "sub", "text.txt"), bytes.Repeat([]byte("roe "), 1000), 0644)
+	createRandomFile(filepath.Join(srcdir, "sub", "random.bin"), 900)
+	total := int64(2500 + 4000 + 900)
+
+	e, err := NewEncrypter(EncryptOptions{
+		Recipients:  []Recipient{NewPasswordRecipient("foobar", testKDFParams)},
+		Split:       1000,
+		Compression: CompressionParams{Algorithm: Deflate, Level: 9},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encdir := filepath.Join(tmpdir, "enc")
+	var encLog progressLog
+	if err := e.EncryptDir(context.Background(), srcdir, encdir, encLog.record); err != nil {
+		t.Fatal(err)
+	}
+	encLog.check(t, "encrypt", total)
+
+	// Part is 0 while the compression is tried
+	parts := map[int]bool{}
+	for _, p := range encLog {
+		if p.File == filepath.Join(srcdir, "split.bin") && p.Part > 0 {
+			parts[p.Part] = p.Parts == 3
+		}
+	}
+	if len(parts) != 3 || !parts[1] || !parts[2] || !parts[3] {
+		t.Errorf("expected the progress of 3 parts, got %v", parts)
+	}
+
+	imagesSize, _ := walkSize(encdir, HasBmpExt)
+	d, err := NewDecrypter(DecryptOptions{Identities: []Identity{NewPasswordIdentity("foobar")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decLog progressLog
+	if err := d.DecryptDir(context.Background(), encdir, filepath.Join(tmpdir, "dec"), decLog.record); err != nil {
+		t.Fatal(err)
+	}
+	decLog.check(t, "decrypt", imagesSize)
+}
+
+func Test_encryptFileCancel(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "clean.bin")
+	createRandomFile(cleanpath, 5*chunkSize)
+	e, err := NewEncrypter(EncryptOptions{Recipients: []Recipient{NewPasswordRecipient("foobar", testKDFParams)}, Split: 3 * chunkSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cancel while the second part is being encrypted
+	encdir := filepath.Join(tmpdir, "enc")
+	ctx, cancel := context.WithCancel(context.Background())
+	progress := func(p Progress) {
+		if p.Part == 2 && p.FileDone > 3*chunkSize {
+			cancel()
+		}
+	}
+	err = e.EncryptFile(ctx, cleanpath, encdir, progress)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if files, _ := ioutil.ReadDir(encdir); len(files) != 0 {
+		t.Errorf("the images of a cancelled encryption should be removed, found %d", len(files))
+	}
+
+	// cancel in the middle of the decryption
+	if err := e.EncryptFile(context.Background(), cleanpath, encdir, nil); err != nil {
+		t.Fatal(err)
+	}
+	decdir := filepath.Join(tmpdir, "dec")
+	os.MkdirAll(decdir, os.ModePerm)
+	ctx, cancel = context.WithCancel(context.Background())
+	progress = func(p Progress) {
+		if p.FileDone > 2*chunkSize {
+			cancel()
+		}
+	}
+	d, err := NewDecrypter(DecryptOptions{Identities: []Identity{NewPasswordIdentity("foobar")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.DecryptFile(ctx, filepath.Join(encdir, "clean.bin.1-2.bmp"), decdir, progress)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if files, _ := ioutil.ReadDir(decdir); len(files) != 0 {
+		t.Errorf("the file of a cancelled decryption should be removed, found %d", len(files))
+	}
+}
@@ -0,0 +1,304 @@
+package roe
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// fileKeySize is the size of the random key used to encrypt a payload
+// when it is encrypted to recipients.
+const fileKeySize = 32
+
+// wrappedKeySize is the size of a file key encrypted with chacha20poly1305 (key + tag)
+const wrappedKeySize = fileKeySize + 16
+
+// types of the stanzas of the payload header
+const (
+	stanzaX25519 uint8 = 1
+)
+
+// Recipient is a public key a file can be encrypted to.
+type Recipient interface {
+	// wrap encrypts the file key returning the stanza to be stored in the payload header
+	wrap(fileKey []byte) (stanza, error)
+	// coverMask returns the mask of the slot of the recipient in a cover, see coverEnvelope
+	coverMask(seed []byte) ([]byte, error)
+}
+
+// Identity is a private key able to decrypt the files encrypted to its Recipient.
+type Identity interface {
+	// unwrap returns the file key or errNoMatch when the stanza is not addressed to this identity
+	unwrap(s stanza) ([]byte, error)
+	// coverMask returns the mask of the cover slots opened by this identity, see coverEnvelope
+	coverMask(seed []byte) ([]byte, error)
+}
+
+// errNoMatch is returned by Identity.unwrap when the stanza is not addressed to the identity
+var errNoMatch = newError(ErrWrongKey, "no identity matches any of the recipients")
+
+const (
+	x25519RecipientPrefix = "roepk1"
+	x25519IdentityPrefix  = "ROE-SECRET-KEY-1"
+	x25519Info            = "roe/x25519"
+)
+
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// X25519Recipient is a Curve25519 public key.
+type X25519Recipient struct {
+	key []byte
+}
+
+// X25519Identity is a Curve25519 private key.
+type X25519Identity struct {
+	key       []byte
+	recipient *X25519Recipient
+}
+
+// GenerateX25519Identity returns a new random identity.
+func GenerateX25519Identity() (*X25519Identity, error) {
+	key := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return newX25519Identity(key)
+}
+
+func newX25519Identity(key []byte) (*X25519Identity, error) {
+	if len(key) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("invalid X25519 private key size %d", len(key))
+	}
+	pub, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Identity{key: key, recipient: &X25519Recipient{key: pub}}, nil
+}
+
+// ParseX25519Recipient parses a public key in the format returned by X25519Recipient.String.
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	if !strings.HasPrefix(s, x25519RecipientPrefix) {
+		return nil, fmt.Errorf("invalid recipient '%s'", s)
+	}
+	key, err := keyEncoding.DecodeString(strings.ToUpper(s[len(x25519RecipientPrefix):]))
+	if err != nil || len(key) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid recipient '%s'", s)
+	}
+	return &X25519Recipient{key: key}, nil
+}
+
+// ParseX25519Identity parses a private key in the format returned by X25519Identity.String.
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	if !strings.HasPrefix(s, x25519IdentityPrefix) {
+		return nil, fmt.Errorf("invalid identity")
+	}
+	key, err := keyEncoding.DecodeString(s[len(x25519IdentityPrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity")
+	}
+	return newX25519Identity(key)
+}
+
+// String returns the public key encoded as "roepk1" followed by its base32 representation.
+func (r *X25519Recipient) String() string {
+	return x25519RecipientPrefix + strings.ToLower(keyEncoding.EncodeToString(r.key))
+}
+
+// String returns the private key encoded as "ROE-SECRET-KEY-1" followed by its base32 representation.
+func (i *X25519Identity) String() string {
+	return x25519IdentityPrefix + keyEncoding.EncodeToString(i.key)
+}
+
+// Recipient returns the public key of the identity.
+func (i *X25519Identity) Recipient() *X25519Recipient {
+	return i.recipient
+}
+
+// x25519WrapKey derives the key used to wrap the file key from the shared secret,
+// binding it to both the ephemeral and the recipient public keys.
+func x25519WrapKey(shared, ephemeral, recipient []byte, info string) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeral)+len(recipient))
+	salt = append(salt, ephemeral...)
+	salt = append(salt, recipient...)
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// x25519Wrap encrypts the file key with a key agreed between a new ephemeral key and the
+// recipient, returning the ephemeral public key followed by the wrapped file key.
+func x25519Wrap(recipient, fileKey []byte, info string) ([]byte, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, err
+	}
+	ephemeralPub, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapKey, err := x25519WrapKey(shared, ephemeralPub, recipient, info)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// the wrap key is never reused, so the nonce can be zero
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Seal(ephemeralPub, nonce, fileKey, nil), nil
+}
+
+// x25519Unwrap is the inverse of x25519Wrap, key and pub are the private and public keys
+// of the recipient. It returns errNoMatch when body has not been wrapped for them.
+func x25519Unwrap(key, pub, body []byte, info string) ([]byte, error) {
+	if len(body) != curve25519.PointSize+wrappedKeySize {
+		return nil, errNoMatch
+	}
+	ephemeralPub := body[:curve25519.PointSize]
+
+	shared, err := curve25519.X25519(key, ephemeralPub)
+	if err != nil {
+		return nil, errNoMatch
+	}
+	wrapKey, err := x25519WrapKey(shared, ephemeralPub, pub, info)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	fileKey, err := aead.Open(nil, nonce, body[curve25519.PointSize:], nil)
+	if err != nil {
+		return nil, errNoMatch
+	}
+	return fileKey, nil
+}
+
+// wrap returns a stanza whose body is the ephemeral public key followed by the wrapped file key.
+func (r *X25519Recipient) wrap(fileKey []byte) (stanza, error) {
+	body, err := x25519Wrap(r.key, fileKey, x25519Info)
+	if err != nil {
+		return stanza{}, err
+	}
+	return stanza{Type: stanzaX25519, Body: body}, nil
+}
+
+func (i *X25519Identity) unwrap(s stanza) ([]byte, error) {
+	if s.Type != stanzaX25519 {
+		return nil, errNoMatch
+	}
+	return x25519Unwrap(i.key, i.recipient.key, s.Body, x25519Info)
+}
+
+// coverMask is derived from the public key.
+func (r *X25519Recipient) coverMask(seed []byte) ([]byte, error) {
+	return deriveCoverMask(r.key, seed)
+}
+
+func (i *X25519Identity) coverMask(seed []byte) ([]byte, error) {
+	return i.recipient.coverMask(seed)
+}
+
+// ParseRecipients reads a list of recipients, one per line; both roe public keys
+// and ssh public keys in the authorized_keys format are accepted.
+// Empty lines and lines starting with "#" are ignored.
+func ParseRecipients(r io.Reader) ([]Recipient, error) {
+	recipients := make([]Recipient, 0)
+
+	err := scanKeyLines(r, func(line string) error {
+		var recipient Recipient
+		var err error
+		if strings.HasPrefix(line, "ssh-") {
+			recipient, err = ParseSSHRecipient(line)
+		} else {
+			recipient, err = ParseX25519Recipient(line)
+		}
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, recipient)
+		return nil
+	})
+
+	return recipients, err
+}
+
+// ParseIdentities reads a list of identities, one per line, as written by roecli keygen.
+// Empty lines and lines starting with "#" are ignored.
+func ParseIdentities(r io.Reader) ([]Identity, error) {
+	ids := make([]Identity, 0)
+
+	err := scanKeyLines(r, func(line string) error {
+		id, err := ParseX25519Identity(line)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	})
+
+	return ids, err
+}
+
+func scanKeyLines(r io.Reader, fn func(line string) error) error {
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// identities is the list of keys tried, in order, on every stanza of a payload header.
+type identities []Identity
+
+// fileKey returns the file key wrapped in the first stanza matching one of the identities.
+func (ids identities) fileKey(h payloadHeader, limits KDFLimits) ([]byte, error) {
+	if err := checkPasswordSlots(h, ids, limits); err != nil {
+		return nil, err
+	}
+	for _, s := range h.Stanzas {
+		for _, id := range ids {
+			key, err := id.unwrap(s)
+			if err == errNoMatch {
+				continue
+			}
+			return key, err
+		}
+	}
+
+	// a more helpful error for the common case of a mistyped password
+	if err := wrongPasswordError(h, ids); err != nil {
+		return nil, err
+	}
+	return nil, errNoMatch
+}
@@ -0,0 +1,89 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func Test_x25519KeyEncoding(t *testing.T) {
+	id, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id2, err := ParseX25519Identity(id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id2.Recipient().String() != id.Recipient().String() {
+		t.Errorf("parsed identity has a different public key")
+	}
+
+	r, err := ParseX25519Recipient(id.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r.key, id.recipient.key) {
+		t.Errorf("parsed recipient differs")
+	}
+
+	for _, s := range []string{"", "roepk1", "roepk1aaaa", id.String()} {
+		if _, err := ParseX25519Recipient(s); err == nil {
+			t.Errorf("ParseX25519Recipient(%q) should fail", s)
+		}
+	}
+}
+
+func Test_parseRecipients(t *testing.T) {
+	id1, _ := GenerateX25519Identity()
+	id2, _ := GenerateX25519Identity()
+	file := "# team\n" + id1.Recipient().String() + "\n\n  " + id2.Recipient().String() + "  \n"
+
+	recipients, err := ParseRecipients(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 2 {
+		t.Errorf("expected 2 recipients, got %d", len(recipients))
+	}
+
+	if _, err := ParseRecipients(strings.NewReader("foobar\n")); err == nil {
+		t.Errorf("expected an error parsing an invalid recipient")
+	}
+}
+
+func Test_encryptToRecipients(t *testing.T) {
+	alice, _ := GenerateX25519Identity()
+	bob, _ := GenerateX25519Identity()
+	eve, _ := GenerateX25519Identity()
+
+	cleartext := []byte("hello alice and bob")
+	header, key, err := newPayloadHeader(rand.Reader, []Recipient{alice.Recipient(), bob.Recipient()}, DefaultCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := encrypt(rand.Reader, bytes.NewReader(cleartext), buffer, BMP, header, key, int64(len(cleartext))); err != nil {
+		t.Fatal(err)
+	}
+	enc := buffer.Bytes()
+
+	for _, id := range []*X25519Identity{alice, bob} {
+		out := bytes.NewBuffer(make([]byte, 0))
+		if err := decrypt(bytes.NewReader(enc), out, identities{eve, id}); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(out.Bytes(), cleartext) {
+			t.Errorf("decrypted data differs")
+		}
+	}
+
+	if err := decrypt(bytes.NewReader(enc), ioutil.Discard, identities{eve}); err != errNoMatch {
+		t.Errorf("expected %v, got %v", errNoMatch, err)
+	}
+	if err := decrypt(bytes.NewReader(enc), ioutil.Discard, identities{NewPasswordIdentity("foobar")}); err != errNoMatch {
+		t.Errorf("expected %v decrypting with a password, got %v", errNoMatch, err)
+	}
+}
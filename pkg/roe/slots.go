@@ -0,0 +1,400 @@
+package roe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// maxPasswordSlots is the maximum number of password slots of an image
+const maxPasswordSlots = 8
+
+// Slot describes one of the key slots stored in the header of an image.
+type Slot struct {
+	Index int
+	Type  string    // "password", "keyfile", "password+keyfile", "key", "x25519", "ssh-rsa" or "ssh-ed25519"
+	KDF   KDFParams // set only for password and keyfile slots
+}
+
+func (s Slot) String() string {
+	if s.KDF.Algorithm != 0 {
+		return fmt.Sprintf("%d: %s (%s)", s.Index, s.Type, s.KDF)
+	}
+	return fmt.Sprintf("%d: %s", s.Index, s.Type)
+}
+
+func newSlot(index int, s stanza) Slot {
+	slot := Slot{Index: index}
+
+	switch s.Type {
+	case stanzaPassword:
+		slot.Type = "password"
+		if len(s.Body) == passwordStanzaSize {
+			switch s.Body[1] {
+			case factorKeyfile:
+				slot.Type = "keyfile"
+			case factorPassword | factorKeyfile:
+				slot.Type = "password+keyfile"
+			}
+			var kdf kdfParams
+			binary.Read(bytes.NewReader(s.Body[2:]), binary.LittleEndian, &kdf)
+			slot.KDF, _ = kdfParamsFromHeader(s.Body[0], kdf)
+		}
+	case stanzaKey:
+		slot.Type = "key"
+	case stanzaX25519:
+		slot.Type = "x25519"
+	case stanzaSSHRSA:
+		slot.Type = "ssh-rsa"
+	case stanzaSSHEd25519:
+		slot.Type = "ssh-ed25519"
+	default:
+		slot.Type = fmt.Sprintf("unknown(%d)", s.Type)
+	}
+
+	return slot
+}
+
+// ListSlots returns the key slots of the given image. No key is needed,
+// but the slots are not authenticated either.
+func ListSlots(fp string) ([]Slot, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, data, err := openContainer(bufio.NewReader(f))
+	var header payloadHeader
+	if err == nil {
+		header, err = readPayloadHeader(data)
+	}
+	if errors.Is(err, ErrNotRoeImage) {
+		// the header can be in the pixels of a converted image, or in a cover
+		header, err = readImageHeader(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make([]Slot, 0, len(header.Stanzas))
+	for i, s := range header.Stanzas {
+		slots = append(slots, newSlot(i, s))
+	}
+	return slots, nil
+}
+
+// readImageHeader reads the payload header stored in the pixels of the image f, from its
+// beginning. The payloads hidden in a cover are not found, they need an identity.
+func readImageHeader(f *os.File) (payloadHeader, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return payloadHeader{}, err
+	}
+	img, err := decodeImage(f)
+	if err != nil {
+		return payloadHeader{}, errNotRoePayload
+	}
+	data, err := imageData(img, nil)
+	if err != nil {
+		return payloadHeader{}, err
+	}
+	return readPayloadHeader(data)
+}
+
+// AddSlot adds to the given image a slot wrapping its file key for the recipient,
+// for e.g. a NewPasswordRecipient. One of the ids must unlock an existing slot.
+// Only the header is rewritten, in every part when the file is splitted. The payloads
+// hidden in a cover get a slot of the cover for the recipient too.
+func AddSlot(fp string, ids []Identity, r Recipient) error {
+	return updateSlots(fp, ids, []Recipient{r}, func(h *payloadHeader, fileKey []byte) error {
+		if len(h.Stanzas) >= maxStanzas {
+			return fmt.Errorf("too many slots, the maximum is %d", maxStanzas)
+		}
+		if _, ok := r.(*passwordRecipient); ok && countStanzas(h.Stanzas, stanzaPassword) >= maxPasswordSlots {
+			return fmt.Errorf("too many password slots, the maximum is %d", maxPasswordSlots)
+		}
+		s, err := r.wrap(fileKey)
+		if err != nil {
+			return err
+		}
+		h.Stanzas = append(h.Stanzas, s)
+		return nil
+	})
+}
+
+// RemoveSlot removes the slot at index from the given image, as returned by ListSlots.
+// One of the ids must unlock one of the slots, and the last slot cannot be removed.
+// Only the header is rewritten, in every part when the file is splitted: the file key
+// does not change, so copies made before the removal can still be opened with the old slot.
+// The slots of a cover are left as they are, the removed recipient can still find the payload.
+func RemoveSlot(fp string, ids []Identity, index int) error {
+	return updateSlots(fp, ids, nil, func(h *payloadHeader, fileKey []byte) error {
+		if index < 0 || index >= len(h.Stanzas) {
+			return fmt.Errorf("slot %d does not exist", index)
+		}
+		if len(h.Stanzas) == 1 {
+			return fmt.Errorf("cannot remove the last slot")
+		}
+		h.Stanzas = append(h.Stanzas[:index:index], h.Stanzas[index+1:]...)
+		return nil
+	})
+}
+
+func countStanzas(stanzas []stanza, t uint8) int {
+	n := 0
+	for _, s := range stanzas {
+		if s.Type == t {
+			n++
+		}
+	}
+	return n
+}
+
+// updateSlots unlocks the header of fp with ids, calls fn to change its stanzas and writes
+// the new signed header to all the parts of fp, adding a slot for the recipients to the
+// covers. The parts are written to temporary files
+// first and renamed only when all of them have been rewritten, each old part being moved
+// to a backup first: when a rename fails the old parts are restored from the backups, and
+// after a crash the parts that were not replaced can be found in their "*.bak*" files.
+func updateSlots(fp string, ids []Identity, recipients []Recipient, fn func(h *payloadHeader, fileKey []byte) error) error {
+	paths := []string{fp}
+	if isSplittedName(fp) {
+		names, err := findSplitNames(fp)
+		if err != nil {
+			return err
+		}
+		paths = paths[:0]
+		for _, n := range names {
+			paths = append(paths, filepath.Join(filepath.Dir(fp), n.String()))
+		}
+	}
+
+	var header payloadHeader
+	var fileKey []byte
+	tmps := make([]string, 0, len(paths))
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+
+	for i, p := range paths {
+		tmp, err := rewriteHeader(p, ids, recipients, func(h payloadHeader) (payloadHeader, error) {
+			// unlock the first part, the others must share the same header
+			if i == 0 {
+				key, err := identities(ids).fileKey(h, DefaultKDFLimits)
+				if err != nil {
+					return h, err
+				}
+				if err := h.verify(key); err != nil {
+					return h, err
+				}
+				header, fileKey = h, key
+				if err := fn(&header, fileKey); err != nil {
+					return h, err
+				}
+				if err := header.sign(fileKey); err != nil {
+					return h, err
+				}
+				return header, nil
+			}
+			if err := h.verify(fileKey); err != nil {
+				return h, fmt.Errorf("'%s' is not part of the same file: %w", p, err)
+			}
+			return header, nil
+		})
+		if err != nil {
+			return err
+		}
+		tmps = append(tmps, tmp)
+	}
+
+	return replaceParts(paths, tmps)
+}
+
+// replaceParts renames each of the tmps to the matching path, restoring all the paths
+// when one of the renames fails. The old files are removed only at the end.
+func replaceParts(paths, tmps []string) (err error) {
+	backups := make([]string, 0, len(paths))
+	defer func() {
+		if err != nil {
+			for i, bak := range backups {
+				os.Rename(bak, paths[i])
+			}
+			return
+		}
+		for _, bak := range backups {
+			os.Remove(bak)
+		}
+	}()
+
+	for i, tmp := range tmps {
+		bak, err := ioutil.TempFile(filepath.Dir(paths[i]), filepath.Base(paths[i])+".bak")
+		if err != nil {
+			return err
+		}
+		bak.Close()
+		if err := os.Rename(paths[i], bak.Name()); err != nil {
+			os.Remove(bak.Name())
+			return err
+		}
+		backups = append(backups, bak.Name())
+		if err := os.Rename(tmp, paths[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteHeader writes a copy of the file fp to a temporary file in the same folder,
+// replacing its payload header with the one returned by fn. The encrypted data is copied
+// as is, the headers of the container and the random filler are written again since the
+// size of the payload header may have changed. The cover images are opened with ids and
+// get a slot for the recipients. It returns the path of the temporary file.
+func rewriteHeader(fp string, ids identities, recipients []Recipient, fn func(h payloadHeader) (payloadHeader, error)) (string, error) {
+	src, err := os.Open(fp)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	// read the headers and the clearsize
+	c, shape, data, err := openCarrier(src, ids, recipients)
+	if err != nil {
+		return "", fmt.Errorf("failed to read '%s': %w", fp, err)
+	}
+	header, err := readPayloadHeader(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to read '%s': %w", fp, err)
+	}
+	var clearsize uint64
+	if err := binary.Read(data, binary.LittleEndian, &clearsize); err != nil {
+		return "", readError(err, "failed to read the payload size of '%s'", fp)
+	}
+	if clearsize > maxPayloadSize {
+		return "", newError(ErrCorrupted, "invalid payload size %d in '%s'", clearsize, fp)
+	}
+	var part partInfo
+	if err := binary.Read(data, binary.LittleEndian, &part); err != nil {
+		return "", readError(err, "failed to read the payload part of '%s'", fp)
+	}
+	aead, err := newAEAD(Cipher(header.Cipher), make([]byte, 32))
+	if err != nil {
+		return "", err
+	}
+
+	header, err = fn(header)
+	if err != nil {
+		return "", err
+	}
+
+	dst, err := ioutil.TempFile(filepath.Dir(fp), filepath.Base(fp)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if fi, err := src.Stat(); err == nil {
+		dst.Chmod(fi.Mode())
+	}
+
+	// same layout written by encrypt, in the same container
+	hb := header.bytes()
+	datasize := streamOverhead(aead, int64(clearsize)) + int64(clearsize)
+	encsize := payloadSize(len(hb), aead, int64(clearsize))
+	if shape != nil {
+		ic := c.(shapedContainer)
+		switch {
+		case encsize <= shape.capacity():
+			c = ic.withShape(shape)
+		case shape.width == shape.height:
+			// the square images grow as needed, as when they are written
+			c = ic.withShape(nil)
+		default:
+			return "", fmt.Errorf("failed to update '%s': the header does not fit in the %dx%d image", fp, shape.width, shape.height)
+		}
+	}
+	w := bufio.NewWriterSize(dst, ioBufferSize)
+	cw, err := c.newWriter(w, encsize, rand.Reader)
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", fmt.Errorf("failed to update '%s': %w", fp, err)
+	}
+
+	cw.Write(hb)
+	binary.Write(cw, binary.LittleEndian, clearsize)
+	binary.Write(cw, binary.LittleEndian, part)
+	if _, err := io.CopyN(cw, data, datasize); err != nil {
+		os.Remove(dst.Name())
+		return "", readError(err, "failed to copy the payload of '%s'", fp)
+	}
+	err = cw.Close()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+
+	return dst.Name(), nil
+}
+
+// openCarrier opens the image src for rewriteHeader, it returns the container writing
+// the image in the same way and a reader of the payload. The payloads stored in the pixels
+// keep the size of the image, returned with the container. The ones hidden in a cover are
+// opened with ids and written in the same cover, keeping its slots and adding the ones of
+// the recipients. The converted images, or those of other formats, are not rewritten.
+func openCarrier(src *os.File, ids identities, recipients []Recipient) (Container, *imageShape, io.Reader, error) {
+	width, height, serr := imageSize(src)
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, nil, err
+	}
+	c, data, err := openContainer(bufio.NewReaderSize(src, ioBufferSize))
+	if err != nil && !errors.Is(err, ErrNotRoeImage) {
+		return nil, nil, nil, err
+	}
+	if err == nil {
+		var ok bool
+		if data, ok = payloadStart(data); ok {
+			if _, shaped := c.(shapedContainer); !shaped {
+				return c, nil, data, nil
+			}
+			if serr != nil {
+				return nil, nil, nil, serr
+			}
+			return c, &imageShape{width: width, height: height, fixed: true}, data, nil
+		}
+	}
+
+	// the payload is not in the pixels, it can be in the low bits of a cover
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, nil, err
+	}
+	img, err := decodeImage(src)
+	if err != nil {
+		return nil, nil, nil, errNotRoePayload
+	}
+	if env, data, err := openCoverEnvelope(newLsbReader(img), ids); err == nil && c != nil {
+		if data, ok := payloadStart(data); ok {
+			covers, err := newCoverContainers(c, []image.Image{img}, recipients)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			cc := covers[0].(coverContainer)
+			cc.envelope = env
+			return cc, nil, data, nil
+		}
+	}
+	if _, err := imageData(img, ids); err != nil {
+		return nil, nil, nil, errNotRoePayload
+	}
+	return nil, nil, nil, fmt.Errorf("unsupported carrier, the payload is stored in the pixels of a converted image: decrypt it and encrypt it again")
+}
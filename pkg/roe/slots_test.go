@@ -0,0 +1,224 @@
+package roe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_slots(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	// a file splitted in 3 parts
+	cleanpath := filepath.Join(tmpdir, "testfile")
+	clearbuf := createRandomFile(cleanpath, 3000)
+	encdir := filepath.Join(tmpdir, "enc")
+	if err := encryptFile(cleanpath, encdir, "alice", EncryptOptions{Split: 1000, Preserve: PreserveAll}); err != nil {
+		t.Fatal(err)
+	}
+	encpath := filepath.Join(encdir, "testfile.2-3.bmp")
+
+	decryptWith := func(password string) error {
+		decdir := filepath.Join(tmpdir, "dec")
+		defer os.RemoveAll(decdir)
+		os.MkdirAll(decdir, os.ModePerm)
+
+		if err := decryptFile(encpath, decdir, password); err != nil {
+			return err
+		}
+		decbuf, _ := ioutil.ReadFile(filepath.Join(decdir, "testfile"))
+		if !bytes.Equal(clearbuf, decbuf) {
+			t.Errorf("decrypted file and original file differs")
+		}
+		return nil
+	}
+
+	alice := []Identity{NewPasswordIdentity("alice")}
+	bob := []Identity{NewPasswordIdentity("bob")}
+
+	if err := AddSlot(encpath, bob, NewPasswordRecipient("eve", testKDFParams)); err == nil {
+		t.Errorf("adding a slot without a valid password should fail")
+	}
+	if err := AddSlot(encpath, alice, NewPasswordRecipient("bob", testKDFParams)); err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{"alice", "bob"} {
+		if err := decryptWith(password); err != nil {
+			t.Errorf("decrypting with %s: %v", password, err)
+		}
+	}
+
+	slots, err := ListSlots(filepath.Join(encdir, "testfile.3-3.bmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != 2 || slots[1].Type != "password" || slots[1].KDF != testKDFParams {
+		t.Errorf("unexpected slots %v", slots)
+	}
+
+	// revoke alice using bob's password
+	if err := RemoveSlot(encpath, bob, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptWith("alice"); !isWrongPassword(err) {
+		t.Errorf("expected %v, got %v", errWrongPassword, err)
+	}
+	if err := decryptWith("bob"); err != nil {
+		t.Error(err)
+	}
+	if err := RemoveSlot(encpath, bob, 0); err == nil {
+		t.Errorf("removing the last slot should fail")
+	}
+}
+
+func isWrongPassword(err error) bool {
+	return err != nil && strings.Contains(err.Error(), errWrongPassword.Error())
+}
+
+func Test_slotsKeepTheCarrier(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleanpath := filepath.Join(tmpdir, "testfile")
+	clearbuf := createRandomFile(cleanpath, 3000)
+	alice := []Identity{NewPasswordIdentity("alice")}
+	cover := newCover(200, 100)
+
+	for name, opts := range map[string]EncryptOptions{
+		"dimensions": {Dimensions: Dimensions{MaxWidth: 200, Aspect: 3}},
+		"png cover":  {Container: PNG, Covers: []image.Image{cover}},
+		"bmp cover":  {Covers: []image.Image{cover}},
+	} {
+		opts.Recipients = []Recipient{NewPasswordRecipient("alice", testKDFParams)}
+		e, err := NewEncrypter(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encdir := filepath.Join(tmpdir, "enc-"+name)
+		if err := e.EncryptFile(context.Background(), cleanpath, encdir, nil); err != nil {
+			t.Fatal(err)
+		}
+		files, _ := ioutil.ReadDir(encdir)
+		encpath := filepath.Join(encdir, files[0].Name())
+		before := readImage(t, encpath)
+
+		if err := AddSlot(encpath, alice, NewPasswordRecipient("bob", testKDFParams)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		after := readImage(t, encpath)
+		if after.Bounds() != before.Bounds() {
+			t.Errorf("%s: the image is %v, it was %v", name, after.Bounds(), before.Bounds())
+		}
+		if opts.Covers != nil {
+			// only the lowest bits of the colors of the cover change
+			for i, p := range toNRGBA(after).Pix {
+				if p|1 != cover.Pix[i]|1 {
+					t.Fatalf("%s: the image differs from its cover at %d", name, i)
+				}
+			}
+		}
+		slots, err := ListSlots(encpath)
+		switch {
+		case opts.Covers != nil && !errors.Is(err, ErrNotRoeImage):
+			// the covers cannot be told from images without a payload
+			t.Errorf("%s: expected %v, got %v", name, ErrNotRoeImage, err)
+		case opts.Covers == nil && (err != nil || len(slots) != 2):
+			t.Errorf("%s: unexpected slots %v, %v", name, slots, err)
+		}
+
+		// the cover keeps the slot of alice and gets one for bob
+		for _, password := range []string{"alice", "bob"} {
+			decdir := filepath.Join(tmpdir, "dec-"+name+"-"+password)
+			os.MkdirAll(decdir, os.ModePerm)
+			if err := decryptFile(encpath, decdir, password); err != nil {
+				t.Fatalf("%s: %s: %v", name, password, err)
+			}
+			decbuf, _ := ioutil.ReadFile(filepath.Join(decdir, "testfile"))
+			if !bytes.Equal(clearbuf, decbuf) {
+				t.Errorf("%s: decrypted file and original file differs", name)
+			}
+		}
+	}
+
+	// the pixels of a bmp image converted to png are not rewritten
+	encdir := filepath.Join(tmpdir, "enc")
+	if err := encryptFile(cleanpath, encdir, "alice", EncryptOptions{Split: MaxSplit}); err != nil {
+		t.Fatal(err)
+	}
+	converted := filepath.Join(tmpdir, "converted.png")
+	f, _ := os.Create(converted)
+	png.Encode(f, readImage(t, filepath.Join(encdir, "testfile.bmp")))
+	f.Close()
+	if err := AddSlot(converted, alice, NewPasswordRecipient("bob", testKDFParams)); err == nil || !strings.Contains(err.Error(), "unsupported carrier") {
+		t.Errorf("expected an unsupported carrier error, got %v", err)
+	}
+	if slots, err := ListSlots(converted); err != nil || len(slots) != 1 {
+		t.Errorf("converted: unexpected slots %v, %v", slots, err)
+	}
+}
+
+// readImage decodes the image fp.
+func readImage(t *testing.T, fp string) image.Image {
+	f, err := os.Open(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := decodeImage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func Test_replacePartsRestores(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	paths := make([]string, 3)
+	tmps := make([]string, 3)
+	for i := range paths {
+		paths[i] = filepath.Join(tmpdir, fmt.Sprintf("testfile.%d-3.bmp", i+1))
+		tmps[i] = paths[i] + ".tmp"
+		ioutil.WriteFile(paths[i], []byte("old"), 0600)
+		ioutil.WriteFile(tmps[i], []byte("new"), 0600)
+	}
+
+	// the last rename fails, the first two parts must be restored
+	os.Remove(tmps[2])
+	if err := replaceParts(paths, tmps); err == nil {
+		t.Fatal("replacing a missing part should fail")
+	}
+	for _, p := range paths {
+		if data, _ := ioutil.ReadFile(p); string(data) != "old" {
+			t.Errorf("'%s' has not been restored: %q", p, data)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmpdir, "*.bak*")); len(files) > 0 {
+		t.Errorf("backups left: %v", files)
+	}
+
+	for _, tmp := range tmps {
+		ioutil.WriteFile(tmp, []byte("new"), 0600)
+	}
+	if err := replaceParts(paths, tmps); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		if data, _ := ioutil.ReadFile(p); string(data) != "new" {
+			t.Errorf("'%s' has not been replaced: %q", p, data)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmpdir, "*")); len(files) != 3 {
+		t.Errorf("unexpected files %v", files)
+	}
+}
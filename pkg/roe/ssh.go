@@ -0,0 +1,230 @@
+package roe
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// types of the stanzas wrapping the file key for ssh keys
+const (
+	stanzaSSHRSA     uint8 = 2
+	stanzaSSHEd25519 uint8 = 3
+)
+
+const (
+	sshRSALabel    = "roe/ssh-rsa"
+	sshEd25519Info = "roe/ssh-ed25519"
+)
+
+// sshTagSize is the size of the key fingerprint stored at the beginning of the ssh stanzas,
+// used to skip the stanzas addressed to other keys without trying to decrypt them.
+const sshTagSize = 4
+
+func sshTag(pk ssh.PublicKey) []byte {
+	h := sha256.Sum256(pk.Marshal())
+	return h[:sshTagSize]
+}
+
+// ParseSSHRecipient parses an ssh-ed25519 or ssh-rsa public key in the authorized_keys format,
+// for e.g. the content of ~/.ssh/id_ed25519.pub.
+func ParseSSHRecipient(s string) (Recipient, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh public key: %v", err)
+	}
+
+	switch pk.Type() {
+	case ssh.KeyAlgoRSA:
+		rsaKey := pk.(ssh.CryptoPublicKey).CryptoPublicKey().(*rsa.PublicKey)
+		if rsaKey.Size() < 2048/8 {
+			return nil, fmt.Errorf("ssh-rsa keys shorter than 2048 bits are not supported")
+		}
+		return &sshRSARecipient{sshKey: pk, key: rsaKey}, nil
+	case ssh.KeyAlgoED25519:
+		edKey := pk.(ssh.CryptoPublicKey).CryptoPublicKey().(ed25519.PublicKey)
+		x, err := ed25519PublicKeyToCurve25519(edKey)
+		if err != nil {
+			return nil, err
+		}
+		return &sshEd25519Recipient{sshKey: pk, key: x}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported ssh key type %s", pk.Type())
+}
+
+// ParseSSHIdentity parses an ssh-ed25519 or ssh-rsa private key in PEM or OpenSSH format,
+// for e.g. the content of ~/.ssh/id_ed25519. When the key is protected, passphrase is
+// called to get the passphrase; passphrase can be nil for unprotected keys.
+func ParseSSHIdentity(pemBytes []byte, passphrase func() ([]byte, error)) (Identity, error) {
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok && passphrase != nil {
+		var p []byte
+		if p, err = passphrase(); err != nil {
+			return nil, err
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh private key: %v", err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		pk, err := ssh.NewPublicKey(&k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &sshRSAIdentity{tag: sshTag(pk), key: k}, nil
+	case *ed25519.PrivateKey:
+		return newSSHEd25519Identity(*k)
+	case ed25519.PrivateKey:
+		return newSSHEd25519Identity(k)
+	}
+
+	return nil, fmt.Errorf("unsupported ssh private key type %T", key)
+}
+
+// sshRSARecipient wraps the file key with RSA-OAEP-SHA256.
+type sshRSARecipient struct {
+	sshKey ssh.PublicKey
+	key    *rsa.PublicKey
+}
+
+func (r *sshRSARecipient) wrap(fileKey []byte) (stanza, error) {
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, r.key, fileKey, []byte(sshRSALabel))
+	if err != nil {
+		return stanza{}, err
+	}
+	body := append(sshTag(r.sshKey), wrapped...)
+	return stanza{Type: stanzaSSHRSA, Body: body}, nil
+}
+
+type sshRSAIdentity struct {
+	tag []byte
+	key *rsa.PrivateKey
+}
+
+func (i *sshRSAIdentity) unwrap(s stanza) ([]byte, error) {
+	if s.Type != stanzaSSHRSA || len(s.Body) <= sshTagSize || string(s.Body[:sshTagSize]) != string(i.tag) {
+		return nil, errNoMatch
+	}
+	fileKey, err := rsa.DecryptOAEP(sha256.New(), nil, i.key, s.Body[sshTagSize:], []byte(sshRSALabel))
+	if err != nil {
+		return nil, errNoMatch
+	}
+	return fileKey, nil
+}
+
+// coverMask is derived from the wire encoding of the public key.
+func (r *sshRSARecipient) coverMask(seed []byte) ([]byte, error) {
+	return deriveCoverMask(r.sshKey.Marshal(), seed)
+}
+
+func (i *sshRSAIdentity) coverMask(seed []byte) ([]byte, error) {
+	pk, err := ssh.NewPublicKey(&i.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return deriveCoverMask(pk.Marshal(), seed)
+}
+
+// sshEd25519Recipient converts the ed25519 key to its curve25519 equivalent and
+// then wraps the file key like X25519Recipient does.
+type sshEd25519Recipient struct {
+	sshKey ssh.PublicKey
+	key    []byte
+}
+
+func (r *sshEd25519Recipient) wrap(fileKey []byte) (stanza, error) {
+	wrapped, err := x25519Wrap(r.key, fileKey, sshEd25519Info)
+	if err != nil {
+		return stanza{}, err
+	}
+	body := append(sshTag(r.sshKey), wrapped...)
+	return stanza{Type: stanzaSSHEd25519, Body: body}, nil
+}
+
+type sshEd25519Identity struct {
+	tag    []byte
+	key    []byte
+	pubKey []byte
+}
+
+func newSSHEd25519Identity(k ed25519.PrivateKey) (*sshEd25519Identity, error) {
+	pk, err := ssh.NewPublicKey(k.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	// the curve25519 scalar is the first half of the sha512 of the seed, see RFC 8032
+	h := sha512.Sum512(k.Seed())
+	key := h[:curve25519.ScalarSize]
+	pub, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshEd25519Identity{tag: sshTag(pk), key: key, pubKey: pub}, nil
+}
+
+func (i *sshEd25519Identity) unwrap(s stanza) ([]byte, error) {
+	if s.Type != stanzaSSHEd25519 || len(s.Body) < sshTagSize || string(s.Body[:sshTagSize]) != string(i.tag) {
+		return nil, errNoMatch
+	}
+	return x25519Unwrap(i.key, i.pubKey, s.Body[sshTagSize:], sshEd25519Info)
+}
+
+// coverMask is derived from the curve25519 public key.
+func (r *sshEd25519Recipient) coverMask(seed []byte) ([]byte, error) {
+	return deriveCoverMask(r.key, seed)
+}
+
+func (i *sshEd25519Identity) coverMask(seed []byte) ([]byte, error) {
+	return deriveCoverMask(i.pubKey, seed)
+}
+
+// curve25519P is the prime 2^255 - 19
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// ed25519PublicKeyToCurve25519 converts the y coordinate of an ed25519 public key
+// to the u coordinate of the birationally equivalent curve25519 point: u = (1 + y) / (1 - y).
+func ed25519PublicKeyToCurve25519(pk ed25519.PublicKey) ([]byte, error) {
+	if len(pk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key size %d", len(pk))
+	}
+
+	// the key is little-endian, with the sign of x in the most significant bit
+	be := make([]byte, len(pk))
+	for i := range pk {
+		be[len(pk)-1-i] = pk[i]
+	}
+	be[0] &= 0x7f
+	y := new(big.Int).SetBytes(be)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+
+	num := new(big.Int).Add(big.NewInt(1), y)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+	u := num.Mul(num, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+
+	out := make([]byte, curve25519.PointSize)
+	ub := u.Bytes()
+	for i := range ub {
+		out[i] = ub[len(ub)-1-i]
+	}
+	return out, nil
+}
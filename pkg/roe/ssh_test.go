@@ -0,0 +1,107 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newSSHKeyPair returns the authorized_keys line and the PEM encoded private key of key.
+func newSSHKeyPair(t *testing.T, key interface{}) (string, []byte) {
+	var pub interface{}
+	var block *pem.Block
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		pub = &k.PublicKey
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case ed25519.PrivateKey:
+		pub = k.Public()
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+
+	pk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(ssh.MarshalAuthorizedKey(pk)), pem.EncodeToMemory(block)
+}
+
+func Test_encryptToSSHRecipients(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for _, key := range []interface{}{rsaKey, edKey} {
+		pub, priv := newSSHKeyPair(t, key)
+		_, otherPriv := newSSHKeyPair(t, otherKey)
+
+		recipient, err := ParseSSHRecipient(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		identity, err := ParseSSHIdentity(priv, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := ParseSSHIdentity(otherPriv, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cleartext := []byte(fmt.Sprintf("hello %T", key))
+		header, fileKey, err := newPayloadHeader(rand.Reader, []Recipient{recipient}, DefaultCipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffer := bytes.NewBuffer(make([]byte, 0))
+		if err := encrypt(rand.Reader, bytes.NewReader(cleartext), buffer, BMP, header, fileKey, int64(len(cleartext))); err != nil {
+			t.Fatal(err)
+		}
+
+		out := bytes.NewBuffer(make([]byte, 0))
+		if err := decrypt(bytes.NewReader(buffer.Bytes()), out, identities{other, identity}); err != nil {
+			t.Errorf("%T: %v", key, err)
+		} else if !bytes.Equal(out.Bytes(), cleartext) {
+			t.Errorf("%T: decrypted data differs", key)
+		}
+
+		if err := decrypt(bytes.NewReader(buffer.Bytes()), ioutil.Discard, identities{other}); err != errNoMatch {
+			t.Errorf("%T: expected %v, got %v", key, errNoMatch, err)
+		}
+	}
+}
+
+func Test_parseSSHIdentityWithPassphrase(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv := pem.EncodeToMemory(block)
+
+	if _, err := ParseSSHIdentity(priv, nil); err == nil {
+		t.Errorf("expected an error parsing a protected key without passphrase")
+	}
+
+	asked := false
+	_, err = ParseSSHIdentity(priv, func() ([]byte, error) {
+		asked = true
+		return []byte("secret"), nil
+	})
+	if err != nil || !asked {
+		t.Errorf("expected the passphrase to be asked and the key to be parsed, err: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package roe
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// chunkSize is the size of the plaintext of each chunk of the payload.
+// Every chunk is authenticated independently, so that decrypt never
+// writes bytes that have not been verified.
+const chunkSize = 64 * 1024
+
+// ioBufferSize is the size of the buffers between the files and the chunks, so that
+// an image is read and written with a few large syscalls instead of one per chunk
+// or per header field.
+const ioBufferSize = 1024 * 1024
+
+// bufferSize returns the size of the buffer for size bytes of data, small images
+// do not need a large buffer.
+func bufferSize(size int64) int {
+	if size < 4096 {
+		return 4096
+	}
+	if size > ioBufferSize {
+		return ioBufferSize
+	}
+	return int(size)
+}
+
+// stream implements the STREAM construction (Hoang, Reyhanitabar, Rogaway, Vizár)
+// on top of an AEAD: the nonce of each chunk is made of a random prefix, a 32 bits
+// big-endian counter and a final byte set to 1 only for the last chunk.
+// Reordering chunks changes their counter, dropping the last ones removes the
+// final flag, in both cases authentication fails.
+type stream struct {
+	aead    cipher.AEAD
+	nonce   []byte
+	ad      []byte
+	counter uint32
+	done    bool
+}
+
+// streamPrefixSize returns the size of the random nonce prefix written before the chunks.
+func streamPrefixSize(aead cipher.AEAD) int {
+	return aead.NonceSize() - 5
+}
+
+// streamOverhead returns the number of bytes added by the stream to size bytes of plaintext.
+func streamOverhead(aead cipher.AEAD, size int64) int64 {
+	return int64(streamPrefixSize(aead)) + streamChunks(size)*int64(aead.Overhead())
+}
+
+// streamChunks returns the number of chunks needed to encrypt size bytes;
+// even an empty plaintext has a final chunk.
+func streamChunks(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + chunkSize - 1) / chunkSize
+}
+
+// newStream returns a stream using the given nonce prefix. The additional data ad is
+// authenticated along with every chunk.
+func newStream(aead cipher.AEAD, prefix []byte, ad []byte) (*stream, error) {
+	if len(prefix) != streamPrefixSize(aead) {
+		return nil, fmt.Errorf("invalid nonce prefix size %d", len(prefix))
+	}
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, prefix)
+	return &stream{aead: aead, nonce: nonce, ad: ad}, nil
+}
+
+func (s *stream) next(last bool) ([]byte, error) {
+	if s.done {
+		return nil, fmt.Errorf("stream already finished")
+	}
+	if s.counter == ^uint32(0) {
+		return nil, fmt.Errorf("stream too long")
+	}
+	n := len(s.nonce)
+	binary.BigEndian.PutUint32(s.nonce[n-5:n-1], s.counter)
+	s.nonce[n-1] = 0
+	if last {
+		s.nonce[n-1] = 1
+		s.done = true
+	}
+	s.counter++
+	return s.nonce, nil
+}
+
+// seal encrypts the next chunk appending the result to dst.
+func (s *stream) seal(dst, chunk []byte, last bool) ([]byte, error) {
+	nonce, err := s.next(last)
+	if err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(dst, nonce, chunk, s.ad), nil
+}
+
+// open decrypts and authenticates the next chunk appending the result to dst.
+func (s *stream) open(dst, chunk []byte, last bool) ([]byte, error) {
+	nonce, err := s.next(last)
+	if err != nil {
+		return nil, err
+	}
+	clear, err := s.aead.Open(dst, nonce, chunk, s.ad)
+	if err != nil {
+		return nil, errAuthFailed
+	}
+	return clear, nil
+}
+
+// encrypt reads exactly size bytes from src and writes them encrypted to dst.
+func (s *stream) encrypt(src io.Reader, dst io.Writer, size int64) error {
+	buf := make([]byte, chunkSize, chunkSize+s.aead.Overhead())
+
+	for chunks := streamChunks(size); chunks > 0; chunks-- {
+		n := int64(chunkSize)
+		if size < n {
+			n = size
+		}
+		if _, err := io.ReadFull(src, buf[:n]); err != nil {
+			return fmt.Errorf("failed to read %d bytes: %w", n, err)
+		}
+		size -= n
+
+		enc, err := s.seal(buf[:0], buf[:n], chunks == 1)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(enc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decrypt reads the chunks holding size bytes of plaintext from src, writing each one
+// to dst only after it has been authenticated.
+func (s *stream) decrypt(src io.Reader, dst io.Writer, size int64) error {
+	_, err := io.Copy(dst, s.reader(src, size))
+	return err
+}
+
+// streamReader decrypts the chunks read from src on demand.
+type streamReader struct {
+	s       *stream
+	src     io.Reader
+	size    int64
+	chunks  int64
+	written int64
+	buf     []byte
+	clear   []byte
+	err     error
+}
+
+// reader returns a reader of the size bytes of plaintext held by the chunks read from src,
+// each chunk is returned only after it has been authenticated.
+func (s *stream) reader(src io.Reader, size int64) *streamReader {
+	return &streamReader{
+		s:      s,
+		src:    src,
+		size:   size,
+		chunks: streamChunks(size),
+		buf:    make([]byte, chunkSize+s.aead.Overhead()),
+	}
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.clear) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.clear)
+	r.clear = r.clear[n:]
+	return n, nil
+}
+
+// WriteTo writes the chunks to w as they are decrypted, without copying them to an
+// intermediate buffer. io.Copy uses it.
+func (r *streamReader) WriteTo(w io.Writer) (int64, error) {
+	written := int64(0)
+	for {
+		if len(r.clear) > 0 {
+			n, err := w.Write(r.clear)
+			r.clear = r.clear[n:]
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+		if r.err != nil {
+			if r.err == io.EOF {
+				return written, nil
+			}
+			return written, r.err
+		}
+		r.err = r.next()
+	}
+}
+
+// next reads and decrypts the next chunk, it returns io.EOF after the last one.
+func (r *streamReader) next() error {
+	if r.chunks == 0 {
+		return io.EOF
+	}
+	n := int64(chunkSize)
+	if r.size-r.written < n {
+		n = r.size - r.written
+	}
+	n += int64(r.s.aead.Overhead())
+	if _, err := io.ReadFull(r.src, r.buf[:n]); err != nil {
+		return readError(err, "failed to read %d bytes, %d bytes were decrypted", n, r.written)
+	}
+
+	clear, err := r.s.open(r.buf[:0], r.buf[:n], r.chunks == 1)
+	if err != nil {
+		return err
+	}
+	r.chunks--
+	r.clear = clear
+	r.written += int64(len(clear))
+	return nil
+}
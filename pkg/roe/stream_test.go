@@ -0,0 +1,80 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+// sealChunks encrypts size random bytes with a new stream, returning the plaintext
+// and the encrypted chunks.
+func sealChunks(t *testing.T, key, prefix []byte, size int) ([]byte, [][]byte) {
+	aead, _ := newAEAD(DefaultCipher, key)
+	s, err := newStream(aead, prefix, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clear := make([]byte, size)
+	rand.Read(clear)
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err := s.encrypt(bytes.NewReader(clear), buf, int64(size)); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := make([][]byte, 0)
+	for enc := buf.Bytes(); len(enc) > 0; {
+		n := chunkSize + aead.Overhead()
+		if n > len(enc) {
+			n = len(enc)
+		}
+		chunks = append(chunks, enc[:n])
+		enc = enc[n:]
+	}
+	return clear, chunks
+}
+
+func Test_streamRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	prefix := make([]byte, 7)
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 100} {
+		clear, chunks := sealChunks(t, key, prefix, size)
+
+		aead, _ := newAEAD(DefaultCipher, key)
+		s, _ := newStream(aead, prefix, nil)
+		out := bytes.NewBuffer(make([]byte, 0))
+		if err := s.decrypt(bytes.NewReader(bytes.Join(chunks, nil)), out, int64(size)); err != nil {
+			t.Errorf("size %d: %v", size, err)
+		} else if !bytes.Equal(out.Bytes(), clear) {
+			t.Errorf("size %d: decrypted data differs", size)
+		}
+	}
+}
+
+func Test_streamReorderAndTruncate(t *testing.T) {
+	key := make([]byte, 32)
+	prefix := make([]byte, 7)
+	size := 3 * chunkSize
+	_, chunks := sealChunks(t, key, prefix, size)
+
+	open := func(data []byte, size int) error {
+		aead, _ := newAEAD(DefaultCipher, key)
+		s, _ := newStream(aead, prefix, nil)
+		return s.decrypt(bytes.NewReader(data), ioutil.Discard, int64(size))
+	}
+
+	// swap the first two chunks
+	reordered := bytes.Join([][]byte{chunks[1], chunks[0], chunks[2]}, nil)
+	if err := open(reordered, size); err != errAuthFailed {
+		t.Errorf("reordering: expected %v, got %v", errAuthFailed, err)
+	}
+
+	// drop the last chunk, pretending the stream had only two
+	truncated := bytes.Join(chunks[:2], nil)
+	if err := open(truncated, 2*chunkSize); err != errAuthFailed {
+		t.Errorf("truncation: expected %v, got %v", errAuthFailed, err)
+	}
+}
@@ -0,0 +1,210 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// NewEncryptWriter returns a writer encrypting the data written to it to the recipients,
+// using the cipher c. The size of the image depends on the size of the data, so nothing
+// is written to dst until Close, which writes the complete bmp image (see
+// Encrypter.NewWriter for the other formats).
+// Meanwhile the data is kept encrypted with an ephemeral key, in memory and then in a
+// temporary file when it gets larger. The data must fit in a single image, about 4 GiB.
+func NewEncryptWriter(dst io.Writer, recipients []Recipient, c Cipher) (io.WriteCloser, error) {
+	e, err := NewEncrypter(EncryptOptions{Recipients: recipients, Cipher: c})
+	if err != nil {
+		return nil, err
+	}
+	return e.NewWriter(dst)
+}
+
+type encryptWriter struct {
+	dst       io.Writer
+	rand      io.Reader
+	container Container
+	header    payloadHeader
+	fileKey   []byte
+	spool     *spool
+	err       error
+}
+
+var errWriterClosed = fmt.Errorf("the writer is closed")
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if max := w.container.Capacity(); w.spool.size+int64(len(p)) > max {
+		w.err = fmt.Errorf("too much data, a single %s file holds about %d bytes", w.container.Name(), max)
+		return 0, w.err
+	}
+	n, err := w.spool.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Close encrypts the data written so far and writes the image to dst.
+// It does not close dst.
+func (w *encryptWriter) Close() error {
+	if w.err == errWriterClosed {
+		return w.err
+	}
+	defer w.spool.close()
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errWriterClosed
+
+	src, err := w.spool.reader()
+	if err != nil {
+		return err
+	}
+	return encrypt(w.rand, src, w.dst, w.container, w.header, w.fileKey, w.spool.size)
+}
+
+// spoolMemory is the amount of data a spool keeps in memory before moving to a temporary file.
+const spoolMemory = 4 * 1024 * 1024
+
+// spool holds data of unknown size encrypted with an ephemeral key, chunk by chunk.
+type spool struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	s       *stream
+	pending []byte
+	mem     bytes.Buffer
+	f       *os.File
+	size    int64
+}
+
+func newSpool() (*spool, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key is never reused, a zero prefix is fine
+	prefix := make([]byte, streamPrefixSize(aead))
+	s, err := newStream(aead, prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &spool{aead: aead, prefix: prefix, s: s, pending: make([]byte, 0, chunkSize+aead.Overhead())}, nil
+}
+
+func (sp *spool) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is sealed only when more data follows, the last one is sealed by reader
+		if len(sp.pending) == chunkSize {
+			if err := sp.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := chunkSize - len(sp.pending)
+		if n > len(p) {
+			n = len(p)
+		}
+		sp.pending = append(sp.pending, p[:n]...)
+		p = p[n:]
+		written += n
+		sp.size += int64(n)
+	}
+	return written, nil
+}
+
+// seal encrypts the pending chunk and stores it.
+func (sp *spool) seal(last bool) error {
+	enc, err := sp.s.seal(sp.pending[:0], sp.pending, last)
+	if err != nil {
+		return err
+	}
+	sp.pending = sp.pending[:0]
+
+	if sp.f == nil && sp.mem.Len()+len(enc) > spoolMemory {
+		if sp.f, err = ioutil.TempFile("", "roe-spool-*"); err != nil {
+			return err
+		}
+		if _, err := sp.mem.WriteTo(sp.f); err != nil {
+			return err
+		}
+	}
+	if sp.f != nil {
+		_, err = sp.f.Write(enc)
+		return err
+	}
+	sp.mem.Write(enc)
+	return nil
+}
+
+// reader seals the last chunk and returns a reader of the data written to the spool.
+func (sp *spool) reader() (io.Reader, error) {
+	if err := sp.seal(true); err != nil {
+		return nil, err
+	}
+	return sp.section(0, sp.size)
+}
+
+// section returns a reader of n bytes of the data written to the spool, starting at off.
+// The last chunk must have been sealed; the sections can be read concurrently, each one
+// decrypting the chunks it covers.
+func (sp *spool) section(off, n int64) (io.Reader, error) {
+	var src io.ReaderAt = bytes.NewReader(sp.mem.Bytes())
+	if sp.f != nil {
+		src = sp.f
+	}
+
+	// start from the chunk holding off, its counter is its index
+	first := off / chunkSize
+	s, err := newStream(sp.aead, sp.prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.counter = uint32(first)
+	encoff := first * int64(chunkSize+sp.aead.Overhead())
+	r := s.reader(io.NewSectionReader(src, encoff, math.MaxInt64-encoff), sp.size-first*chunkSize)
+	if _, err := io.CopyN(ioutil.Discard, r, off-first*chunkSize); err != nil {
+		return nil, err
+	}
+	return io.LimitReader(r, n), nil
+}
+
+// close removes the temporary file, if any.
+func (sp *spool) close() {
+	if sp.f != nil {
+		sp.f.Close()
+		os.Remove(sp.f.Name())
+		sp.f = nil
+	}
+	sp.mem.Reset()
+}
+
+// NewDecryptReader reads the headers of the image read from src, unwrapping the file key
+// with ids, and returns a reader of the decrypted data. Every chunk of data is returned
+// only after it has been authenticated, reading stops at the end of the payload and the
+// rest of the image is left unread. A converted image (see DecryptFile) is read and
+// decoded entirely first.
+// Each part of a splitted file is a separate image; compressed files are decompressed,
+// but the parts of a compressed splitted file can only be decrypted with DecryptFile.
+// Close releases the resources of the reader, it does not close src.
+func NewDecryptReader(src io.Reader, ids []Identity) (io.ReadCloser, error) {
+	d, err := NewDecrypter(DecryptOptions{Identities: ids})
+	if err != nil {
+		return nil, err
+	}
+	return d.NewReader(src)
+}
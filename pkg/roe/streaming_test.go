@@ -0,0 +1,156 @@
+package roe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_encryptWriterAndDecryptReader(t *testing.T) {
+	recipients := []Recipient{NewPasswordRecipient("foobar", testKDFParams)}
+	ids := []Identity{NewPasswordIdentity("foobar")}
+
+	// the last size does not fit in memory, the writer moves to a temporary file
+	for _, size := range []int{0, 1, chunkSize, chunkSize + 1, spoolMemory + chunkSize + 3} {
+		cleartext := make([]byte, size)
+		rand.Read(cleartext)
+
+		buffer := bytes.NewBuffer(make([]byte, 0))
+		w, err := NewEncryptWriter(buffer, recipients, DefaultCipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// write in pieces not aligned to the chunks
+		for p := cleartext; len(p) > 0; {
+			n := 1000
+			if n > len(p) {
+				n = len(p)
+			}
+			w.Write(p[:n])
+			p = p[n:]
+		}
+		if buffer.Len() != 0 {
+			t.Errorf("%d bytes: nothing should be written before Close", size)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte{1}); err == nil {
+			t.Errorf("%d bytes: write after Close should fail", size)
+		}
+
+		// the output is a complete image
+		var h bmpHeader
+		binary.Read(bytes.NewReader(buffer.Bytes()), binary.LittleEndian, &h)
+		if int(h.FileSize) != buffer.Len() {
+			t.Errorf("%d bytes: the image is %d bytes, its header says %d", size, buffer.Len(), h.FileSize)
+		}
+
+		r, err := NewDecryptReader(bytes.NewReader(buffer.Bytes()), ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, cleartext) {
+			t.Errorf("%d bytes: decrypted data differs", size)
+		}
+	}
+}
+
+func Test_decryptReaderErrors(t *testing.T) {
+	enc := encryptTo(t, []byte("hello reader"), NewPasswordRecipient("foobar", testKDFParams))
+
+	if _, err := NewDecryptReader(bytes.NewReader(enc), []Identity{NewPasswordIdentity("wrong")}); err != errWrongPassword {
+		t.Errorf("expected %v, got %v", errWrongPassword, err)
+	}
+
+	// flip a bit of the encrypted data, the error comes from Read
+	header, err := readPayloadHeader(bytes.NewReader(enc[54:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc[54+len(header.bytes())+8+7] ^= 1
+	r, err := NewDecryptReader(bytes.NewReader(enc), []Identity{NewPasswordIdentity("foobar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != errAuthFailed {
+		t.Errorf("expected %v, got %v", errAuthFailed, err)
+	}
+}
+
+func Test_decryptReaderCompressed(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "roe")
+	defer os.RemoveAll(tmpdir)
+
+	cleartext := bytes.Repeat([]byte("roe roe roe "), 10000)
+	cleanpath := filepath.Join(tmpdir, "roe.txt")
+	ioutil.WriteFile(cleanpath, cleartext, 0644)
+	comp := CompressionParams{Algorithm: Zstd, Level: defaultZstdLevel}
+	if err := encryptFile(cleanpath, tmpdir, "foobar", EncryptOptions{Split: MaxSplit, Compression: comp}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(tmpdir, "roe.txt.bmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewDecryptReader(f, []Identity{NewPasswordIdentity("foobar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, cleartext) {
+		t.Errorf("decompressed data differs")
+	}
+}
+
+func Test_spoolSection(t *testing.T) {
+	// in memory, then in a temporary file
+	for _, size := range []int{3*chunkSize + 100, spoolMemory + chunkSize/2} {
+		clear := make([]byte, size)
+		rand.Read(clear)
+
+		sp, err := newSpool()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sp.close()
+		for p := clear; len(p) > 0; p = p[1000:] {
+			if len(p) < 1000 {
+				sp.Write(p)
+				break
+			}
+			sp.Write(p[:1000])
+		}
+		if err := sp.seal(true); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, s := range [][2]int{{0, size}, {0, 10}, {chunkSize - 5, 10}, {chunkSize, chunkSize}, {2*chunkSize + 1, size - 2*chunkSize - 1}, {size, 0}} {
+			r, err := sp.section(int64(s[0]), int64(s[1]))
+			if err != nil {
+				t.Fatalf("size %d, section %v: %v", size, s, err)
+			}
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Errorf("size %d, section %v: %v", size, s, err)
+			} else if !bytes.Equal(data, clear[s[0]:s[0]+s[1]]) {
+				t.Errorf("size %d, section %v: the data differs", size, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package roe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// wavHeader is the header of a PCM wav file, with its format and data chunks.
+type wavHeader struct {
+	ChunkID       [4]byte
+	ChunkSize     uint32
+	Format        [4]byte
+	FmtID         [4]byte
+	FmtSize       uint32
+	AudioFormat   uint16
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+	DataID        [4]byte
+	DataSize      uint32
+}
+
+// wavHeaderSize is the size of wavHeader, the RIFF chunk size counts all of it but
+// its first 8 bytes.
+const wavHeaderSize = 44
+
+// wavContainer stores the payload in the samples of a 16 bits stereo sound at 44.1 kHz,
+// the sound is heard as noise.
+type wavContainer struct{}
+
+func (wavContainer) Name() string { return "wav" }
+
+func (wavContainer) Ext() string { return ".wav" }
+
+// Capacity is the largest data chunk made of whole samples, the size of the RIFF chunk
+// is stored in 32 bits.
+func (wavContainer) Capacity() int64 {
+	return (math.MaxUint32 - (wavHeaderSize - 8)) &^ 3
+}
+
+func (c wavContainer) newWriter(w io.Writer, size int64, rnd io.Reader) (io.WriteCloser, error) {
+	datasize := (size + 3) &^ 3
+	if datasize > c.Capacity() {
+		return nil, fmt.Errorf("%d bytes do not fit in a wav sound, the maximum is about %d bytes", size, c.Capacity())
+	}
+
+	h := wavHeader{
+		ChunkID:       [4]byte{'R', 'I', 'F', 'F'},
+		ChunkSize:     uint32(wavHeaderSize - 8 + datasize),
+		Format:        [4]byte{'W', 'A', 'V', 'E'},
+		FmtID:         [4]byte{'f', 'm', 't', ' '},
+		FmtSize:       16,
+		AudioFormat:   1,
+		Channels:      2,
+		SampleRate:    44100,
+		ByteRate:      44100 * 4,
+		BlockAlign:    4,
+		BitsPerSample: 16,
+		DataID:        [4]byte{'d', 'a', 't', 'a'},
+		DataSize:      uint32(datasize),
+	}
+	if err := binary.Write(w, binary.LittleEndian, h); err != nil {
+		return nil, err
+	}
+	return &fillWriter{w: w, size: datasize, rnd: rnd}, nil
+}
+
+func (wavContainer) match(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WAVE"))
+}
+
+// newReader skips the chunks up to the data one, the format must be PCM.
+func (wavContainer) newReader(r io.Reader) (io.Reader, error) {
+	if _, err := io.CopyN(ioutil.Discard, r, 12); err != nil {
+		return nil, readError(err, "failed to read the wav header")
+	}
+
+	pcm := false
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &chunk); err != nil {
+			return nil, readError(err, "failed to read a wav chunk")
+		}
+
+		switch string(chunk.ID[:]) {
+		case "fmt ":
+			var format uint16
+			if chunk.Size < 2 {
+				return nil, newError(ErrCorrupted, "invalid wav format chunk")
+			}
+			if err := binary.Read(r, binary.LittleEndian, &format); err != nil {
+				return nil, readError(err, "failed to read the wav format")
+			}
+			pcm = format == 1
+			chunk.Size -= 2
+		case "data":
+			if !pcm {
+				return nil, errNotRoePayload
+			}
+			return io.LimitReader(r, int64(chunk.Size)), nil
+		}
+
+		// skip the rest of the chunk, the chunks are aligned on 2 bytes
+		if _, err := io.CopyN(ioutil.Discard, r, int64(chunk.Size)+int64(chunk.Size&1)); err != nil {
+			return nil, readError(err, "failed to read a wav chunk")
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package roe
+
+// xattrSupported is true when the extended attributes can be read and written
+const xattrSupported = false
+
+func readXattrs(fp string) ([]xattr, error) {
+	return nil, nil
+}
+
+func writeXattrs(fp string, attrs []xattr) error {
+	return nil
+}
@@ -0,0 +1,75 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package roe
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrSupported is true when the extended attributes can be read and written
+const xattrSupported = true
+
+// keepXattr returns true for the attributes stored in the images. On linux only the
+// user namespace is kept, the others (security, system, trusted) are tied to the
+// machine or need privileges to be restored.
+func keepXattr(name string) bool {
+	if runtime.GOOS == "linux" {
+		return strings.HasPrefix(name, "user.")
+	}
+	return true
+}
+
+// readXattrs returns the extended attributes of fp.
+func readXattrs(fp string) ([]xattr, error) {
+	size, err := unix.Listxattr(fp, nil)
+	if err != nil || size == 0 {
+		return nil, ignoreNotSupported(err)
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Listxattr(fp, buf); err != nil {
+		return nil, ignoreNotSupported(err)
+	}
+
+	attrs := make([]xattr, 0)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 || !keepXattr(string(name)) {
+			continue
+		}
+		size, err := unix.Getxattr(fp, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = unix.Getxattr(fp, string(name), value); err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, xattr{Name: string(name), Value: value[:size]})
+	}
+	return attrs, nil
+}
+
+// writeXattrs sets the extended attributes of fp.
+func writeXattrs(fp string, attrs []xattr) error {
+	for _, a := range attrs {
+		if !keepXattr(a.Name) {
+			continue
+		}
+		if err := unix.Setxattr(fp, a.Name, a.Value, 0); err != nil {
+			return ignoreNotSupported(err)
+		}
+	}
+	return nil
+}
+
+// ignoreNotSupported hides the errors of the file systems without extended attributes
+func ignoreNotSupported(err error) error {
+	if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}